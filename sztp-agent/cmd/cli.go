@@ -1,8 +1,12 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/TwiN/go-color"
 	"github.com/spf13/cobra"
@@ -31,3 +35,16 @@ func RootCmd() *cobra.Command {
 
 	return c
 }
+
+// runUntilSignal runs the bootstrap sequence until it ends, or until SIGTERM or SIGINT is received.
+// The agent then stops cleanly, the aborted bootstrap sequence is not an error.
+func runUntilSignal(run func(ctx context.Context) error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := run(ctx)
+	if err != nil && ctx.Err() != nil && errors.Is(err, context.Canceled) {
+		log.Println("[INFO] Stopped by a signal: ", err)
+		return nil
+	}
+	return err
+}
@@ -10,6 +10,7 @@ package cmd
 
 import (
 	"fmt"
+	"log"
 	"net/url"
 	"os"
 
@@ -25,16 +26,30 @@ func init() {
 // Run returns the run command
 func Run() *cobra.Command {
 	var (
-		bootstrapURL             string
-		serialNumber             string
-		dhcpLeaseFile            string
-		devicePassword           string
-		devicePrivateKey         string
-		deviceEndEntityCert      string
-		bootstrapTrustAnchorCert string
-		statusFilePath           string
-		resultFilePath           string
-		symLinkDir               string
+		bootstrapURL                string
+		serialNumber                string
+		dhcpLeaseFile               string
+		dhcp6LeaseFile              string
+		dhcpClientInterface         string
+		dhcpInterfacePriority       []string
+		dnsDiscovery                bool
+		bootstrapSources            []string
+		removableStoragePath        string
+		devicePassword              string
+		devicePrivateKey            string
+		deviceEndEntityCert         string
+		bootstrapTrustAnchorCert    string
+		manufacturerTrustAnchorCert string
+		imageSigningTrustAnchor     string
+		imageSignatureFormat        string
+		noncelessVoucher            bool
+		insecure                    bool
+		statusFilePath              string
+		resultFilePath              string
+		symLinkDir                  string
+		stateFilePath               string
+		imageInstaller              secureagent.ImageInstallerConfig
+		rebootCommand               string
 	)
 
 	cmd := &cobra.Command{
@@ -42,14 +57,43 @@ func Run() *cobra.Command {
 		Short: "Exec the run command",
 		RunE: func(_ *cobra.Command, _ []string) error {
 			arrayChecker := []string{devicePrivateKey, deviceEndEntityCert, bootstrapTrustAnchorCert, statusFilePath, resultFilePath}
-			if bootstrapURL != "" && dhcpLeaseFile != "" {
-				return fmt.Errorf("'--bootstrap-url' and '--dhcp-lease-file' are mutualy exclusive")
+			// The bootstrap sources may combine the discovery options, in the given order
+			if len(bootstrapSources) == 0 {
+				if bootstrapURL != "" && dhcpLeaseFile != "" {
+					return fmt.Errorf("'--bootstrap-url' and '--dhcp-lease-file' are mutualy exclusive")
+				}
+				if bootstrapURL != "" && dhcp6LeaseFile != "" {
+					return fmt.Errorf("'--bootstrap-url' and '--dhcp6-lease-file' are mutualy exclusive")
+				}
+				if dhcpClientInterface != "" && (bootstrapURL != "" || dhcpLeaseFile != "" || dhcp6LeaseFile != "") {
+					return fmt.Errorf("'--dhcp-client-interface' is mutualy exclusive with '--bootstrap-url' and the lease files")
+				}
+			}
+			if removableStoragePath != "" && (bootstrapURL != "" || dhcpLeaseFile != "" || dhcp6LeaseFile != "" || dhcpClientInterface != "" || dnsDiscovery || len(bootstrapSources) > 0) {
+				return fmt.Errorf("'--removable-storage-path' is mutualy exclusive with the bootstrap server discovery options")
+			}
+			if removableStoragePath != "" {
+				info, err := os.Stat(removableStoragePath)
+				cobra.CheckErr(err)
+				if !info.IsDir() {
+					return fmt.Errorf("must be a folder: %q", removableStoragePath)
+				}
 			}
-			if bootstrapURL == "" && dhcpLeaseFile == "" {
-				return fmt.Errorf("'--bootstrap-url' or '--dhcp-lease-file' is required")
+			// The lease files may be directories, such as /run/systemd/netif/leases
+			for _, leaseFile := range []string{dhcpLeaseFile, dhcp6LeaseFile} {
+				if leaseFile != "" {
+					_, err := os.Stat(leaseFile)
+					cobra.CheckErr(err)
+				}
+			}
+			if manufacturerTrustAnchorCert != "" {
+				arrayChecker = append(arrayChecker, manufacturerTrustAnchorCert)
 			}
-			if dhcpLeaseFile != "" {
-				arrayChecker = append(arrayChecker, dhcpLeaseFile)
+			if imageSigningTrustAnchor != "" {
+				arrayChecker = append(arrayChecker, imageSigningTrustAnchor)
+			}
+			if imageSignatureFormat != secureagent.ImageSignatureCMS && imageSignatureFormat != secureagent.ImageSignatureMinisign {
+				return fmt.Errorf("'--image-signature-format' must be 'cms' or 'minisign': %q", imageSignatureFormat)
 			}
 			if bootstrapURL != "" {
 				_, err := url.ParseRequestURI(bootstrapURL)
@@ -62,9 +106,37 @@ func Run() *cobra.Command {
 					return fmt.Errorf("must not be folder: %q", filePath)
 				}
 			}
+			installer, err := secureagent.NewImageInstaller(imageInstaller)
+			if err != nil {
+				return err
+			}
 			client := secureagent.NewHTTPClient(bootstrapTrustAnchorCert, deviceEndEntityCert, devicePrivateKey)
+			if insecure {
+				log.Println("[WARNING] '--insecure' is set, the bootstrap server will not be authenticated")
+				client = secureagent.NewInsecureHTTPClient(deviceEndEntityCert, devicePrivateKey)
+			}
 			a := secureagent.NewAgent(bootstrapURL, serialNumber, dhcpLeaseFile, devicePassword, devicePrivateKey, deviceEndEntityCert, bootstrapTrustAnchorCert, statusFilePath, resultFilePath, symLinkDir, &client)
-			return a.RunCommand()
+			a.SetManufacturerTrustAnchorCert(manufacturerTrustAnchorCert)
+			a.SetDhcp6LeaseFile(dhcp6LeaseFile)
+			a.SetDhcpClientInterface(dhcpClientInterface)
+			a.SetDhcpInterfacePriority(dhcpInterfacePriority)
+			a.SetDnsDiscovery(dnsDiscovery)
+			if len(bootstrapSources) > 0 {
+				sources, err := a.NamedBootstrapSources(bootstrapSources)
+				if err != nil {
+					return err
+				}
+				a.SetBootstrapSources(sources)
+			}
+			a.SetRemovableStoragePath(removableStoragePath)
+			a.SetNoncelessVoucher(noncelessVoucher)
+			a.SetInsecure(insecure)
+			a.SetStateFilePath(stateFilePath)
+			a.SetImageInstaller(installer)
+			a.SetRebootCommand(rebootCommand)
+			a.SetImageSigningTrustAnchor(imageSigningTrustAnchor)
+			a.SetImageSignatureFormat(imageSignatureFormat)
+			return runUntilSignal(a.RunCommand)
 		},
 	}
 
@@ -73,14 +145,35 @@ func Run() *cobra.Command {
 	// Opened discussion to define the procedure: https://github.com/opiproject/sztp/issues/2
 	flags.StringVar(&bootstrapURL, "bootstrap-url", "", "Bootstrap server URL. Mutually exclusive with '--dhcp-lease-file'")
 	flags.StringVar(&serialNumber, "serial-number", "", "Device's serial number. If empty, discover via SMBIOS")
-	flags.StringVar(&dhcpLeaseFile, "dhcp-lease-file", "", "Device's dhclient leases file. Mutually exclusive with '--bootstrap-url'")
+	flags.StringVar(&dhcpLeaseFile, "dhcp-lease-file", "", "Device's DHCP lease file or directory, dhclient, systemd-networkd or dhcpcd format detected automatically. Mutually exclusive with '--bootstrap-url'. If both are empty, discover via NetworkManager")
+	flags.StringVar(&dhcp6LeaseFile, "dhcp6-lease-file", "", "Device's dhclient6 leases file, its URLs are merged with the '--dhcp-lease-file' ones. Mutually exclusive with '--bootstrap-url'")
+	flags.StringVar(&dhcpClientInterface, "dhcp-client-interface", "", "Request the bootstrap URL with the built-in DHCP client on this interface, without configuring its address, instead of reading a lease file")
+	flags.StringSliceVar(&dhcpInterfacePriority, "dhcp-interface-priority", nil, "Interfaces whose DHCP bootstrap URLs are tried first, in order. Other interfaces follow, most recent lease first")
+	flags.BoolVar(&dnsDiscovery, "dns-discovery", false, "Also discover the signed bootstrapping data from the _sztp TXT records and the bootstrap servers from the _sztp SRV records, over unicast DNS and mDNS")
+	flags.StringSliceVar(&bootstrapSources, "bootstrap-sources", nil, "Bootstrap sources tried in order, configured by their options: 'bootstrap-url', 'dhcp-lease-file', 'dhcp-client', 'network-manager' or 'dns'. If empty, selected by the discovery options")
+	flags.StringVar(&removableStoragePath, "removable-storage-path", "", "Mounted removable storage holding the signed conveyed-information.cms, owner-certificate.cms and ownership-voucher.vcj, used instead of a bootstrap server")
 	flags.StringVar(&devicePassword, "device-password", "my-secret", "Device's password")
 	flags.StringVar(&devicePrivateKey, "device-private-key", "/certs/private_key.pem", "Device's private key")
 	flags.StringVar(&deviceEndEntityCert, "device-end-entity-cert", "/certs/my_cert.pem", "Device's End Entity cert")
 	flags.StringVar(&bootstrapTrustAnchorCert, "bootstrap-trust-anchor-cert", "/certs/opi.pem", "Bootstrap server trust anchor Cert")
+	flags.StringVar(&manufacturerTrustAnchorCert, "manufacturer-trust-anchor-cert", "", "Manufacturer trust anchor Cert used to verify ownership vouchers")
+	flags.BoolVar(&noncelessVoucher, "nonceless-voucher", false, "Do not send a nonce, requesting a nonceless ownership voucher")
+	flags.BoolVar(&insecure, "insecure", false, "Do not authenticate the bootstrap server, its conveyed-information must be signed. For lab environments only")
 	flags.StringVar(&statusFilePath, "status-file-path", "/var/lib/sztp/status.json", "Status file path")
 	flags.StringVar(&resultFilePath, "result-file-path", "/var/lib/sztp/result.json", "Result file path")
 	flags.StringVar(&symLinkDir, "sym-link-dir", "/run/sztp", "Sym Link Directory")
+	flags.StringVar(&stateFilePath, "state-file-path", "/var/lib/sztp/state.json", "State file the bootstrap sequence resumes from after a reboot. If empty, every run starts from scratch")
+	flags.StringVar(&imageInstaller.Type, "boot-image-installer", "", "Installs the boot image: 'block-device', 'command', 'grub' or 'kexec'. If empty, the boot image is only downloaded and verified")
+	flags.StringVar(&imageInstaller.Device, "boot-image-device", "", "Block device or partition the 'block-device' installer writes the boot image to")
+	flags.StringVar(&imageInstaller.Command, "boot-image-command", "", "Vendor install command of the 'command' installer, run by /bin/sh with the boot image path as $1")
+	flags.StringVar(&imageInstaller.Path, "boot-image-path", "", "Path the 'grub' installer copies the boot image to, booted by the '--boot-image-grub-entry' menu entry")
+	flags.StringVar(&imageInstaller.GrubEntry, "boot-image-grub-entry", "", "GRUB menu entry the 'grub' installer boots once, with the '--boot-image-grub-command'")
+	flags.StringVar(&imageInstaller.GrubCommand, "boot-image-grub-command", "grub-reboot", "Command the 'grub' installer boots its menu entry once with, e.g. 'grub2-reboot' on some distributions")
+	flags.StringVar(&imageInstaller.Initrd, "boot-image-kexec-initrd", "", "Initrd the 'kexec' installer loads along with the boot image kernel")
+	flags.StringVar(&imageInstaller.CommandLine, "boot-image-kexec-cmdline", "", "Kernel command line of the 'kexec' installer. If empty, the current one is reused")
+	flags.StringVar(&rebootCommand, "reboot-command", "systemctl reboot", "Command rebooting the device into the installed boot image, the 'kexec' installer runs 'systemctl kexec' instead")
+	flags.StringVar(&imageSigningTrustAnchor, "image-signing-trust-anchor", "", "Trust anchor the detached boot image signature is verified against, a PEM certificate for 'cms' or a minisign public key. If empty, the boot image is verified with its hashes only")
+	flags.StringVar(&imageSignatureFormat, "image-signature-format", secureagent.ImageSignatureCMS, "Format of the detached boot image signature, downloaded from the download-uri with its extension: 'cms' (.p7s) or 'minisign' (.minisig)")
 
 	return cmd
 }
@@ -0,0 +1,90 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package dhcp implements the DHCP client
+package dhcp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+)
+
+// OptionSZTPRedirect is the DHCPv4 sztp-redirect-urls option (RFC 8572)
+const OptionSZTPRedirect = dhcpv4.GenericOptionCode(143)
+
+// RequestBootstrapURLs runs a DHCPDISCOVER/DHCPREQUEST exchange on an interface, asking for
+// the sztp-redirect-urls option, and returns the URLs of the DHCPACK. The interface may be
+// unconfigured and the offered address is not configured, it is released with a DHCPRELEASE.
+//
+// Parameters:
+// - ctx: bounds the exchange.
+// - iface: the interface to send the requests on.
+//
+// Returns:
+// - []BootstrapURL: the Bootstrap URLs of the DHCPACK.
+// - error: an error if no DHCPACK is received or it has no sztp-redirect-urls option.
+func RequestBootstrapURLs(ctx context.Context, iface string) ([]BootstrapURL, error) {
+	client, err := nclient4.New(iface)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := client.Close(); err != nil {
+			log.Println("[ERROR] Error when closing:", err)
+		}
+	}()
+	return requestBootstrapURLs(ctx, client, iface)
+}
+
+func requestBootstrapURLs(ctx context.Context, client *nclient4.Client, iface string) ([]BootstrapURL, error) {
+	// The modifiers apply to both the DHCPDISCOVER and the DHCPREQUEST
+	lease, err := client.Request(ctx, dhcpv4.WithRequestedOptions(OptionSZTPRedirect))
+	if err != nil {
+		return nil, err
+	}
+	// The offered address is not used, give it back once the options are read
+	defer func() {
+		if err := releaseLease(iface, lease); err != nil {
+			log.Println("[WARNING] Failed to release the DHCP lease:", err)
+		}
+	}()
+	value := lease.ACK.GetOneOption(OptionSZTPRedirect)
+	if len(value) == 0 {
+		return nil, fmt.Errorf("no sztp-redirect-urls option in the DHCPACK of %s", lease.ACK.ServerIdentifier())
+	}
+	urls := decodeOptionValue(value)
+	candidates := make([]BootstrapURL, 0, len(urls))
+	for _, url := range urls {
+		candidates = append(candidates, BootstrapURL{URL: url, Interface: iface, Lease: int(lease.CreationTime.Unix())})
+	}
+	return candidates, nil
+}
+
+// releaseLease sends the DHCPRELEASE of a lease. It is broadcast as the interface has no address,
+// the unicast one of nclient4 would come from 0.0.0.0 and be dropped by the server.
+func releaseLease(iface string, lease *nclient4.Lease) error {
+	release, err := dhcpv4.NewReleaseFromACK(lease.ACK)
+	if err != nil {
+		return err
+	}
+	conn, err := nclient4.NewRawUDPConn(iface, nclient4.ClientPort)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Println("[ERROR] Error when closing:", err)
+		}
+	}()
+	_, err = conn.WriteTo(release.ToBytes(), &net.UDPAddr{IP: net.IPv4bcast, Port: nclient4.ServerPort})
+	return err
+}
@@ -0,0 +1,178 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package dhcp implements the DHCP client
+package dhcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+)
+
+// newTestVethPair creates a veth pair, the server end gets an address and the client end stays unconfigured
+func newTestVethPair(t *testing.T) (string, string) {
+	t.Helper()
+	client := fmt.Sprintf("sztp%d", os.Getpid()%100000)
+	server := client + "s"
+	commands := [][]string{
+		{"link", "add", client, "type", "veth", "peer", "name", server},
+		{"addr", "add", "192.0.2.1/24", "dev", server},
+		{"link", "set", server, "up"},
+		{"link", "set", client, "up"},
+	}
+	for i, args := range commands {
+		// nolint:gosec
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			if i == 0 {
+				t.Skipf("cannot create a veth pair: %v %s", err, out)
+			}
+			t.Fatalf("ip %v: %v %s", args, err, out)
+		}
+		if i == 0 {
+			t.Cleanup(func() { _ = exec.Command("ip", "link", "del", client).Run() })
+		}
+	}
+	return client, server
+}
+
+// isSZTPRedirectRequested compares the codes, the parsed requests hold the named option 143 of the dhcpv4 package
+func isSZTPRedirectRequested(m *dhcpv4.DHCPv4) bool {
+	for _, code := range m.ParameterRequestList() {
+		if code.Code() == OptionSZTPRedirect.Code() {
+			return true
+		}
+	}
+	return false
+}
+
+// startTestDHCPServer answers every DHCPDISCOVER and DHCPREQUEST with the given sztp-redirect-urls option,
+// the DHCPREQUEST and DHCPRELEASE messages are sent to the returned channel
+func startTestDHCPServer(t *testing.T, iface string, redirectURLs []byte) <-chan *dhcpv4.DHCPv4 {
+	t.Helper()
+	requests := make(chan *dhcpv4.DHCPv4, 4)
+	serverIP := net.IPv4(192, 0, 2, 1)
+	handler := func(conn net.PacketConn, _ net.Addr, m *dhcpv4.DHCPv4) {
+		var messageType dhcpv4.MessageType
+		switch m.MessageType() {
+		case dhcpv4.MessageTypeDiscover:
+			messageType = dhcpv4.MessageTypeOffer
+		case dhcpv4.MessageTypeRequest:
+			messageType = dhcpv4.MessageTypeAck
+			requests <- m
+		case dhcpv4.MessageTypeRelease:
+			requests <- m
+			return
+		default:
+			return
+		}
+		modifiers := []dhcpv4.Modifier{
+			dhcpv4.WithMessageType(messageType),
+			dhcpv4.WithYourIP(net.IPv4(192, 0, 2, 100)),
+			dhcpv4.WithServerIP(serverIP),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP)),
+			dhcpv4.WithLeaseTime(600),
+		}
+		if redirectURLs != nil && isSZTPRedirectRequested(m) {
+			modifiers = append(modifiers, dhcpv4.WithGeneric(OptionSZTPRedirect, redirectURLs))
+		}
+		reply, err := dhcpv4.NewReplyFromRequest(m, modifiers...)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := conn.WriteTo(reply.ToBytes(), &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}); err != nil {
+			t.Error(err)
+		}
+	}
+	server, err := server4.NewServer(iface, &net.UDPAddr{Port: dhcpv4.ServerPort}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve() }()
+	t.Cleanup(func() { _ = server.Close() })
+	return requests
+}
+
+func TestRequestBootstrapURLs(t *testing.T) {
+	tests := []struct {
+		name         string
+		redirectURLs []byte
+		want         []string
+		wantErr      bool
+	}{
+		{
+			name:         "text option",
+			redirectURLs: []byte("https://bootstrap:8080/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data"),
+			want:         []string{"https://bootstrap:8080/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data"},
+		},
+		{
+			name:         "bootstrap-server-list option",
+			redirectURLs: append(append([]byte{0, 9}, []byte("https://a")...), append([]byte{0, 9}, []byte("https://b")...)...),
+			want:         []string{"https://a", "https://b"},
+		},
+		{
+			name:    "no option in the DHCPACK",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newTestVethPair(t)
+			requests := startTestDHCPServer(t, server, tt.redirectURLs)
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			got, err := RequestBootstrapURLs(ctx, client)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RequestBootstrapURLs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			request := <-requests
+			if !isSZTPRedirectRequested(request) {
+				t.Errorf("DHCPREQUEST does not request option 143: %v", request.ParameterRequestList())
+			}
+			select {
+			case release := <-requests:
+				if release.MessageType() != dhcpv4.MessageTypeRelease || !release.ClientIPAddr.Equal(net.IPv4(192, 0, 2, 100)) {
+					t.Errorf("RequestBootstrapURLs() sent %v instead of releasing the lease", release.MessageType())
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("RequestBootstrapURLs() did not release the lease")
+			}
+			if tt.wantErr {
+				return
+			}
+			urls := make([]string, 0, len(got))
+			for _, candidate := range got {
+				urls = append(urls, candidate.URL)
+				if candidate.Interface != client {
+					t.Errorf("RequestBootstrapURLs() interface = %v, want %v", candidate.Interface, client)
+				}
+			}
+			if !reflect.DeepEqual(urls, tt.want) {
+				t.Errorf("RequestBootstrapURLs() got = %v, want %v", urls, tt.want)
+			}
+			// The offered address is not configured
+			iface, err := net.InterfaceByName(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs, err := iface.Addrs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, addr := range addrs {
+				if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+					t.Errorf("RequestBootstrapURLs() configured %v on %s", addr, client)
+				}
+			}
+		})
+	}
+}
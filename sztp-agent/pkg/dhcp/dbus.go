@@ -7,3 +7,236 @@ Copyright (C) 2022 Red Hat.
 
 // Package dhcp implements the DHCP client
 package dhcp
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"strconv"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// NetworkManager D-Bus names
+const (
+	nmBusName                = "org.freedesktop.NetworkManager"
+	nmObjectPath             = "/org/freedesktop/NetworkManager"
+	nmInterface              = "org.freedesktop.NetworkManager"
+	nmActiveConnectionIface  = "org.freedesktop.NetworkManager.Connection.Active"
+	nmDeviceInterface        = "org.freedesktop.NetworkManager.Device"
+	nmDHCP4ConfigInterface   = "org.freedesktop.NetworkManager.DHCP4Config"
+	nmDHCP6ConfigInterface   = "org.freedesktop.NetworkManager.DHCP6Config"
+	dbusPropertiesInterface  = "org.freedesktop.DBus.Properties"
+	dbusPropertiesChanged    = "PropertiesChanged"
+	nmDHCPOptionExpiry       = "expiry"
+	nmDHCPOptionLeaseTime    = "dhcp_lease_time"
+	nmDHCP4OptionRedirectURL = "sztp_redirect_urls"       // DHCPv4 option 143
+	nmDHCP6OptionRedirectURL = "dhcp6_sztp_redirect_urls" // DHCPv6 option 136
+)
+
+// NetworkManager reads the sztp-redirect-urls option of the DHCP leases obtained by NetworkManager
+type NetworkManager struct {
+	conn *dbus.Conn
+}
+
+// ConnectNetworkManager connects to NetworkManager on the system bus
+func ConnectNetworkManager() (*NetworkManager, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return NewNetworkManager(conn), nil
+}
+
+// NewNetworkManager reaches NetworkManager through an existing bus connection
+func NewNetworkManager(conn *dbus.Conn) *NetworkManager {
+	return &NetworkManager{conn: conn}
+}
+
+// Close closes the bus connection
+func (nm *NetworkManager) Close() error {
+	return nm.conn.Close()
+}
+
+// GetBootstrapURLs retrieves the Bootstrap URLs from the DHCPv4 and DHCPv6 options of the
+// connections activated by NetworkManager.
+//
+// Returns:
+// - []BootstrapURL: the Bootstrap URLs, with the interface of the connection they came from.
+// - error: an error if NetworkManager cannot be queried.
+func (nm *NetworkManager) GetBootstrapURLs() ([]BootstrapURL, error) {
+	var activeConnections []dbus.ObjectPath
+	if err := nm.getProperty(nmObjectPath, nmInterface, "ActiveConnections", &activeConnections); err != nil {
+		return nil, err
+	}
+	var candidates []BootstrapURL
+	for _, activeConnection := range activeConnections {
+		urls, err := nm.getActiveConnectionBootstrapURLs(activeConnection)
+		if err != nil {
+			// The connection may have been deactivated in the meantime
+			log.Printf("[ERROR] Failed to read the DHCP options of %s: %v", activeConnection, err)
+			continue
+		}
+		candidates = append(candidates, urls...)
+	}
+	return candidates, nil
+}
+
+// WatchBootstrapURLs returns the current Bootstrap URLs, then sends them every time they change,
+// for instance when a new lease arrives, until the context is done. The watch starts before the
+// current URLs are read so that no lease arriving in between is missed.
+func (nm *NetworkManager) WatchBootstrapURLs(ctx context.Context) ([]BootstrapURL, <-chan []BootstrapURL, error) {
+	options := []dbus.MatchOption{
+		dbus.WithMatchSender(nmBusName),
+		dbus.WithMatchInterface(dbusPropertiesInterface),
+		dbus.WithMatchMember(dbusPropertiesChanged),
+	}
+	if err := nm.conn.AddMatchSignal(options...); err != nil {
+		return nil, nil, err
+	}
+	signals := make(chan *dbus.Signal, 16)
+	nm.conn.Signal(signals)
+	current, err := nm.GetBootstrapURLs()
+	if err != nil {
+		nm.conn.RemoveSignal(signals)
+		_ = nm.conn.RemoveMatchSignal(options...)
+		return nil, nil, err
+	}
+	initial := current
+
+	updates := make(chan []BootstrapURL)
+	go func() {
+		defer close(updates)
+		defer func() {
+			nm.conn.RemoveSignal(signals)
+			_ = nm.conn.RemoveMatchSignal(options...)
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case signal, ok := <-signals:
+				if !ok {
+					return
+				}
+				if !isNetworkManagerLeaseChange(signal) {
+					continue
+				}
+				candidates, err := nm.GetBootstrapURLs()
+				if err != nil {
+					log.Println("[ERROR] Failed to read the DHCP options from NetworkManager:", err)
+					continue
+				}
+				if reflect.DeepEqual(candidates, current) {
+					continue
+				}
+				current = candidates
+				select {
+				case updates <- candidates:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return initial, updates, nil
+}
+
+func (nm *NetworkManager) getActiveConnectionBootstrapURLs(activeConnection dbus.ObjectPath) ([]BootstrapURL, error) {
+	var devices []dbus.ObjectPath
+	if err := nm.getProperty(activeConnection, nmActiveConnectionIface, "Devices", &devices); err != nil {
+		return nil, err
+	}
+	var iface string
+	if len(devices) > 0 {
+		if err := nm.getProperty(devices[0], nmDeviceInterface, "Interface", &iface); err != nil {
+			return nil, err
+		}
+	}
+	var candidates []BootstrapURL
+	configs := []struct {
+		property string
+		iface    string
+		option   string
+	}{
+		{"Dhcp4Config", nmDHCP4ConfigInterface, nmDHCP4OptionRedirectURL},
+		{"Dhcp6Config", nmDHCP6ConfigInterface, nmDHCP6OptionRedirectURL},
+	}
+	for _, config := range configs {
+		var path dbus.ObjectPath
+		if err := nm.getProperty(activeConnection, nmActiveConnectionIface, config.property, &path); err != nil {
+			return nil, err
+		}
+		// "/" means the connection has no DHCP configuration for this family
+		if path == "/" || !path.IsValid() {
+			continue
+		}
+		var dhcpOptions map[string]dbus.Variant
+		if err := nm.getProperty(path, config.iface, "Options", &dhcpOptions); err != nil {
+			return nil, err
+		}
+		value, ok := dhcpOptions[config.option]
+		if !ok {
+			continue
+		}
+		lease := leaseStart(dhcpOptions)
+		for _, url := range decodeRedirectURLs(variantString(value)) {
+			candidates = append(candidates, BootstrapURL{URL: url, Interface: iface, Lease: lease})
+		}
+	}
+	return candidates, nil
+}
+
+// leaseStart returns when a lease started or was last renewed, its expiry minus its lease time, 0 if unknown
+func leaseStart(dhcpOptions map[string]dbus.Variant) int {
+	expiry, ok := dhcpOptions[nmDHCPOptionExpiry]
+	if !ok {
+		return 0
+	}
+	leaseTime, ok := dhcpOptions[nmDHCPOptionLeaseTime]
+	if !ok {
+		return 0
+	}
+	end, err := strconv.Atoi(variantString(expiry))
+	if err != nil {
+		return 0
+	}
+	duration, err := strconv.Atoi(variantString(leaseTime))
+	if err != nil {
+		return 0
+	}
+	return end - duration
+}
+
+func (nm *NetworkManager) getProperty(path dbus.ObjectPath, iface, property string, value interface{}) error {
+	variant, err := nm.conn.Object(nmBusName, path).GetProperty(iface + "." + property)
+	if err != nil {
+		return err
+	}
+	return variant.Store(value)
+}
+
+// isNetworkManagerLeaseChange tells whether a PropertiesChanged signal may change the bootstrap URLs
+func isNetworkManagerLeaseChange(signal *dbus.Signal) bool {
+	if signal.Name != dbusPropertiesInterface+"."+dbusPropertiesChanged || len(signal.Body) == 0 {
+		return false
+	}
+	iface, ok := signal.Body[0].(string)
+	if !ok {
+		return false
+	}
+	switch iface {
+	case nmInterface, nmActiveConnectionIface, nmDHCP4ConfigInterface, nmDHCP6ConfigInterface:
+		return true
+	default:
+		return false
+	}
+}
+
+// variantString returns the value of an option, NetworkManager exposes them as strings
+func variantString(v dbus.Variant) string {
+	if s, ok := v.Value().(string); ok {
+		return s
+	}
+	return ""
+}
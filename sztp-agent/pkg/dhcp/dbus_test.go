@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package dhcp implements the DHCP client
+package dhcp
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const testBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%DIR%/bus</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startTestBus starts a private bus and returns its address
+func startTestBus(t *testing.T) string {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not available")
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(config, []byte(strings.ReplaceAll(testBusConfig, "%DIR%", dir)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(address)
+}
+
+func connectTestBus(t *testing.T, address string) *dbus.Conn {
+	t.Helper()
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func exportTestProperties(t *testing.T, conn *dbus.Conn, path dbus.ObjectPath, iface string, props map[string]interface{}) *prop.Properties {
+	t.Helper()
+	spec := map[string]*prop.Prop{}
+	for name, value := range props {
+		spec[name] = &prop.Prop{Value: value, Emit: prop.EmitTrue}
+	}
+	properties, err := prop.Export(conn, path, prop.Map{iface: spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return properties
+}
+
+// fakeNetworkManager exports a Network Manager with a single active connection on eth0
+type fakeNetworkManager struct {
+	dhcp4 *prop.Properties
+}
+
+func newFakeNetworkManager(t *testing.T, conn *dbus.Conn, dhcp4Options, dhcp6Options map[string]dbus.Variant) *fakeNetworkManager {
+	t.Helper()
+	activeConnection := dbus.ObjectPath("/org/freedesktop/NetworkManager/ActiveConnection/1")
+	device := dbus.ObjectPath("/org/freedesktop/NetworkManager/Devices/2")
+	dhcp4 := dbus.ObjectPath("/org/freedesktop/NetworkManager/DHCP4Config/3")
+	dhcp6 := dbus.ObjectPath("/")
+	if dhcp6Options != nil {
+		dhcp6 = "/org/freedesktop/NetworkManager/DHCP6Config/4"
+		exportTestProperties(t, conn, dhcp6, nmDHCP6ConfigInterface, map[string]interface{}{"Options": dhcp6Options})
+	}
+	exportTestProperties(t, conn, nmObjectPath, nmInterface, map[string]interface{}{
+		"ActiveConnections": []dbus.ObjectPath{activeConnection},
+	})
+	exportTestProperties(t, conn, activeConnection, nmActiveConnectionIface, map[string]interface{}{
+		"Devices":     []dbus.ObjectPath{device},
+		"Dhcp4Config": dhcp4,
+		"Dhcp6Config": dhcp6,
+	})
+	exportTestProperties(t, conn, device, nmDeviceInterface, map[string]interface{}{"Interface": "eth0"})
+	nm := &fakeNetworkManager{
+		dhcp4: exportTestProperties(t, conn, dhcp4, nmDHCP4ConfigInterface, map[string]interface{}{"Options": dhcp4Options}),
+	}
+	reply, err := conn.RequestName(nmBusName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("failed to own %s: %v", nmBusName, err)
+	}
+	return nm
+}
+
+func TestNetworkManager_GetBootstrapURLs(t *testing.T) {
+	tests := []struct {
+		name         string
+		dhcp4Options map[string]dbus.Variant
+		dhcp6Options map[string]dbus.Variant
+		want         []BootstrapURL
+	}{
+		{
+			name: "DHCPv4 lease with several URLs",
+			dhcp4Options: map[string]dbus.Variant{
+				"ip_address":             dbus.MakeVariant("10.0.0.5"),
+				"expiry":                 dbus.MakeVariant("1700003600"),
+				"dhcp_lease_time":        dbus.MakeVariant("3600"),
+				nmDHCP4OptionRedirectURL: dbus.MakeVariant("https://bootstrap1:8080/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data, https://bootstrap2:8080"),
+			},
+			want: []BootstrapURL{
+				{URL: "https://bootstrap1:8080/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data", Interface: "eth0", Lease: 1700000000},
+				{URL: "https://bootstrap2:8080", Interface: "eth0", Lease: 1700000000},
+			},
+		},
+		{
+			name:         "DHCPv4 and DHCPv6 leases",
+			dhcp4Options: map[string]dbus.Variant{nmDHCP4OptionRedirectURL: dbus.MakeVariant(`"https://bootstrap4:8080"`)},
+			dhcp6Options: map[string]dbus.Variant{nmDHCP6OptionRedirectURL: dbus.MakeVariant("0:1a:68:74:74:70:73:3a:2f:2f:5b:32:30:30:31:3a:64:62:38:3a:3a:31:5d:3a:38:30:38:30")},
+			want: []BootstrapURL{
+				{URL: "https://bootstrap4:8080", Interface: "eth0"},
+				{URL: "https://[2001:db8::1]:8080", Interface: "eth0"},
+			},
+		},
+		{
+			name:         "lease without the option",
+			dhcp4Options: map[string]dbus.Variant{"ip_address": dbus.MakeVariant("10.0.0.5")},
+			want:         nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := startTestBus(t)
+			newFakeNetworkManager(t, connectTestBus(t, address), tt.dhcp4Options, tt.dhcp6Options)
+			nm := NewNetworkManager(connectTestBus(t, address))
+			got, err := nm.GetBootstrapURLs()
+			if err != nil {
+				t.Fatalf("GetBootstrapURLs() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetBootstrapURLs() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworkManager_WatchBootstrapURLs(t *testing.T) {
+	address := startTestBus(t)
+	fake := newFakeNetworkManager(t, connectTestBus(t, address), map[string]dbus.Variant{
+		nmDHCP4OptionRedirectURL: dbus.MakeVariant("https://initial:8080"),
+	}, nil)
+	nm := NewNetworkManager(connectTestBus(t, address))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	current, updates, err := nm.WatchBootstrapURLs(ctx)
+	if err != nil {
+		t.Fatalf("WatchBootstrapURLs() error = %v", err)
+	}
+	if want := []BootstrapURL{{URL: "https://initial:8080", Interface: "eth0"}}; !reflect.DeepEqual(current, want) {
+		t.Errorf("WatchBootstrapURLs() current = %v, want %v", current, want)
+	}
+
+	fake.dhcp4.SetMust(nmDHCP4ConfigInterface, "Options", map[string]dbus.Variant{
+		nmDHCP4OptionRedirectURL: dbus.MakeVariant("https://bootstrap:8080"),
+	})
+	want := []BootstrapURL{{URL: "https://bootstrap:8080", Interface: "eth0"}}
+	select {
+	case got := <-updates:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("WatchBootstrapURLs() got = %v, want %v", got, want)
+		}
+	case <-ctx.Done():
+		t.Fatal("WatchBootstrapURLs() did not report the new lease")
+	}
+
+	cancel()
+	for range updates {
+	}
+}
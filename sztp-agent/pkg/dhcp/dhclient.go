@@ -0,0 +1,353 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package dhcp implements the DHCP client
+package dhcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dhclientTimeLayout is the default db-time-format of dhclient, in UTC
+const dhclientTimeLayout = "2006/01/02 15:04:05"
+
+// infiniteLifetime is the DHCPv6 lifetime of the addresses that never expire (RFC 8415 section 7.7)
+const infiniteLifetime = 0xffffffff
+
+// Lease is a lease or lease6 block of a dhclient lease file
+type Lease struct {
+	Interface    string            // the interface the lease was obtained on
+	FixedAddress string            // the leased IPv4 address, or the first leased IPv6 address
+	Renew        time.Time         // when the lease is renewed, zero if unknown
+	Rebind       time.Time         // when the lease is rebound, zero if unknown
+	Expire       time.Time         // when the lease expires, zero if it never does
+	Options      map[string]string // the raw option values by name, e.g. sztp-redirect-urls or dhcp6.sztp-redirect-urls
+}
+
+// Expired tells whether the lease has expired at the given time
+func (l *Lease) Expired(now time.Time) bool {
+	return !l.Expire.IsZero() && !now.Before(l.Expire)
+}
+
+// Option returns the raw value of an option, matched with or without its dhcp6. like prefix
+func (l *Lease) Option(name string) (string, bool) {
+	if value, ok := l.Options[name]; ok {
+		return value, true
+	}
+	names := make([]string, 0, len(l.Options))
+	for option := range l.Options {
+		names = append(names, option)
+	}
+	sort.Strings(names)
+	for _, option := range names {
+		if strings.HasSuffix(option, "."+name) {
+			return l.Options[option], true
+		}
+	}
+	return "", false
+}
+
+// ParseLeases parses the lease and lease6 blocks of a dhclient or dhclient6 lease file.
+//
+// Parameters:
+// - r: the content of the lease file.
+//
+// Returns:
+// - []Lease: the leases in the order of the file, dhclient appends the new leases.
+// - error: an error if the file is not valid dhclient lease syntax.
+func ParseLeases(r io.Reader) ([]Lease, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := tokenizeLeases(data)
+	if err != nil {
+		return nil, err
+	}
+	pos := 0
+	statements, err := parseLeaseStatements(tokens, &pos, false)
+	if err != nil {
+		return nil, err
+	}
+	var leases []Lease
+	for _, statement := range statements {
+		if !statement.isBlock || (statement.words[0] != "lease" && statement.words[0] != "lease6") {
+			continue
+		}
+		lease := Lease{Options: map[string]string{}}
+		if err := lease.parse(statement.block); err != nil {
+			return nil, fmt.Errorf("invalid %s block %d: %w", statement.words[0], len(leases)+1, err)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+// parseDhclientLeases reads the Bootstrap URLs of the leases of dhclient and dhclient6 lease files
+// that have not expired. The leases are dated by their renew time and numbered in the order of the
+// file, the last ones are the most recent.
+func parseDhclientLeases(data []byte, key string) ([]BootstrapURL, error) {
+	leases, err := ParseLeases(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var candidates []BootstrapURL
+	for i := range leases {
+		value, ok := leases[i].Option(key)
+		if !ok {
+			continue
+		}
+		if leases[i].Expired(now) {
+			log.Printf("[INFO] Ignoring the %s of the lease of %s expired on %v", key, leases[i].Interface, leases[i].Expire)
+			continue
+		}
+		lease := 0
+		if !leases[i].Renew.IsZero() {
+			lease = int(leases[i].Renew.Unix())
+		}
+		for _, url := range decodeRedirectURLs(value) {
+			candidates = append(candidates, BootstrapURL{URL: url, Interface: leases[i].Interface, Lease: lease, Position: i + 1})
+		}
+	}
+	return candidates, nil
+}
+
+// leaseStatement is a statement of a lease file, terminated by ; or followed by a { } block
+type leaseStatement struct {
+	words   []string
+	isBlock bool
+	block   []leaseStatement
+}
+
+func (l *Lease) parse(statements []leaseStatement) error {
+	for _, statement := range statements {
+		words := statement.words
+		if statement.isBlock {
+			switch words[0] {
+			case "ia-na", "ia-ta", "ia-pd":
+				if err := l.parseIA(statement.block); err != nil {
+					return fmt.Errorf("%s: %w", words[0], err)
+				}
+			}
+			continue
+		}
+		if len(words) < 2 {
+			continue
+		}
+		var err error
+		switch words[0] {
+		case "interface":
+			l.Interface = strings.Trim(words[1], `"`)
+		case "fixed-address":
+			l.FixedAddress = words[1]
+		case "option":
+			l.Options[words[1]] = strings.Join(words[2:], " ")
+		case "renew":
+			l.Renew, err = parseLeaseTime(words[1:])
+		case "rebind":
+			l.Rebind, err = parseLeaseTime(words[1:])
+		case "expire":
+			l.Expire, err = parseLeaseTime(words[1:])
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", words[0], err)
+		}
+	}
+	return nil
+}
+
+// parseIA reads the times of a DHCPv6 identity association, the lease expires with its last address
+func (l *Lease) parseIA(statements []leaseStatement) error {
+	var starts, renew, rebind int64
+	var never bool
+	for _, statement := range statements {
+		words := statement.words
+		if statement.isBlock {
+			if words[0] != "iaaddr" && words[0] != "iaprefix" {
+				continue
+			}
+			expire, err := parseIAAddress(statement.block)
+			if err != nil {
+				return fmt.Errorf("%s: %w", words[0], err)
+			}
+			if expire.IsZero() {
+				never = true
+			} else if expire.After(l.Expire) {
+				l.Expire = expire
+			}
+			if l.FixedAddress == "" && words[0] == "iaaddr" && len(words) > 1 {
+				l.FixedAddress = words[1]
+			}
+			continue
+		}
+		if len(words) != 2 {
+			continue
+		}
+		var err error
+		switch words[0] {
+		case "starts":
+			starts, err = strconv.ParseInt(words[1], 10, 64)
+		case "renew":
+			renew, err = strconv.ParseInt(words[1], 10, 64)
+		case "rebind":
+			rebind, err = strconv.ParseInt(words[1], 10, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", words[0], err)
+		}
+	}
+	if starts > 0 {
+		l.Renew = time.Unix(starts+renew, 0).UTC()
+		l.Rebind = time.Unix(starts+rebind, 0).UTC()
+	}
+	if never {
+		l.Expire = time.Time{}
+	}
+	return nil
+}
+
+// parseIAAddress returns when an iaaddr or iaprefix expires, its start plus its valid lifetime. It
+// never expires, the zero time, without start or valid lifetime or with the infinite one.
+func parseIAAddress(statements []leaseStatement) (time.Time, error) {
+	var starts, maxLife int64
+	var hasStarts, hasMaxLife bool
+	for _, statement := range statements {
+		words := statement.words
+		if statement.isBlock || len(words) != 2 {
+			continue
+		}
+		var err error
+		switch words[0] {
+		case "starts":
+			starts, err = strconv.ParseInt(words[1], 10, 64)
+			hasStarts = true
+		case "max-life":
+			maxLife, err = strconv.ParseInt(words[1], 10, 64)
+			hasMaxLife = true
+		}
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s: %w", words[0], err)
+		}
+	}
+	if !hasStarts || !hasMaxLife || maxLife == infiniteLifetime {
+		return time.Time{}, nil
+	}
+	return time.Unix(starts+maxLife, 0).UTC(), nil
+}
+
+// parseLeaseTime parses the dhclient times: "<weekday> <yyyy/mm/dd> <hh:mm:ss>" in UTC,
+// "epoch <seconds>" with db-time-format local, or "never"
+func parseLeaseTime(words []string) (time.Time, error) {
+	switch {
+	case len(words) == 1 && words[0] == "never":
+		return time.Time{}, nil
+	case len(words) == 2 && words[0] == "epoch":
+		seconds, err := strconv.ParseInt(words[1], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	case len(words) == 3:
+		return time.ParseInLocation(dhclientTimeLayout, words[1]+" "+words[2], time.UTC)
+	default:
+		return time.Time{}, fmt.Errorf("invalid time %q", strings.Join(words, " "))
+	}
+}
+
+// parseLeaseStatements groups the tokens into statements and blocks, up to the end of the
+// current block
+func parseLeaseStatements(tokens []string, pos *int, nested bool) ([]leaseStatement, error) {
+	var statements []leaseStatement
+	var words []string
+	for *pos < len(tokens) {
+		token := tokens[*pos]
+		*pos++
+		switch token {
+		case ";":
+			if len(words) > 0 {
+				statements = append(statements, leaseStatement{words: words})
+			}
+			words = nil
+		case "{":
+			if len(words) == 0 {
+				return nil, errors.New("block without a name")
+			}
+			block, err := parseLeaseStatements(tokens, pos, true)
+			if err != nil {
+				return nil, err
+			}
+			statements = append(statements, leaseStatement{words: words, isBlock: true, block: block})
+			words = nil
+		case "}":
+			if !nested {
+				return nil, errors.New("unexpected }")
+			}
+			if len(words) > 0 {
+				return nil, fmt.Errorf("missing ; after %q", strings.Join(words, " "))
+			}
+			return statements, nil
+		default:
+			words = append(words, token)
+		}
+	}
+	if nested {
+		return nil, errors.New("missing }")
+	}
+	if len(words) > 0 {
+		return nil, fmt.Errorf("missing ; after %q", strings.Join(words, " "))
+	}
+	return statements, nil
+}
+
+// tokenizeLeases splits a lease file into words, quoted strings and the { } ; punctuation,
+// dropping the comments
+func tokenizeLeases(data []byte) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(data); {
+		switch c := data[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			// Quoted strings are kept with their quotes and escapes, see unquoteLeaseString
+			j := i + 1
+			for ; j < len(data) && data[j] != '"'; j++ {
+				if data[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(data) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, string(data[i:j+1]))
+			i = j + 1
+		default:
+			j := i
+			for j < len(data) && !bytes.ContainsRune([]byte(" \t\r\n{};\"#"), rune(data[j])) {
+				j++
+			}
+			tokens = append(tokens, string(data[i:j]))
+			i = j
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package dhcp implements the DHCP client
+package dhcp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//nolint:funlen
+func TestParseLeases(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []Lease
+		wantErr bool
+	}{
+		{
+			name: "dhclient lease",
+			content: `lease {
+  interface "eth0";
+  fixed-address 10.127.127.100;
+  filename "grubx64.efi";
+  option subnet-mask 255.255.255.0;
+  option sztp-redirect-urls "https://bootstrap:8080/restconf";
+  option domain-name-servers 10.127.127.3, 10.127.127.4;
+  renew 1 2022/08/15 19:16:40;
+  rebind 1 2022/08/15 19:20:50;
+  expire 1 2022/08/15 19:22:05;
+}
+`,
+			want: []Lease{{
+				Interface:    "eth0",
+				FixedAddress: "10.127.127.100",
+				Renew:        time.Date(2022, 8, 15, 19, 16, 40, 0, time.UTC),
+				Rebind:       time.Date(2022, 8, 15, 19, 20, 50, 0, time.UTC),
+				Expire:       time.Date(2022, 8, 15, 19, 22, 5, 0, time.UTC),
+				Options: map[string]string{
+					"subnet-mask":         "255.255.255.0",
+					"sztp-redirect-urls":  `"https://bootstrap:8080/restconf"`,
+					"domain-name-servers": "10.127.127.3, 10.127.127.4",
+				},
+			}},
+		},
+		{
+			name: "epoch times and never expiring lease",
+			content: `lease {
+  interface "eth1";
+  renew epoch 1660591000; # Mon Aug 15 19:16:40 2022
+  expire never;
+}
+`,
+			want: []Lease{{
+				Interface: "eth1",
+				Renew:     time.Unix(1660591000, 0).UTC(),
+				Options:   map[string]string{},
+			}},
+		},
+		{
+			name: "dhclient6 lease",
+			content: `default-duid "\000\001\000\001,\271\023\013\002B\254\021\000\002";
+lease6 {
+  interface "eth2";
+  ia-na 1a:2b:3c:4d {
+    starts 1700000000;
+    renew 1800;
+    rebind 2880;
+    iaaddr 2001:db8::10 {
+      starts 1700000000;
+      preferred-life 3600;
+      max-life 7200;
+    }
+    iaaddr 2001:db8::11 {
+      starts 1700000000;
+      preferred-life 3600;
+      max-life 3600;
+    }
+  }
+  option dhcp6.sztp-redirect-urls 0:9:68:74:74:70:73:3a:2f:2f:61;
+}
+`,
+			want: []Lease{{
+				Interface:    "eth2",
+				FixedAddress: "2001:db8::10",
+				Renew:        time.Unix(1700001800, 0).UTC(),
+				Rebind:       time.Unix(1700002880, 0).UTC(),
+				Expire:       time.Unix(1700007200, 0).UTC(),
+				Options:      map[string]string{"dhcp6.sztp-redirect-urls": "0:9:68:74:74:70:73:3a:2f:2f:61"},
+			}},
+		},
+		{
+			name: "dhclient6 lease never expiring",
+			content: `lease6 {
+  interface "eth3";
+  ia-na 1a:2b:3c:4d {
+    iaaddr 2001:db8::10 {
+      starts 1700000000;
+      max-life 7200;
+    }
+    iaaddr 2001:db8::11 {
+      starts 1700000000;
+      max-life 4294967295;
+    }
+  }
+  ia-pd 1a:2b:3c:4e {
+    iaprefix 2001:db8:1::/56 {
+      preferred-life 3600;
+    }
+  }
+}
+`,
+			want: []Lease{{
+				Interface:    "eth3",
+				FixedAddress: "2001:db8::10",
+				Options:      map[string]string{},
+			}},
+		},
+		{
+			name:    "semicolon and braces in a string",
+			content: "lease {\n  interface \"eth0\";\n  option sztp-redirect-urls \"https://a/{x};y\";\n}\n",
+			want: []Lease{{
+				Interface: "eth0",
+				Options:   map[string]string{"sztp-redirect-urls": `"https://a/{x};y"`},
+			}},
+		},
+		{
+			name:    "empty file",
+			content: "",
+			want:    nil,
+		},
+		{
+			name:    "unterminated block",
+			content: "lease {\n  interface \"eth0\";\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing semicolon",
+			content: "lease {\n  interface \"eth0\"\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated string",
+			content: "lease {\n  option sztp-redirect-urls \"http://\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid time",
+			content: "lease {\n  expire 1 2022-08-15 19:22:05;\n}\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLeases(strings.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLeases() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseLeases() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLease_Expired(t *testing.T) {
+	now := time.Date(2022, 8, 15, 19, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		expire time.Time
+		want   bool
+	}{
+		{name: "never expires", expire: time.Time{}, want: false},
+		{name: "expires later", expire: now.Add(time.Minute), want: false},
+		{name: "expires now", expire: now, want: true},
+		{name: "expired", expire: now.Add(-time.Minute), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Lease{Expire: tt.expire}
+			if got := l.Expired(now); got != tt.want {
+				t.Errorf("Expired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLease_Option(t *testing.T) {
+	l := &Lease{Options: map[string]string{
+		"dhcp6.sztp-redirect-urls": "v6",
+		"subnet-mask":              "255.255.255.0",
+	}}
+	if got, ok := l.Option("sztp-redirect-urls"); !ok || got != "v6" {
+		t.Errorf("Option() = %q, %v, want %q, true", got, ok, "v6")
+	}
+	if got, ok := l.Option("subnet-mask"); !ok || got != "255.255.255.0" {
+		t.Errorf("Option() = %q, %v, want %q, true", got, ok, "255.255.255.0")
+	}
+	if _, ok := l.Option("mask"); ok {
+		t.Error("Option() matched a partial option name")
+	}
+}
@@ -0,0 +1,215 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package dhcp implements the DHCP client
+package dhcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// LeaseFormat is the format of a DHCP lease file
+type LeaseFormat string
+
+const (
+	// LeaseFormatUnknown is a lease file of none of the supported formats
+	LeaseFormatUnknown LeaseFormat = ""
+	// LeaseFormatDhclient is the lease and lease6 blocks of ISC dhclient
+	LeaseFormatDhclient LeaseFormat = "dhclient"
+	// LeaseFormatNetworkd is the KEY=VALUE lease files of systemd-networkd, /run/systemd/netif/leases/<ifindex>.
+	// systemd-networkd only records the private options 224 to 254, never the sztp-redirect-urls
+	// option: the DHCP server must also send its value in a private option the device requests.
+	LeaseFormatNetworkd LeaseFormat = "systemd-networkd"
+	// LeaseFormatDhcpcd is the key=value dump of dhcpcd, dhcpcd --dumplease <interface>
+	LeaseFormatDhcpcd LeaseFormat = "dhcpcd"
+	// LeaseFormatDhcpcdBinary is the raw DHCP message dhcpcd stores, /var/lib/dhcpcd/<interface>.lease{,6}
+	LeaseFormatDhcpcdBinary LeaseFormat = "dhcpcd-binary"
+	// LeaseFormatKea is the CSV lease file of the ISC kea DHCP server. It is detected but not
+	// supported: the server records the leases it grants, not the options it sends.
+	LeaseFormatKea LeaseFormat = "kea"
+)
+
+// OptionV6SZTPRedirect is the DHCPv6 sztp-redirect-urls option (RFC 8572)
+const OptionV6SZTPRedirect = dhcpv6.OptionCode(136)
+
+const (
+	// networkdHeader starts the lease files of systemd-networkd
+	networkdHeader = "This is private data"
+	// networkdOptionPrefix names the private options in the systemd-networkd lease files, OPTION_<code>
+	// with the option value as hexadecimal
+	networkdOptionPrefix = "OPTION_"
+)
+
+// DetectLeaseFormat guesses the format of a lease file from its content
+func DetectLeaseFormat(data []byte) LeaseFormat {
+	if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+		return LeaseFormatDhcpcdBinary
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if strings.Contains(line, networkdHeader) {
+				return LeaseFormatNetworkd
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "lease"), strings.HasPrefix(line, "default-duid"), strings.HasPrefix(line, "server-duid"):
+			return LeaseFormatDhclient
+		case strings.HasPrefix(line, "address,"):
+			return LeaseFormatKea
+		}
+		key, _, found := strings.Cut(line, "=")
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			return LeaseFormatUnknown
+		}
+		if key == strings.ToUpper(key) {
+			return LeaseFormatNetworkd
+		}
+		return LeaseFormatDhcpcd
+	}
+	// An empty dhclient lease file, there is no lease yet
+	return LeaseFormatDhclient
+}
+
+// parseNetworkdLease reads the Bootstrap URLs of a systemd-networkd lease file, from the private
+// option whose value is an sztp-redirect-urls one: a list of HTTPS URLs. The file is named after the
+// interface index and rewritten when the lease starts or is renewed, its modification time dates the lease.
+func parseNetworkdLease(path string, info os.FileInfo, data []byte) ([]BootstrapURL, error) {
+	iface := networkdInterface(filepath.Base(path))
+	var candidates []BootstrapURL
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found || !strings.HasPrefix(key, networkdOptionPrefix) {
+			continue
+		}
+		raw, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid %s: %w", path, key, err)
+		}
+		urls := decodeOptionValue(raw)
+		if !httpsURLs(urls) {
+			continue
+		}
+		for _, url := range urls {
+			candidates = append(candidates, BootstrapURL{URL: url, Interface: iface, Lease: int(info.ModTime().Unix())})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%s: no private option of the systemd-networkd lease holds the sztp-redirect-urls, "+
+			"send them in one of the options 224 to 254 and request it with RequestOptions=, or use --dhcp-client-interface", path)
+	}
+	return candidates, nil
+}
+
+// httpsURLs tells whether an option value decoded as a non-empty list of HTTPS URLs, telling the
+// sztp-redirect-urls apart from the other private options
+func httpsURLs(urls []string) bool {
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			return false
+		}
+	}
+	return len(urls) > 0
+}
+
+// networkdInterface returns the name of the interface a systemd-networkd lease file is named after
+func networkdInterface(name string) string {
+	if index, err := strconv.Atoi(name); err == nil {
+		if iface, err := net.InterfaceByIndex(index); err == nil {
+			return iface.Name
+		}
+	}
+	return name
+}
+
+// parseDhcpcdLease reads the Bootstrap URLs of a dhcpcd key=value dump. The option is named after
+// its dhcpcd.conf definition, e.g. define 143 binhex sztp_redirect_urls, the DHCPv6 one is prefixed
+// with dhcp6_. Like for systemd-networkd, the modification time of the file dates the lease.
+func parseDhcpcdLease(path string, info os.FileInfo, data []byte, key string) ([]BootstrapURL, error) {
+	name := strings.ReplaceAll(key, "-", "_")
+	iface := dhcpcdInterface(path)
+	var values []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		k, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		value = strings.Trim(value, `'"`)
+		switch strings.TrimPrefix(k, "new_") {
+		case "interface":
+			iface = value
+		case name, "dhcp6_" + name:
+			values = append(values, value)
+		}
+	}
+	var candidates []BootstrapURL
+	for _, value := range values {
+		for _, url := range decodeRedirectURLs(value) {
+			candidates = append(candidates, BootstrapURL{URL: url, Interface: iface, Lease: int(info.ModTime().Unix())})
+		}
+	}
+	return candidates, scanner.Err()
+}
+
+// parseDhcpcdBinaryLease reads the Bootstrap URLs of the DHCPACK or DHCPv6 REPLY stored by dhcpcd
+func parseDhcpcdBinaryLease(path string, info os.FileInfo, data []byte) ([]BootstrapURL, error) {
+	var values [][]byte
+	if msg, err := dhcpv4.FromBytes(data); err == nil {
+		if value := msg.Options.Get(OptionSZTPRedirect); len(value) > 0 {
+			values = append(values, value)
+		}
+	} else {
+		msg, err := dhcpv6.MessageFromBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: not a DHCP message: %w", path, err)
+		}
+		for _, option := range msg.Options.Get(OptionV6SZTPRedirect) {
+			values = append(values, option.ToBytes())
+		}
+	}
+	iface := dhcpcdInterface(path)
+	var candidates []BootstrapURL
+	for _, value := range values {
+		for _, url := range decodeOptionValue(value) {
+			candidates = append(candidates, BootstrapURL{URL: url, Interface: iface, Lease: int(info.ModTime().Unix())})
+		}
+	}
+	return candidates, nil
+}
+
+// dhcpcdInterface returns the name of the interface a dhcpcd lease file is named after
+func dhcpcdInterface(path string) string {
+	name := filepath.Base(path)
+	for _, ext := range []string{".lease6", ".lease"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
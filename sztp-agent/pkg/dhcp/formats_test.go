@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package dhcp implements the DHCP client
+package dhcp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+const (
+	testDhclientLease = `lease {
+  interface "eth0";
+  option sztp-redirect-urls "https://dhclient/eth0";
+}
+`
+	testNetworkdLease = `# This is private data. Do not parse.
+ADDRESS=192.0.2.10
+NETMASK=255.255.255.0
+LIFETIME=3600
+OPTION_224=0102
+OPTION_225=001068747470733a2f2f6e6574776f726b64
+`
+	testDhcpcdLease = `interface='eth1'
+ip_address='192.0.2.11'
+sztp_redirect_urls='000e68747470733a2f2f646863706364'
+`
+	testKeaLease = `address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context
+192.0.2.10,00:11:22:33:44:55,,3600,1700000000,1,0,0,,0,
+`
+)
+
+// testBootstrapServerList encodes URLs as an RFC 8572 bootstrap-server-list
+func testBootstrapServerList(urls ...string) []byte {
+	var data []byte
+	for _, url := range urls {
+		data = append(data, byte(len(url)>>8), byte(len(url)))
+		data = append(data, url...)
+	}
+	return data
+}
+
+func testDhcpcdBinaryLeases(t *testing.T) (v4, v6 []byte) {
+	t.Helper()
+	ack, err := dhcpv4.New(
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+		dhcpv4.WithYourIP(net.IPv4(192, 0, 2, 12)),
+		dhcpv4.WithOption(dhcpv4.OptGeneric(OptionSZTPRedirect, testBootstrapServerList("https://v4/a", "https://v4/b"))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := dhcpv6.NewMessage(dhcpv6.WithOption(&dhcpv6.OptionGeneric{
+		OptionCode: OptionV6SZTPRedirect,
+		OptionData: testBootstrapServerList("https://[2001:db8::1]/v6"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply.MessageType = dhcpv6.MessageTypeReply
+	return ack.ToBytes(), reply.ToBytes()
+}
+
+func TestDetectLeaseFormat(t *testing.T) {
+	v4, v6 := testDhcpcdBinaryLeases(t)
+	tests := []struct {
+		name string
+		data []byte
+		want LeaseFormat
+	}{
+		{name: "dhclient", data: []byte(testDhclientLease), want: LeaseFormatDhclient},
+		{name: "dhclient6", data: []byte("default-duid \"\\000\\001\";\nlease6 {\n}\n"), want: LeaseFormatDhclient},
+		{name: "empty dhclient", data: nil, want: LeaseFormatDhclient},
+		{name: "systemd-networkd", data: []byte(testNetworkdLease), want: LeaseFormatNetworkd},
+		{name: "systemd-networkd without header", data: []byte("ADDRESS=192.0.2.10\n"), want: LeaseFormatNetworkd},
+		{name: "dhcpcd dump", data: []byte(testDhcpcdLease), want: LeaseFormatDhcpcd},
+		{name: "dhcpcd DHCPACK", data: v4, want: LeaseFormatDhcpcdBinary},
+		{name: "dhcpcd DHCPv6 REPLY", data: v6, want: LeaseFormatDhcpcdBinary},
+		{name: "kea", data: []byte(testKeaLease), want: LeaseFormatKea},
+		{name: "unknown", data: []byte("<lease/>\n"), want: LeaseFormatUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectLeaseFormat(tt.data); got != tt.want {
+				t.Errorf("DetectLeaseFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+//nolint:funlen
+func TestGetBootstrapURLCandidatesViaLeaseFileFormats(t *testing.T) {
+	v4, v6 := testDhcpcdBinaryLeases(t)
+	modTime := time.Unix(1700000000, 0)
+	tests := []struct {
+		name    string
+		files   map[string][]byte
+		want    []BootstrapURL
+		wantErr bool
+	}{
+		{
+			name:  "dhclient",
+			files: map[string][]byte{"dhclient.leases": []byte(testDhclientLease)},
+			want:  []BootstrapURL{{URL: "https://dhclient/eth0", Interface: "eth0", Position: 1}},
+		},
+		{
+			name:  "systemd-networkd lease file",
+			files: map[string][]byte{"4242": []byte(testNetworkdLease)},
+			want:  []BootstrapURL{{URL: "https://networkd", Interface: "4242", Lease: int(modTime.Unix())}},
+		},
+		{
+			name:    "systemd-networkd lease file without the sztp-redirect-urls in a private option",
+			files:   map[string][]byte{"4243": []byte("# This is private data. Do not parse.\nADDRESS=192.0.2.10\nOPTION_224=0102\n")},
+			wantErr: true,
+		},
+		{
+			name:  "dhcpcd dump",
+			files: map[string][]byte{"dump": []byte(testDhcpcdLease)},
+			want:  []BootstrapURL{{URL: "https://dhcpcd", Interface: "eth1", Lease: int(modTime.Unix())}},
+		},
+		{
+			name:  "dhcpcd DHCPACK",
+			files: map[string][]byte{"eth2.lease": v4},
+			want: []BootstrapURL{
+				{URL: "https://v4/a", Interface: "eth2", Lease: int(modTime.Unix())},
+				{URL: "https://v4/b", Interface: "eth2", Lease: int(modTime.Unix())},
+			},
+		},
+		{
+			name:  "dhcpcd DHCPv6 REPLY",
+			files: map[string][]byte{"eth3.lease6": v6},
+			want:  []BootstrapURL{{URL: "https://[2001:db8::1]/v6", Interface: "eth3", Lease: int(modTime.Unix())}},
+		},
+		{
+			name:    "kea server lease file",
+			files:   map[string][]byte{"kea-leases4.csv": []byte(testKeaLease)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var path string
+			for name, data := range tt.files {
+				path = filepath.Join(dir, name)
+				if err := os.WriteFile(path, data, 0o600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := GetBootstrapURLCandidatesViaLeaseFile(path, "sztp-redirect-urls")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetBootstrapURLCandidatesViaLeaseFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetBootstrapURLCandidatesViaLeaseFile() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetBootstrapURLCandidatesViaLeaseFileDirectory(t *testing.T) {
+	v4, v6 := testDhcpcdBinaryLeases(t)
+	dir := t.TempDir()
+	older, newer := time.Unix(1700000000, 0), time.Unix(1700000100, 0)
+	files := []struct {
+		name    string
+		content []byte
+		modTime time.Time
+	}{
+		{name: "eth0.lease", content: v4, modTime: older},
+		{name: "eth0.lease6", content: v6, modTime: newer},
+		// Temporary file written before being renamed
+		{name: ".eth0.lease", content: []byte("sztp_redirect_urls='zz'\n"), modTime: newer},
+		{name: "4242", content: []byte(testNetworkdLease), modTime: newer},
+		{name: "kea-leases4.csv", content: []byte(testKeaLease), modTime: newer},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, file.content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, file.modTime, file.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	candidates, err := GetBootstrapURLCandidatesViaLeaseFile(dir, "sztp-redirect-urls")
+	if err != nil {
+		t.Fatalf("GetBootstrapURLCandidatesViaLeaseFile() error = %v", err)
+	}
+	want := []string{"https://networkd", "https://[2001:db8::1]/v6", "https://v4/a", "https://v4/b"}
+	if got := SortBootstrapURLs(candidates, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetBootstrapURLCandidatesViaLeaseFile() got = %v, want %v", got, want)
+	}
+}
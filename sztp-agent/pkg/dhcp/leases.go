@@ -9,11 +9,15 @@ Copyright (C) 2022 Red Hat.
 package dhcp
 
 import (
-	"bufio"
+	"context"
+	"fmt"
 	"log"
 	"os"
-	"regexp"
+	"path/filepath"
+	"reflect"
 	"strings"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 // GetBootstrapURLsViaLeaseFile retrieves the Bootstrap URL from a DHCP lease file.
@@ -26,30 +30,155 @@ import (
 // - []string: a slice of Bootstrap URLs.
 // - error: an error if the file cannot be read or the key is not found.
 func GetBootstrapURLsViaLeaseFile(leaseFile, key string) ([]string, error) {
-	// nolint:gosec
-	file, err := os.Open(leaseFile)
+	candidates, err := GetBootstrapURLCandidatesViaLeaseFile(leaseFile, key)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			log.Println("[ERROR] Error when closing:", err)
-		}
-	}()
+	sztpRedirectURLs := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		sztpRedirectURLs = append(sztpRedirectURLs, candidate.URL)
+	}
+	return sztpRedirectURLs, nil
+}
 
-	var sztpRedirectURLs []string
-	scanner := bufio.NewScanner(file)
-	re := regexp.MustCompile(`(?m)[^"]*`)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, key) {
-			url := re.FindAllString(line, -1)
-			if len(url) == 1 {
-				continue
-			}
-			sztpRedirectURLs = append(sztpRedirectURLs, url[1])
+// GetBootstrapURLCandidatesViaLeaseFile retrieves the Bootstrap URLs from a DHCP lease file
+// along with the interface and the lease they were offered in. The format of the file (dhclient,
+// systemd-networkd or dhcpcd) is detected. A directory, such as /run/systemd/netif/leases, is
+// read file by file.
+//
+// Parameters:
+// - leaseFile: the path to the DHCP lease file or directory.
+// - key: the key used to retrieve the Bootstrap URL.
+//
+// Returns:
+// - []BootstrapURL: the Bootstrap URLs in the order they appear in the file.
+// - error: an error if the file cannot be read or its format is not supported.
+func GetBootstrapURLCandidatesViaLeaseFile(leaseFile, key string) ([]BootstrapURL, error) {
+	info, err := os.Stat(leaseFile)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return parseLeaseFile(leaseFile, info, key)
+	}
+	entries, err := os.ReadDir(leaseFile)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []BootstrapURL
+	for _, entry := range entries {
+		// Skip the temporary files written before being renamed
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
 		}
+		fileCandidates, err := parseLeaseFile(filepath.Join(leaseFile, entry.Name()), info, key)
+		if err != nil {
+			log.Println("[WARNING] Skipping the lease file:", err)
+			continue
+		}
+		candidates = append(candidates, fileCandidates...)
+	}
+	return candidates, nil
+}
+
+// parseLeaseFile reads the Bootstrap URLs of a lease file in any of the supported formats
+func parseLeaseFile(path string, info os.FileInfo, key string) ([]BootstrapURL, error) {
+	// nolint:gosec
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := DetectLeaseFormat(data)
+	switch format {
+	case LeaseFormatDhclient:
+		return parseDhclientLeases(data, key)
+	case LeaseFormatDhcpcd:
+		return parseDhcpcdLease(path, info, data, key)
+	case LeaseFormatDhcpcdBinary:
+		return parseDhcpcdBinaryLease(path, info, data)
+	case LeaseFormatNetworkd:
+		return parseNetworkdLease(path, info, data)
+	case LeaseFormatKea:
+		return nil, fmt.Errorf("%s is an ISC kea server lease file, it does not hold the options received by the device", path)
+	default:
+		return nil, fmt.Errorf("%s: unsupported lease file format", path)
 	}
+}
 
-	return sztpRedirectURLs, nil
+// WatchLeaseFile watches a DHCP lease file, or a lease directory, and sends its Bootstrap URLs
+// whenever they change, e.g. when the DHCP server starts offering the sztp-redirect-urls option.
+// The parent directory is watched so that the lease files written by renaming a temporary file,
+// or not created yet, are followed.
+//
+// Parameters:
+// - ctx: stops the watch, the channel is then closed.
+// - leaseFile: the path to the DHCP lease file or directory.
+// - key: the key used to retrieve the Bootstrap URL.
+//
+// Returns:
+// - <-chan []BootstrapURL: the Bootstrap URLs of the lease file, each time they change.
+// - error: an error if the lease file cannot be watched.
+func WatchLeaseFile(ctx context.Context, leaseFile, key string) (<-chan []BootstrapURL, error) {
+	dir, name := leaseFile, ""
+	if info, err := os.Stat(leaseFile); err != nil || !info.IsDir() {
+		dir, name = filepath.Dir(leaseFile), filepath.Clean(leaseFile)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(dir); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	// The URLs already in the lease file are not a change
+	candidates, _ := GetBootstrapURLCandidatesViaLeaseFile(leaseFile, key)
+	last := SortBootstrapURLs(candidates, nil)
+	updates := make(chan []BootstrapURL)
+	go func() {
+		defer close(updates)
+		defer func() {
+			if err := watcher.Close(); err != nil {
+				log.Println("[ERROR] Error when closing:", err)
+			}
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("[WARNING] Error when watching the lease file:", err)
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod || (name != "" && filepath.Clean(event.Name) != name) {
+					continue
+				}
+				candidates, err := GetBootstrapURLCandidatesViaLeaseFile(leaseFile, key)
+				if err != nil {
+					// The lease file may be partially written, wait for the next write
+					continue
+				}
+				urls := SortBootstrapURLs(candidates, nil)
+				if reflect.DeepEqual(urls, last) {
+					continue
+				}
+				last = urls
+				select {
+				case updates <- candidates:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return updates, nil
 }
@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package dhcp implements the DHCP client
+package dhcp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testLeases = `lease {
+  interface "eth0";
+  fixed-address 10.127.127.100;
+  option sztp-redirect-urls "https://expired/eth0";
+  renew 1 2022/08/15 19:16:40;
+  rebind 1 2022/08/15 19:20:50;
+  expire 1 2022/08/15 19:22:05;
+}
+lease {
+  interface "eth1";
+  fixed-address 10.127.128.100;
+  option sztp-redirect-urls "https://older/eth1";
+  renew 1 2099/08/15 19:16:40;
+  rebind 1 2099/08/15 19:20:50;
+  expire 1 2099/08/15 19:22:05;
+}
+lease {
+  interface "eth0";
+  fixed-address 10.127.127.101;
+  option subnet-mask 255.255.255.0;
+  renew 1 2099/08/15 19:17:40;
+  expire 1 2099/08/15 19:23:05;
+}
+lease {
+  interface "eth0";
+  fixed-address 10.127.127.100;
+  option sztp-redirect-urls "https://newer/eth0 https://backup/eth0";
+  renew 1 2099/08/15 19:18:40;
+  expire never;
+}
+`
+
+func TestGetBootstrapURLsViaLeaseFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "expired leases ignored",
+			content: testLeases,
+			want:    []string{"https://older/eth1", "https://newer/eth0", "https://backup/eth0"},
+		},
+		{
+			name:    "only expired leases",
+			content: "lease {\n  option sztp-redirect-urls \"https://expired\";\n  expire 1 2022/08/15 19:22:05;\n}\n",
+			want:    []string{},
+		},
+		{
+			name:    "key outside of a lease",
+			content: "# option sztp-redirect-urls \"https://comment\";\n",
+			want:    []string{},
+		},
+		{
+			name:    "invalid lease file",
+			content: "lease {\n  option sztp-redirect-urls \"https://truncated\";\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leaseFile := filepath.Join(t.TempDir(), "dhclient.leases")
+			if err := os.WriteFile(leaseFile, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := GetBootstrapURLsViaLeaseFile(leaseFile, "sztp-redirect-urls")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetBootstrapURLsViaLeaseFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetBootstrapURLsViaLeaseFile() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetBootstrapURLCandidatesViaLeaseFile(t *testing.T) {
+	leaseFile := filepath.Join(t.TempDir(), "dhclient.leases")
+	if err := os.WriteFile(leaseFile, []byte(testLeases), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	candidates, err := GetBootstrapURLCandidatesViaLeaseFile(leaseFile, "sztp-redirect-urls")
+	if err != nil {
+		t.Fatalf("GetBootstrapURLCandidatesViaLeaseFile() error = %v", err)
+	}
+	want := []BootstrapURL{
+		{URL: "https://older/eth1", Interface: "eth1", Lease: 4090504600, Position: 2},
+		{URL: "https://newer/eth0", Interface: "eth0", Lease: 4090504720, Position: 4},
+		{URL: "https://backup/eth0", Interface: "eth0", Lease: 4090504720, Position: 4},
+	}
+	if !reflect.DeepEqual(candidates, want) {
+		t.Errorf("GetBootstrapURLCandidatesViaLeaseFile() got = %v, want %v", candidates, want)
+	}
+	// The most recent lease comes first unless an interface is prioritized
+	if got := SortBootstrapURLs(candidates, nil); !reflect.DeepEqual(got, []string{"https://newer/eth0", "https://backup/eth0", "https://older/eth1"}) {
+		t.Errorf("SortBootstrapURLs() got = %v", got)
+	}
+	if got := SortBootstrapURLs(candidates, []string{"eth1"}); !reflect.DeepEqual(got, []string{"https://older/eth1", "https://newer/eth0", "https://backup/eth0"}) {
+		t.Errorf("SortBootstrapURLs() got = %v", got)
+	}
+	// The position in the file only breaks the ties of the lease times
+	candidates[0].Lease = candidates[1].Lease
+	if got := SortBootstrapURLs(candidates, nil); !reflect.DeepEqual(got, []string{"https://newer/eth0", "https://backup/eth0", "https://older/eth1"}) {
+		t.Errorf("SortBootstrapURLs() got = %v", got)
+	}
+	candidates[0].Lease++
+	if got := SortBootstrapURLs(candidates, nil); !reflect.DeepEqual(got, []string{"https://older/eth1", "https://newer/eth0", "https://backup/eth0"}) {
+		t.Errorf("SortBootstrapURLs() got = %v", got)
+	}
+}
+
+// writeLeaseFile replaces a lease file like dhclient does, through a temporary file
+func writeLeaseFile(t *testing.T, leaseFile, content string) {
+	t.Helper()
+	tmp := leaseFile + "~"
+	if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, leaseFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchLeaseFile(t *testing.T) {
+	leaseFile := filepath.Join(t.TempDir(), "dhclient.leases")
+	writeLeaseFile(t, leaseFile, "lease {\n  interface \"eth0\";\n}\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := WatchLeaseFile(ctx, leaseFile, "sztp-redirect-urls")
+	if err != nil {
+		t.Fatalf("WatchLeaseFile() error = %v", err)
+	}
+	expectUpdate := func(want []string) {
+		t.Helper()
+		select {
+		case candidates := <-updates:
+			if got := SortBootstrapURLs(candidates, nil); !reflect.DeepEqual(got, want) {
+				t.Errorf("WatchLeaseFile() got = %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("WatchLeaseFile() no update, want %v", want)
+		}
+	}
+	lease := "lease {\n  interface \"eth0\";\n  option sztp-redirect-urls \"https://first\";\n}\n"
+	writeLeaseFile(t, leaseFile, lease)
+	expectUpdate([]string{"https://first"})
+	// A renewal offering the same URLs is not a change
+	writeLeaseFile(t, leaseFile, lease+lease)
+	select {
+	case candidates := <-updates:
+		t.Errorf("WatchLeaseFile() unexpected update %v", candidates)
+	case <-time.After(200 * time.Millisecond):
+	}
+	// Other files of the directory are ignored
+	writeLeaseFile(t, filepath.Join(filepath.Dir(leaseFile), "other.leases"), "lease {\n  option sztp-redirect-urls \"https://other\";\n}\n")
+	writeLeaseFile(t, leaseFile, lease+"lease {\n  interface \"eth0\";\n  option sztp-redirect-urls \"https://second\";\n}\n")
+	expectUpdate([]string{"https://second", "https://first"})
+	cancel()
+	if _, ok := <-updates; ok {
+		t.Error("WatchLeaseFile() channel not closed after the context is done")
+	}
+}
@@ -1,9 +0,0 @@
-/*
-SPDX-License-Identifier: Apache-2.0
-Copyright (C) 2022-2023 Intel Corporation
-Copyright (c) 2022 Dell Inc, or its subsidiaries.
-Copyright (C) 2022 Red Hat.
-*/
-
-// Package dhcp implements the DHCP client
-package dhcp
@@ -7,3 +7,157 @@ Copyright (C) 2022 Red Hat.
 
 // Package dhcp implements the DHCP client
 package dhcp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BootstrapURL is a bootstrap server URL offered by a DHCP server
+type BootstrapURL struct {
+	URL       string // the sztp-redirect-urls entry
+	Interface string // the interface the lease was obtained on
+	Lease     int    // when the lease started or was last renewed in Unix time, 0 if unknown
+	Position  int    // the position of the lease in its file, breaks the ties between equal Lease values
+}
+
+// SortBootstrapURLs orders the bootstrap URLs and removes the duplicates. URLs offered on the
+// interfaces listed in interfacePriority come first, in that order, then the URLs of the most
+// recently started or renewed leases, the last ones of a file first. The order of the URLs within a lease is preserved.
+func SortBootstrapURLs(candidates []BootstrapURL, interfacePriority []string) []string {
+	priority := func(iface string) int {
+		for i, name := range interfacePriority {
+			if name == iface {
+				return i
+			}
+		}
+		return len(interfacePriority)
+	}
+	sorted := make([]BootstrapURL, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		pi, pj := priority(sorted[i].Interface), priority(sorted[j].Interface)
+		if pi != pj {
+			return pi < pj
+		}
+		if sorted[i].Lease != sorted[j].Lease {
+			return sorted[i].Lease > sorted[j].Lease
+		}
+		return sorted[i].Position > sorted[j].Position
+	})
+	seen := make(map[string]bool, len(sorted))
+	urls := make([]string, 0, len(sorted))
+	for _, candidate := range sorted {
+		if candidate.URL == "" || seen[candidate.URL] {
+			continue
+		}
+		seen[candidate.URL] = true
+		urls = append(urls, candidate.URL)
+	}
+	return urls
+}
+
+// colonHexRegex matches the colon separated hexadecimal form dhclient uses for binary option values
+var colonHexRegex = regexp.MustCompile(`^[0-9a-fA-F]{1,2}(:[0-9a-fA-F]{1,2})+$`)
+
+// hexRegex matches the plain hexadecimal form dhcpcd uses for binary option values
+var hexRegex = regexp.MustCompile(`^([0-9a-fA-F]{2})+$`)
+
+// decodeRedirectURLs extracts the URLs of an sztp-redirect-urls option value as written by
+// dhclient, dhcpcd or NetworkManager. The value is either a text list of URLs (how option 143 is
+// usually configured) or the RFC 8572 bootstrap-server-list of length-prefixed URIs (option 136),
+// in which case it is quoted with octal escapes or written as hexadecimal.
+func decodeRedirectURLs(value string) []string {
+	value = strings.TrimSpace(value)
+	var data []byte
+	switch {
+	case colonHexRegex.MatchString(value):
+		for _, octet := range strings.Split(value, ":") {
+			b, err := hex.DecodeString(strings.Repeat("0", 2-len(octet)) + octet)
+			if err != nil {
+				return nil
+			}
+			data = append(data, b...)
+		}
+	case hexRegex.MatchString(value):
+		data, _ = hex.DecodeString(value)
+	case strings.HasPrefix(value, `"`):
+		data = unquoteLeaseString(value)
+	default:
+		return parseRedirectURLs(value)
+	}
+	return decodeOptionValue(data)
+}
+
+// decodeOptionValue extracts the URLs of a raw sztp-redirect-urls option. RFC 8572 defines a
+// list of length-prefixed URIs, but the option is often configured as text.
+func decodeOptionValue(data []byte) []string {
+	if urls, err := decodeBootstrapServerList(data); err == nil {
+		return urls
+	}
+	return parseRedirectURLs(string(data))
+}
+
+// parseRedirectURLs splits an sztp-redirect-urls option value into URLs
+func parseRedirectURLs(value string) []string {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == ',' || r == '\t' || r == '\n'
+	})
+	urls := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if url := strings.Trim(field, `"`); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// decodeBootstrapServerList decodes the bootstrap-server-list of the RFC 8572 DHCP options,
+// a sequence of URIs each preceded by its 2 octets length
+func decodeBootstrapServerList(data []byte) ([]string, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty bootstrap-server-list")
+	}
+	var urls []string
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errors.New("truncated uri-length in bootstrap-server-list")
+		}
+		length := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if length == 0 || length > len(data) {
+			return nil, errors.New("invalid uri-length in bootstrap-server-list")
+		}
+		urls = append(urls, string(data[:length]))
+		data = data[length:]
+	}
+	return urls, nil
+}
+
+// unquoteLeaseString removes the quotes of a dhclient string and decodes its escapes,
+// dhclient writes the non printable octets as \ooo
+func unquoteLeaseString(value string) []byte {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`)
+	data := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			data = append(data, value[i])
+			continue
+		}
+		if i+3 < len(value) {
+			if octet, err := strconv.ParseUint(value[i+1:i+4], 8, 8); err == nil {
+				data = append(data, byte(octet))
+				i += 3
+				continue
+			}
+		}
+		i++
+		data = append(data, value[i])
+	}
+	return data
+}
@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package dhcp implements the DHCP client
+package dhcp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_decodeRedirectURLs(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{
+			name:  "text",
+			value: `"https://bootstrap:8080/restconf"`,
+			want:  []string{"https://bootstrap:8080/restconf"},
+		},
+		{
+			name:  "unquoted text list",
+			value: "https://a https://b",
+			want:  []string{"https://a", "https://b"},
+		},
+		{
+			name:  "colon separated bootstrap-server-list",
+			value: "0:9:68:74:74:70:73:3a:2f:2f:61:0:9:68:74:74:70:73:3a:2f:2f:62",
+			want:  []string{"https://a", "https://b"},
+		},
+		{
+			name:  "escaped bootstrap-server-list",
+			value: `"\000\011https://a\000\011https://b"`,
+			want:  []string{"https://a", "https://b"},
+		},
+		{
+			name:  "hexadecimal bootstrap-server-list",
+			value: "000968747470733a2f2f61000968747470733a2f2f62",
+			want:  []string{"https://a", "https://b"},
+		},
+		{
+			name:  "colon separated text",
+			value: "68:74:74:70:73:3a:2f:2f:61",
+			want:  []string{"https://a"},
+		},
+		{
+			name:  "empty",
+			value: "",
+			want:  []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeRedirectURLs(tt.value); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeRedirectURLs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_decodeBootstrapServerList(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "two URIs",
+			data: append([]byte{0, 9}, append([]byte("https://a"), append([]byte{0, 9}, []byte("https://b")...)...)...),
+			want: []string{"https://a", "https://b"},
+		},
+		{
+			name:    "truncated URI",
+			data:    append([]byte{0, 10}, []byte("https://a")...),
+			wantErr: true,
+		},
+		{
+			name:    "truncated length",
+			data:    append(append([]byte{0, 9}, []byte("https://a")...), 0),
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			data:    nil,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeBootstrapServerList(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeBootstrapServerList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeBootstrapServerList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseRedirectURLs(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{"single", "https://a:8080", []string{"https://a:8080"}},
+		{"quoted and separated", `"https://a:8080", "https://b"`, []string{"https://a:8080", "https://b"}},
+		{"spaces", "https://a https://b", []string{"https://a", "https://b"}},
+		{"empty", "", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRedirectURLs(tt.value); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRedirectURLs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
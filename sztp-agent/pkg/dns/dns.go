@@ -0,0 +1,353 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package dns implements the DNS discovery of the bootstrapping data and of the bootstrap servers
+// (RFC 8572 section 4.2)
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// MulticastAddress is the mDNS group the queries are sent to
+	MulticastAddress = "224.0.0.251:5353"
+	// ResolvConf is the file the unicast DNS servers and search domains are read from
+	ResolvConf = "/etc/resolv.conf"
+
+	sztpLabel       = "_sztp"
+	txtKeySeparator = "="
+	multicastDomain = "local."
+	defaultTimeout  = 2 * time.Second
+)
+
+// The keys of the bootstrapping data artifacts in the TXT records
+const (
+	ConveyedInformationKey = "ci"
+	OwnerCertificateKey    = "oc"
+	OwnershipVoucherKey    = "ov"
+)
+
+// BootstrappingData is the bootstrapping data of the TXT records of a name, the DER encoded artifacts
+type BootstrappingData struct {
+	ConveyedInformation []byte // The conveyed-information, always present
+	OwnerCertificate    []byte // The owner certificate, empty when the conveyed-information is not signed
+	OwnershipVoucher    []byte // The ownership voucher, empty when the conveyed-information is not signed
+}
+
+// Resolver queries the _sztp records of the local domains over unicast DNS and multicast DNS
+type Resolver struct {
+	Servers   []string      // unicast DNS servers as host:port, none disables unicast DNS
+	Domains   []string      // the domains searched with unicast DNS
+	Multicast string        // the mDNS address, empty disables multicast DNS
+	Timeout   time.Duration // the timeout of each query
+}
+
+// NewResolver returns a Resolver using the servers and search domains of a resolv.conf file, and mDNS
+func NewResolver(resolvConf string) (*Resolver, error) {
+	config, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	r := &Resolver{
+		Domains:   config.Search,
+		Multicast: MulticastAddress,
+		Timeout:   time.Duration(config.Timeout) * time.Second,
+	}
+	for _, server := range config.Servers {
+		r.Servers = append(r.Servers, net.JoinHostPort(server, config.Port))
+	}
+	return r, nil
+}
+
+// GetBootstrapServers retrieves the bootstrap servers from the SRV records of the local domains.
+// The device-specific records, named after the serial number, are queried first and the
+// non-device-specific ones only when there are none. Unicast DNS results come before mDNS results.
+//
+// Parameters:
+// - ctx: bounds the queries.
+// - serialNumber: the serial number of the device.
+//
+// Returns:
+// - []string: the host:port addresses of the bootstrap servers, in priority order without duplicates.
+// - error: an error if every query failed.
+func (r *Resolver) GetBootstrapServers(ctx context.Context, serialNumber string) ([]string, error) {
+	var servers []string
+	err := r.lookup(ctx, serialNumber, dns.TypeSRV, func(name string, answers []dns.RR) bool {
+		nameServers := parseSRV(name, answers)
+		servers = append(servers, nameServers...)
+		return len(nameServers) > 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dedup(servers), nil
+}
+
+// GetBootstrappingData retrieves the bootstrapping data from the TXT records of the local domains.
+// Like for the bootstrap servers, the device-specific records are queried first and unicast DNS
+// results come before mDNS results. DNS does not authenticate the data, the caller must verify it.
+//
+// Parameters:
+// - ctx: bounds the queries.
+// - serialNumber: the serial number of the device.
+//
+// Returns:
+// - []BootstrappingData: the bootstrapping data of each domain that has some, in priority order.
+// - error: an error if every query failed.
+func (r *Resolver) GetBootstrappingData(ctx context.Context, serialNumber string) ([]BootstrappingData, error) {
+	var data []BootstrappingData
+	err := r.lookup(ctx, serialNumber, dns.TypeTXT, func(name string, answers []dns.RR) bool {
+		nameData := parseTXT(name, answers)
+		if nameData == nil {
+			return false
+		}
+		data = append(data, *nameData)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+type exchangeFunc func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+
+// answersFunc parses the answers of a name and tells whether they hold any valid record
+type answersFunc func(name string, answers []dns.RR) bool
+
+// lookup queries the records of a type in every local domain, over unicast DNS then mDNS
+func (r *Resolver) lookup(ctx context.Context, serialNumber string, qtype uint16, parse answersFunc) error {
+	var errs []error
+	queried := 0
+	if len(r.Servers) > 0 {
+		for _, domain := range r.Domains {
+			queried++
+			if err := r.lookupDomain(ctx, r.exchangeUnicast, serialNumber, domain, qtype, parse); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if r.Multicast != "" {
+		queried++
+		if err := r.lookupDomain(ctx, r.exchangeMulticast, serialNumber, multicastDomain, qtype, parse); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if queried > 0 && len(errs) == queried {
+		return fmt.Errorf("DNS discovery failed: %w", errs[len(errs)-1])
+	}
+	return nil
+}
+
+// lookupDomain queries the device-specific records of a domain, then the non-device-specific ones
+func (r *Resolver) lookupDomain(ctx context.Context, exchange exchangeFunc, serialNumber, domain string, qtype uint16, parse answersFunc) error {
+	names := []string{sztpLabel + "." + dns.Fqdn(domain)}
+	if serialNumber != "" {
+		names = append([]string{serialNumber + "." + names[0]}, names...)
+	}
+	var lastErr error
+	for _, name := range names {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		response, err := exchange(ctx, m)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		lastErr = nil
+		if parse(name, response.Answer) {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+// exchangeUnicast sends a query to the unicast DNS servers in turn until one answers
+func (r *Resolver) exchangeUnicast(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Timeout: r.timeout()}
+	var lastErr error
+	for _, server := range r.Servers {
+		response, _, err := client.ExchangeContext(ctx, m, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s answered %s", server, dns.RcodeToString[response.Rcode])
+			continue
+		}
+		return response, nil
+	}
+	return nil, lastErr
+}
+
+// exchangeMulticast sends a one-shot mDNS query, the responders answer to its source port (RFC 6762 section 6.7)
+func (r *Resolver) exchangeMulticast(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	group, err := net.ResolveUDPAddr("udp", r.Multicast)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Println("[ERROR] Error when closing:", err)
+		}
+	}()
+	deadline := time.Now().Add(r.timeout())
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	query, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(query, group); err != nil {
+		return nil, err
+	}
+	// Gather the answers of every responder until the deadline
+	response := new(dns.Msg)
+	response.SetReply(m)
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return response, nil
+			}
+			return nil, err
+		}
+		answer := new(dns.Msg)
+		if err := answer.Unpack(buf[:n]); err != nil || answer.Id != m.Id || !answer.Response {
+			continue
+		}
+		response.Answer = append(response.Answer, answer.Answer...)
+	}
+}
+
+func (r *Resolver) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return r.Timeout
+}
+
+// parseSRV validates the SRV records of a name and returns the bootstrap servers they carry
+func parseSRV(name string, answers []dns.RR) []string {
+	var srvs []*dns.SRV
+	for _, rr := range answers {
+		record, ok := rr.(*dns.SRV)
+		if !ok || !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		// "." means that the service is decidedly not available (RFC 2782)
+		if record.Target == "." || record.Port == 0 {
+			log.Printf("[WARNING] Ignoring the invalid SRV record: %v", record)
+			continue
+		}
+		srvs = append(srvs, record)
+	}
+	// Lowest priority first, then highest weight
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+	servers := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		servers = append(servers, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	return servers
+}
+
+// parseTXT returns the bootstrapping data of the TXT records of a name, nil when they carry no
+// conveyed-information. Each record holds one artifact as a key=value pair (RFC 6763 section 6.3),
+// its character-strings are concatenated as the artifacts are longer than 255 bytes.
+func parseTXT(name string, answers []dns.RR) *BootstrappingData {
+	var data BootstrappingData
+	for _, rr := range answers {
+		record, ok := rr.(*dns.TXT)
+		if !ok || !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		key, value, found := bytes.Cut(unescapeTXT(strings.Join(record.Txt, "")), []byte(txtKeySeparator))
+		if !found || len(value) == 0 {
+			log.Printf("[WARNING] Ignoring the TXT record without a key=value pair of %s", name)
+			continue
+		}
+		switch strings.ToLower(string(key)) {
+		case ConveyedInformationKey:
+			data.ConveyedInformation = value
+		case OwnerCertificateKey:
+			data.OwnerCertificate = value
+		case OwnershipVoucherKey:
+			data.OwnershipVoucher = value
+		default:
+			log.Printf("[WARNING] Ignoring the TXT record with the unknown key %q of %s", key, name)
+		}
+	}
+	if data.ConveyedInformation == nil {
+		return nil
+	}
+	return &data
+}
+
+// unescapeTXT decodes the presentation format of the TXT character-strings, where the binary
+// bytes are escaped as \DDD and the quotes and backslashes as \" and \\
+func unescapeTXT(s string) []byte {
+	decoded := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			decoded = append(decoded, s[i])
+			continue
+		}
+		i++
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			decoded = append(decoded, (s[i]-'0')*100+(s[i+1]-'0')*10+(s[i+2]-'0'))
+			i += 2
+			continue
+		}
+		decoded = append(decoded, s[i])
+	}
+	return decoded
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func dedup(servers []string) []string {
+	seen := make(map[string]bool, len(servers))
+	unique := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if seen[server] {
+			continue
+		}
+		seen[server] = true
+		unique = append(unique, server)
+	}
+	return unique
+}
@@ -0,0 +1,227 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package dns implements the DNS discovery of the bootstrapping data and of the bootstrap servers
+// (RFC 8572 section 4.2)
+package dns
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestServer serves the given records over UDP on the loopback and returns its address
+func startTestServer(t *testing.T, records []string) string {
+	t.Helper()
+	zone := map[string][]dns.RR{}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := dns.CanonicalName(rr.Header().Name) + dns.TypeToString[rr.Header().Rrtype]
+		zone[key] = append(zone[key], rr)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		m.Answer = zone[dns.CanonicalName(q.Name)+dns.TypeToString[q.Qtype]]
+		if len(m.Answer) == 0 {
+			m.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(m)
+	})}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func TestResolver_GetBootstrapServers(t *testing.T) {
+	tests := []struct {
+		name      string
+		records   []string
+		multicast bool
+		want      []string
+	}{
+		{
+			name: "device-specific records, TXT records are not bootstrap servers",
+			records: []string{
+				"SN1234._sztp.example.com. 60 IN SRV 20 0 8443 backup.example.com.",
+				"SN1234._sztp.example.com. 60 IN SRV 10 0 8080 bootstrap.example.com.",
+				`SN1234._sztp.example.com. 60 IN TXT "ci=\048\130"`,
+				"_sztp.example.com. 60 IN SRV 10 0 8080 generic.example.com.",
+			},
+			want: []string{
+				"bootstrap.example.com:8080",
+				"backup.example.com:8443",
+			},
+		},
+		{
+			name: "non-device-specific records",
+			records: []string{
+				"_sztp.example.com. 60 IN SRV 10 0 8080 generic.example.com.",
+			},
+			want: []string{"generic.example.com:8080"},
+		},
+		{
+			name: "invalid records are ignored",
+			records: []string{
+				"SN1234._sztp.example.com. 60 IN SRV 10 0 8080 .",
+				"SN1234._sztp.example.com. 60 IN SRV 20 0 0 noport.example.com.",
+				"SN1234._sztp.example.com. 60 IN SRV 30 0 8443 valid.example.com.",
+			},
+			want: []string{"valid.example.com:8443"},
+		},
+		{
+			name:      "multicast DNS",
+			multicast: true,
+			records: []string{
+				"SN1234._sztp.local. 60 IN SRV 10 0 8080 bootstrap.local.",
+			},
+			want: []string{"bootstrap.local:8080"},
+		},
+		{
+			name:    "no records",
+			records: nil,
+			want:    []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := startTestServer(t, tt.records)
+			r := &Resolver{Domains: []string{"example.com"}, Timeout: 200 * time.Millisecond}
+			if tt.multicast {
+				// The stand-in answers to the source port like an mDNS responder does for one-shot queries
+				r.Multicast = address
+			} else {
+				r.Servers = []string{address}
+			}
+			got, err := r.GetBootstrapServers(context.Background(), "SN1234")
+			if err != nil {
+				t.Fatalf("GetBootstrapServers() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetBootstrapServers() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+//nolint:funlen
+func TestResolver_GetBootstrappingData(t *testing.T) {
+	tests := []struct {
+		name      string
+		records   []string
+		multicast bool
+		want      []BootstrappingData
+	}{
+		{
+			name: "device-specific records with binary artifacts split in several strings",
+			records: []string{
+				`SN1234._sztp.example.com. 60 IN TXT "ci=\048\130\000" "\"\\\255"`,
+				`SN1234._sztp.example.com. 60 IN TXT "OC=\048\001"`,
+				`SN1234._sztp.example.com. 60 IN TXT "ov=\048\002"`,
+				`SN1234._sztp.example.com. 60 IN SRV 10 0 8080 bootstrap.example.com.`,
+				`_sztp.example.com. 60 IN TXT "ci=\048\003"`,
+			},
+			want: []BootstrappingData{{
+				ConveyedInformation: []byte{0x30, 0x82, 0x00, '"', '\\', 0xff},
+				OwnerCertificate:    []byte{0x30, 0x01},
+				OwnershipVoucher:    []byte{0x30, 0x02},
+			}},
+		},
+		{
+			name: "non-device-specific records, invalid and unknown keys are ignored",
+			records: []string{
+				`SN1234._sztp.example.com. 60 IN TXT "oc=\048\001"`,
+				`_sztp.example.com. 60 IN TXT "ci=\048\003"`,
+				`_sztp.example.com. 60 IN TXT "no-separator"`,
+				`_sztp.example.com. 60 IN TXT "ci="`,
+				`_sztp.example.com. 60 IN TXT "xx=\048"`,
+			},
+			want: []BootstrappingData{{ConveyedInformation: []byte{0x30, 0x03}}},
+		},
+		{
+			name:      "multicast DNS",
+			multicast: true,
+			records: []string{
+				`SN1234._sztp.local. 60 IN TXT "ci=\048\004"`,
+			},
+			want: []BootstrappingData{{ConveyedInformation: []byte{0x30, 0x04}}},
+		},
+		{
+			name: "no conveyed-information",
+			records: []string{
+				"SN1234._sztp.example.com. 60 IN SRV 10 0 8080 bootstrap.example.com.",
+			},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := startTestServer(t, tt.records)
+			r := &Resolver{Domains: []string{"example.com"}, Timeout: 200 * time.Millisecond}
+			if tt.multicast {
+				r.Multicast = address
+			} else {
+				r.Servers = []string{address}
+			}
+			got, err := r.GetBootstrappingData(context.Background(), "SN1234")
+			if err != nil {
+				t.Fatalf("GetBootstrappingData() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetBootstrappingData() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolver_GetBootstrapServersUnreachable(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing answers on this address
+	address := conn.LocalAddr().String()
+	r := &Resolver{Servers: []string{address}, Domains: []string{"example.com"}, Timeout: 100 * time.Millisecond}
+	if _, err := r.GetBootstrapServers(context.Background(), "SN1234"); err == nil {
+		t.Error("GetBootstrapServers() expected an error")
+	}
+	_ = conn.Close()
+}
+
+func TestNewResolver(t *testing.T) {
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(resolvConf, []byte("nameserver 192.0.2.53\nsearch example.com lab.example.com\noptions timeout:3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewResolver(resolvConf)
+	if err != nil {
+		t.Fatalf("NewResolver() error = %v", err)
+	}
+	want := &Resolver{
+		Servers:   []string{"192.0.2.53:53"},
+		Domains:   []string{"example.com", "lab.example.com"},
+		Multicast: MulticastAddress,
+		Timeout:   3 * time.Second,
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("NewResolver() got = %+v, want %+v", r, want)
+	}
+}
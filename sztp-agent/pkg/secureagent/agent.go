@@ -11,6 +11,7 @@ package secureagent
 
 import (
 	"net/http"
+	"time"
 )
 
 const (
@@ -18,6 +19,23 @@ const (
 	OS_RELEASE_FILE   = "/etc/os-release"
 	SZTP_REDIRECT_URL = "sztp-redirect-urls"
 	ARTIFACTS_PATH    = "/tmp/"
+	NONCE_LENGTH      = 32
+	// DBUS_LEASE_TIMEOUT bounds the wait for a DHCP lease carrying the sztp-redirect-urls option
+	DBUS_LEASE_TIMEOUT = 5 * time.Minute
+	// DHCP_CLIENT_TIMEOUT bounds the DHCPDISCOVER/DHCPREQUEST exchange of the built-in DHCP client
+	DHCP_CLIENT_TIMEOUT = time.Minute
+	// DNS_DISCOVERY_TIMEOUT bounds the unicast DNS and mDNS queries for the _sztp records
+	DNS_DISCOVERY_TIMEOUT = 10 * time.Second
+	// DAEMON_RETRY_INTERVAL is the wait before the daemon retries a failed bootstrap sequence
+	DAEMON_RETRY_INTERVAL = 5 * time.Second
+	// BOOT_ID_FILE identifies the current boot, to tell whether the device rebooted into the installed boot image
+	BOOT_ID_FILE = "/proc/sys/kernel/random/boot_id"
+	// DOWNLOAD_PROGRESS_INTERVAL is the minimum wait between two saves of the download progress in the status
+	DOWNLOAD_PROGRESS_INTERVAL = time.Second
+	// BOOTSTRAP_PATH is the RESTCONF operation of the bootstrap servers discovered or redirected to by their address only
+	BOOTSTRAP_PATH = "/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data"
+	// COMMAND_WAIT_DELAY bounds the wait for the output of a killed command, held open by its orphaned children
+	COMMAND_WAIT_DELAY = 10 * time.Second
 )
 
 type InputJSON struct {
@@ -43,6 +61,8 @@ type BootstrapServerOnboardingInfo struct {
 	IetfSztpConveyedInfoOnboardingInformation struct {
 		InfoTimestampReference string // [not received in json] This is the reference to know exactly the time file downloaded and reference to the artifacts of a specific request
 		BootImage              struct {
+			OsName            string   `json:"os-name,omitempty"`
+			OsVersion         string   `json:"os-version,omitempty"`
 			DownloadURI       []string `json:"download-uri"`
 			ImageVerification []struct {
 				HashAlgorithm string `json:"hash-algorithm"`
@@ -59,9 +79,27 @@ type BootstrapServerOnboardingInfo struct {
 type BootstrapServerPostOutput struct {
 	IetfSztpBootstrapServerOutput struct {
 		ConveyedInformation string `json:"conveyed-information"`
+		OwnerCertificate    string `json:"owner-certificate,omitempty"`
+		OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 	} `json:"ietf-sztp-bootstrap-server:output"`
 }
 
+// OwnershipVoucher is the voucher artifact (RFC 8366) conveyed by the bootstrap server, it pins the
+// domain certificate that signs the owner certificate
+type OwnershipVoucher struct {
+	IetfVoucherVoucher struct {
+		CreatedOn                  string `json:"created-on"`
+		ExpiresOn                  string `json:"expires-on,omitempty"`
+		Assertion                  string `json:"assertion"`
+		SerialNumber               string `json:"serial-number"`
+		IdevidIssuer               string `json:"idevid-issuer,omitempty"`
+		PinnedDomainCert           string `json:"pinned-domain-cert"`
+		DomainCertRevocationChecks bool   `json:"domain-cert-revocation-checks,omitempty"`
+		Nonce                      string `json:"nonce,omitempty"`
+		LastRenewalDate            string `json:"last-renewal-date,omitempty"`
+	} `json:"ietf-voucher:voucher"`
+}
+
 type BootstrapServerErrorOutput struct {
 	IetfRestconfErrors struct {
 		Error []struct {
@@ -81,21 +119,42 @@ type HttpClient interface {
 type Agent struct {
 	InputBootstrapURL             string                        // Bootstrap complete URL given by USER
 	BootstrapURL                  string                        // Bootstrap complete URL
+	BootstrapURLs                 []string                      // Discovered Bootstrap URLs, in the order they are tried
+	RedirectTrustAnchor           string                        // The CMS trust-anchor of the redirect bootstrap server in use, empty when not redirected
 	SerialNumber                  string                        // Device's Serial Number
 	DevicePassword                string                        // Device's Password
 	DevicePrivateKey              string                        // Device's private key
 	DeviceEndEntityCert           string                        // Device's end-entity cert
 	BootstrapTrustAnchorCert      string                        // the trusted bootstrap server's trust-anchor certificate (PEM)
+	ManufacturerTrustAnchorCert   string                        // the manufacturer trust anchor used to verify ownership vouchers (PEM)
 	ContentTypeReq                string                        // The content type for the request to the Server
 	InputJSONContent              string                        // The input.json file serialized
+	Nonce                         []byte                        // The nonce sent in the last get-bootstrapping-data request
+	NoncelessVoucher              bool                          // Do not send a nonce, requesting a nonceless ownership voucher
+	Insecure                      bool                          // The bootstrap server is not authenticated, for lab environments only
 	DhcpLeaseFile                 string                        // The dhcpfile
+	Dhcp6LeaseFile                string                        // The dhclient6 leases file
+	DhcpClientInterface           string                        // The interface the built-in DHCP client requests the bootstrap URLs on
+	DhcpInterfacePriority         []string                      // Interfaces whose DHCP leases are tried first, in order
+	DnsDiscovery                  bool                          // Also discover the bootstrap servers from the _sztp DNS records
+	RemovableStoragePath          string                        // The mounted removable storage holding signed bootstrapping data
+	BootstrapSources              []BootstrapSource             // The sources the bootstrap URLs are discovered from, in order, the default ones when empty
+	RetryPolicy                   RetryPolicy                   // How the daemon retries a failed bootstrap sequence
+	ImageInstaller                ImageInstaller                // Installs the boot image, it is only downloaded and verified when nil
+	RebootCommand                 string                        // Reboots the device into the installed boot image, run by /bin/sh
+	HashAlgorithms                HashAlgorithms                // The hash algorithms of the image-verification entries, the default ones when empty
+	ImageSigningTrustAnchor       string                        // the trust anchor of the boot image signatures, a PEM certificate or a minisign public key, not verified when empty
+	ImageSignatureFormat          string                        // ImageSignatureCMS or ImageSignatureMinisign, the detached signature is next to the boot image
 	ProgressJSON                  ProgressJSON                  // ProgressJson structure
 	BootstrapServerOnboardingInfo BootstrapServerOnboardingInfo // BootstrapServerOnboardingInfo structure
 	BootstrapServerRedirectInfo   BootstrapServerRedirectInfo   // BootstrapServerRedirectInfo structure
+	BaseHttpClient                HttpClient                    // The HttpClient before any redirect trust-anchor, every bootstrap sequence starts from it
+	DownloadHttpClient            HttpClient                    // Downloads the boot image and its signature, derived from BaseHttpClient when nil
 	HttpClient                    HttpClient
 	StatusFilePath                string // Path to the status file
 	ResultFilePath                string // Path to the result file
 	SymLinkDir                    string // Path to the symlink directory for the status file
+	StateFilePath                 string // Path to the state file the bootstrap sequence resumes from, no resume when empty
 }
 
 func NewAgent(bootstrapURL, serialNumber, dhcpLeaseFile, devicePassword, devicePrivateKey, deviceEndEntityCert, bootstrapTrustAnchorCert, statusFilePath, resultFilePath, symLinkDir string, httpClient HttpClient) *Agent {
@@ -114,9 +173,11 @@ func NewAgent(bootstrapURL, serialNumber, dhcpLeaseFile, devicePassword, deviceP
 		BootstrapServerRedirectInfo:   BootstrapServerRedirectInfo{},
 		BootstrapServerOnboardingInfo: BootstrapServerOnboardingInfo{},
 		HttpClient:                    httpClient,
+		BaseHttpClient:                httpClient,
 		StatusFilePath:                statusFilePath,
 		ResultFilePath:                resultFilePath,
 		SymLinkDir:                    symLinkDir,
+		RetryPolicy:                   DefaultRetryPolicy(),
 	}
 }
 
@@ -124,6 +185,14 @@ func (a *Agent) GetBootstrapURL() string {
 	return a.BootstrapURL
 }
 
+func (a *Agent) GetBootstrapURLs() []string {
+	return a.BootstrapURLs
+}
+
+func (a *Agent) GetRedirectTrustAnchor() string {
+	return a.RedirectTrustAnchor
+}
+
 func (a *Agent) GetSerialNumber() string {
 	return a.SerialNumber
 }
@@ -144,6 +213,10 @@ func (a *Agent) GetBootstrapTrustAnchorCert() string {
 	return a.BootstrapTrustAnchorCert
 }
 
+func (a *Agent) GetManufacturerTrustAnchorCert() string {
+	return a.ManufacturerTrustAnchorCert
+}
+
 func (a *Agent) GetContentTypeReq() string {
 	return a.ContentTypeReq
 }
@@ -152,6 +225,62 @@ func (a *Agent) GetInputJSONContent() string {
 	return a.InputJSONContent
 }
 
+func (a *Agent) GetNoncelessVoucher() bool {
+	return a.NoncelessVoucher
+}
+
+func (a *Agent) GetInsecure() bool {
+	return a.Insecure
+}
+
+func (a *Agent) GetDhcp6LeaseFile() string {
+	return a.Dhcp6LeaseFile
+}
+
+func (a *Agent) GetDhcpClientInterface() string {
+	return a.DhcpClientInterface
+}
+
+func (a *Agent) GetDhcpInterfacePriority() []string {
+	return a.DhcpInterfacePriority
+}
+
+func (a *Agent) GetDnsDiscovery() bool {
+	return a.DnsDiscovery
+}
+
+func (a *Agent) GetRemovableStoragePath() string {
+	return a.RemovableStoragePath
+}
+
+func (a *Agent) GetBootstrapSources() []BootstrapSource {
+	return a.BootstrapSources
+}
+
+func (a *Agent) GetRetryPolicy() RetryPolicy {
+	return a.RetryPolicy
+}
+
+func (a *Agent) GetImageInstaller() ImageInstaller {
+	return a.ImageInstaller
+}
+
+func (a *Agent) GetRebootCommand() string {
+	return a.RebootCommand
+}
+
+func (a *Agent) GetHashAlgorithms() HashAlgorithms {
+	return a.HashAlgorithms
+}
+
+func (a *Agent) GetImageSigningTrustAnchor() string {
+	return a.ImageSigningTrustAnchor
+}
+
+func (a *Agent) GetImageSignatureFormat() string {
+	return a.ImageSignatureFormat
+}
+
 func (a *Agent) GetProgressJSON() ProgressJSON {
 	return a.ProgressJSON
 }
@@ -168,10 +297,18 @@ func (a *Agent) GetSymLinkDir() string {
 	return a.SymLinkDir
 }
 
+func (a *Agent) GetStateFilePath() string {
+	return a.StateFilePath
+}
+
 func (a *Agent) SetBootstrapURL(url string) {
 	a.BootstrapURL = url
 }
 
+func (a *Agent) SetBootstrapURLs(urls []string) {
+	a.BootstrapURLs = urls
+}
+
 func (a *Agent) SetSerialNumber(serialNumber string) {
 	a.SerialNumber = serialNumber
 }
@@ -192,10 +329,70 @@ func (a *Agent) SetBootstrapTrustAnchorCert(cacert string) {
 	a.BootstrapTrustAnchorCert = cacert
 }
 
+func (a *Agent) SetManufacturerTrustAnchorCert(cacert string) {
+	a.ManufacturerTrustAnchorCert = cacert
+}
+
 func (a *Agent) SetContentTypeReq(ct string) {
 	a.ContentTypeReq = ct
 }
 
+func (a *Agent) SetNoncelessVoucher(nonceless bool) {
+	a.NoncelessVoucher = nonceless
+}
+
+func (a *Agent) SetInsecure(insecure bool) {
+	a.Insecure = insecure
+}
+
+func (a *Agent) SetDhcp6LeaseFile(leaseFile string) {
+	a.Dhcp6LeaseFile = leaseFile
+}
+
+func (a *Agent) SetDhcpClientInterface(iface string) {
+	a.DhcpClientInterface = iface
+}
+
+func (a *Agent) SetDhcpInterfacePriority(interfaces []string) {
+	a.DhcpInterfacePriority = interfaces
+}
+
+func (a *Agent) SetDnsDiscovery(dnsDiscovery bool) {
+	a.DnsDiscovery = dnsDiscovery
+}
+
+func (a *Agent) SetRemovableStoragePath(path string) {
+	a.RemovableStoragePath = path
+}
+
+func (a *Agent) SetBootstrapSources(sources []BootstrapSource) {
+	a.BootstrapSources = sources
+}
+
+func (a *Agent) SetRetryPolicy(policy RetryPolicy) {
+	a.RetryPolicy = policy
+}
+
+func (a *Agent) SetImageInstaller(installer ImageInstaller) {
+	a.ImageInstaller = installer
+}
+
+func (a *Agent) SetRebootCommand(command string) {
+	a.RebootCommand = command
+}
+
+func (a *Agent) SetHashAlgorithms(algorithms HashAlgorithms) {
+	a.HashAlgorithms = algorithms
+}
+
+func (a *Agent) SetImageSigningTrustAnchor(trustAnchor string) {
+	a.ImageSigningTrustAnchor = trustAnchor
+}
+
+func (a *Agent) SetImageSignatureFormat(format string) {
+	a.ImageSignatureFormat = format
+}
+
 func (a *Agent) SetProgressJSON(p ProgressJSON) {
 	a.ProgressJSON = p
 }
@@ -211,3 +408,7 @@ func (a *Agent) SetResultFilePath(path string) {
 func (a *Agent) SetSymLinkDir(path string) {
 	a.SymLinkDir = path
 }
+
+func (a *Agent) SetStateFilePath(path string) {
+	a.StateFilePath = path
+}
@@ -868,6 +868,8 @@ func TestNewAgent(t *testing.T) {
 				ResultFilePath:           "TestResultFilePath",
 				SymLinkDir:               "TestSymLinkDir",
 				HttpClient:               &client,
+				BaseHttpClient:           &client,
+				RetryPolicy:              DefaultRetryPolicy(),
 			},
 		},
 	}
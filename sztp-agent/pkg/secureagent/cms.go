@@ -0,0 +1,137 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	cms "github.com/github/smimesign/ietf-cms"
+	"github.com/github/smimesign/ietf-cms/oid"
+	"github.com/github/smimesign/ietf-cms/protocol"
+)
+
+// oidContentTypeSztpConveyedInfoJSON is the id-ct-sztpConveyedInfoJSON content type defined by RFC 8572
+var oidContentTypeSztpConveyedInfoJSON = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 43}
+
+// parseConveyedInformation returns the JSON document carried by the conveyed-information
+// CMS structure. When the bootstrap server provided ownership artifacts the conveyed
+// information must be signed by the owner certificate, which itself must chain to the
+// pinned-domain-cert of the ownership voucher. It must be signed as well when the bootstrap
+// server is untrusted, i.e. not authenticated (RFC 8572 section 5.6).
+func parseConveyedInformation(conveyedInfo []byte, ownerCerts []*x509.Certificate, pinnedDomainCert *x509.Certificate, untrusted bool) ([]byte, error) {
+	ci, err := protocol.ParseContentInfo(conveyedInfo)
+	if err != nil {
+		return nil, err
+	}
+	if ci.ContentType.Equal(oid.ContentTypeSignedData) {
+		if len(ownerCerts) == 0 || pinnedDomainCert == nil {
+			return nil, errors.New("signed conveyed-information received without ownership-voucher and owner-certificate")
+		}
+		return verifySignedConveyedInformation(conveyedInfo, ownerCerts, pinnedDomainCert)
+	}
+	if len(ownerCerts) != 0 {
+		return nil, errors.New("conveyed-information must be signed when owner-certificate is present")
+	}
+	if untrusted {
+		return nil, errors.New("conveyed-information must be signed when the bootstrap server is not authenticated")
+	}
+	if !isConveyedInformationContentType(ci.ContentType) {
+		return nil, fmt.Errorf("unsupported conveyed-information content type: %v", ci.ContentType)
+	}
+	var data asn1.RawValue
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &data); err != nil {
+		return nil, err
+	}
+	return data.Bytes, nil
+}
+
+// parseOwnerCertificate decodes the base64 encoded owner-certificate, a degenerate CMS
+// SignedData structure holding the owner certificate and its intermediates.
+func parseOwnerCertificate(ownerCertificate string) ([]*x509.Certificate, error) {
+	return parseCertificates(ownerCertificate, "owner-certificate")
+}
+
+// parseCertificates decodes a base64 encoded degenerate CMS SignedData structure, as used by
+// the owner-certificate and trust-anchor nodes, and returns the certificates it contains.
+func parseCertificates(encoded string, name string) ([]*x509.Certificate, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	sd, err := cms.ParseSignedData(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	certs, err := sd.GetCertificates()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s does not contain any certificate", name)
+	}
+	return certs, nil
+}
+
+// verifySignedConveyedInformation checks that the SignedData was signed by the owner
+// certificate and returns the encapsulated conveyed information.
+func verifySignedConveyedInformation(ber []byte, ownerCerts []*x509.Certificate, pinnedDomainCert *x509.Certificate) ([]byte, error) {
+	sd, err := cms.ParseSignedData(ber)
+	if err != nil {
+		return nil, err
+	}
+	// Only the owner certificate is allowed to sign, ignore whatever the signer embedded
+	if err := sd.SetCertificates(ownerCerts); err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(pinnedDomainCert)
+	_, err = sd.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("conveyed-information signature verification failed: %w", err)
+	}
+	contentType, content, err := signedDataContent(ber)
+	if err != nil {
+		return nil, err
+	}
+	if !isConveyedInformationContentType(contentType) {
+		return nil, fmt.Errorf("unsupported signed conveyed-information content type: %v", contentType)
+	}
+	return content, nil
+}
+
+// signedDataContent returns the type and value of the content encapsulated in a SignedData
+func signedDataContent(ber []byte) (asn1.ObjectIdentifier, []byte, error) {
+	ci, err := protocol.ParseContentInfo(ber)
+	if err != nil {
+		return nil, nil, err
+	}
+	psd, err := ci.SignedDataContent()
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := psd.EncapContentInfo.EContentValue()
+	if err != nil {
+		return nil, nil, err
+	}
+	if content == nil {
+		return nil, nil, errors.New("signed data has no content")
+	}
+	return psd.EncapContentInfo.EContentType, content, nil
+}
+
+func isConveyedInformationContentType(contentType asn1.ObjectIdentifier) bool {
+	return contentType.Equal(oidContentTypeSztpConveyedInfoJSON) || contentType.Equal(oid.ContentTypeData)
+}
@@ -0,0 +1,278 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/github/smimesign/ietf-cms/oid"
+	"github.com/github/smimesign/ietf-cms/protocol"
+)
+
+const testConveyedInformation = `{"ietf-sztp-conveyed-info:onboarding-information":{"configuration":"dGVzdA=="}}`
+
+func newTestCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func newTestCertificateBundle(t *testing.T, certs ...*x509.Certificate) string {
+	t.Helper()
+	psd, err := protocol.NewSignedData(protocol.EncapsulatedContentInfo{EContentType: oid.ContentTypeData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cert := range certs {
+		if err := psd.AddCertificate(cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	der, err := psd.ContentInfoDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func newTestSignedData(t *testing.T, contentType asn1.ObjectIdentifier, content []byte, cert *x509.Certificate, key crypto.Signer) []byte {
+	t.Helper()
+	eci, err := protocol.NewEncapsulatedContentInfo(contentType, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psd, err := protocol.NewSignedData(eci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := psd.AddSignerInfo([]*x509.Certificate{cert}, key); err != nil {
+		t.Fatal(err)
+	}
+	der, err := psd.ContentInfoDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func newTestContentInfo(t *testing.T, contentType asn1.ObjectIdentifier, content []byte) []byte {
+	t.Helper()
+	octets, err := asn1.Marshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(protocol.ContentInfo{
+		ContentType: contentType,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: octets, IsCompound: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+//nolint:funlen
+func Test_parseConveyedInformation(t *testing.T) {
+	rootCert, rootKey := newTestCertificate(t, "root", nil, nil)
+	ownerCert, ownerKey := newTestCertificate(t, "owner", rootCert, rootKey)
+	otherCert, otherKey := newTestCertificate(t, "other", nil, nil)
+
+	tampered := newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ownerCert, ownerKey)
+	tampered[len(tampered)-1] ^= 0xff
+
+	type args struct {
+		conveyedInfo     []byte
+		ownerCerts       []*x509.Certificate
+		pinnedDomainCert *x509.Certificate
+		untrusted        bool
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "unsigned conveyed information",
+			args: args{
+				conveyedInfo: newTestContentInfo(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation)),
+			},
+			want:    []byte(testConveyedInformation),
+			wantErr: false,
+		},
+		{
+			name: "unsigned conveyed information from an untrusted bootstrap server",
+			args: args{
+				conveyedInfo: newTestContentInfo(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation)),
+				untrusted:    true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "signed conveyed information from an untrusted bootstrap server",
+			args: args{
+				conveyedInfo:     newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ownerCert, ownerKey),
+				ownerCerts:       []*x509.Certificate{ownerCert},
+				pinnedDomainCert: ownerCert,
+				untrusted:        true,
+			},
+			want:    []byte(testConveyedInformation),
+			wantErr: false,
+		},
+		{
+			name: "signed conveyed information with the owner certificate pinned",
+			args: args{
+				conveyedInfo:     newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ownerCert, ownerKey),
+				ownerCerts:       []*x509.Certificate{ownerCert},
+				pinnedDomainCert: ownerCert,
+			},
+			want:    []byte(testConveyedInformation),
+			wantErr: false,
+		},
+		{
+			name: "signed conveyed information with the owner certificate chaining to the pinned certificate",
+			args: args{
+				conveyedInfo:     newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ownerCert, ownerKey),
+				ownerCerts:       []*x509.Certificate{ownerCert, rootCert},
+				pinnedDomainCert: rootCert,
+			},
+			want:    []byte(testConveyedInformation),
+			wantErr: false,
+		},
+		{
+			name: "owner certificate not chaining to the pinned certificate",
+			args: args{
+				conveyedInfo:     newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ownerCert, ownerKey),
+				ownerCerts:       []*x509.Certificate{ownerCert},
+				pinnedDomainCert: otherCert,
+			},
+			wantErr: true,
+		},
+		{
+			name: "signed conveyed information signed by another certificate",
+			args: args{
+				conveyedInfo:     newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), otherCert, otherKey),
+				ownerCerts:       []*x509.Certificate{ownerCert},
+				pinnedDomainCert: rootCert,
+			},
+			wantErr: true,
+		},
+		{
+			name: "signed conveyed information with a tampered signature",
+			args: args{
+				conveyedInfo:     tampered,
+				ownerCerts:       []*x509.Certificate{ownerCert},
+				pinnedDomainCert: rootCert,
+			},
+			wantErr: true,
+		},
+		{
+			name: "signed conveyed information without owner certificate",
+			args: args{
+				conveyedInfo: newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ownerCert, ownerKey),
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsigned conveyed information with owner certificate",
+			args: args{
+				conveyedInfo:     newTestContentInfo(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation)),
+				ownerCerts:       []*x509.Certificate{ownerCert},
+				pinnedDomainCert: rootCert,
+			},
+			wantErr: true,
+		},
+		{
+			name: "signed conveyed information with unexpected content type",
+			args: args{
+				conveyedInfo:     newTestSignedData(t, oid.ContentTypeTSTInfo, []byte(testConveyedInformation), ownerCert, ownerKey),
+				ownerCerts:       []*x509.Certificate{ownerCert},
+				pinnedDomainCert: rootCert,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid CMS structure",
+			args: args{
+				conveyedInfo: []byte("not a CMS structure"),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConveyedInformation(tt.args.conveyedInfo, tt.args.ownerCerts, tt.args.pinnedDomainCert, tt.args.untrusted)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseConveyedInformation() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConveyedInformation() got = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseOwnerCertificate(t *testing.T) {
+	rootCert, rootKey := newTestCertificate(t, "root", nil, nil)
+	ownerCert, _ := newTestCertificate(t, "owner", rootCert, rootKey)
+
+	got, err := parseOwnerCertificate(newTestCertificateBundle(t, ownerCert, rootCert))
+	if err != nil {
+		t.Fatalf("parseOwnerCertificate() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("parseOwnerCertificate() got %d certificates, want owner and root", len(got))
+	}
+	for _, cert := range got {
+		if !cert.Equal(ownerCert) && !cert.Equal(rootCert) {
+			t.Errorf("parseOwnerCertificate() got unexpected certificate %v", cert.Subject)
+		}
+	}
+	if _, err := parseOwnerCertificate(newTestCertificateBundle(t)); err == nil {
+		t.Errorf("parseOwnerCertificate() expected an error for an empty bundle")
+	}
+	if _, err := parseOwnerCertificate("{wrongBASE64}"); err == nil {
+		t.Errorf("parseOwnerCertificate() expected an error for an invalid bundle")
+	}
+}
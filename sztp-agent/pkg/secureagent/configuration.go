@@ -1,15 +1,19 @@
 package secureagent
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"log"
 	"os"
 	"os/exec"
+	"syscall"
 )
 
-func (a *Agent) copyConfigurationFile() error {
+func (a *Agent) copyConfigurationFile(ctx context.Context) error {
 	log.Println("[INFO] Starting the Copy Configuration.")
-	_ = a.doReportProgress(ProgressTypeConfigInitiated, "Configuration Initiated")
+	_ = a.doReportProgress(ctx, ProgressTypeConfigInitiated, "Configuration Initiated")
 	_ = a.updateAndSaveStatus(StageTypeConfig, true, "")
 	// Copy the configuration file to the device
 	file, err := os.Create(ARTIFACTS_PATH + a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.InfoTimestampReference + "-config")
@@ -36,12 +40,12 @@ func (a *Agent) copyConfigurationFile() error {
 		return err
 	}
 	log.Println("[INFO] Configuration file copied successfully")
-	_ = a.doReportProgress(ProgressTypeConfigComplete, "Configuration Complete")
+	_ = a.doReportProgress(ctx, ProgressTypeConfigComplete, "Configuration Complete")
 	_ = a.updateAndSaveStatus(StageTypeConfig, false, "")
 	return nil
 }
 
-func (a *Agent) launchScriptsConfiguration(typeOf string) error {
+func (a *Agent) launchScriptsConfiguration(ctx context.Context, typeOf string) error {
 	var script, scriptName string
 	var reportStart, reportEnd ProgressType
 	switch typeOf {
@@ -57,7 +61,7 @@ func (a *Agent) launchScriptsConfiguration(typeOf string) error {
 		reportEnd = ProgressTypePreScriptComplete
 	}
 	log.Println("[INFO] Starting the " + scriptName + "-configuration.")
-	_ = a.doReportProgress(reportStart, "Report starting")
+	_ = a.doReportProgress(ctx, reportStart, "Report starting")
 	if scriptName == PRE {
 		_ = a.updateAndSaveStatus(StageTypePreScript, true, "")
 	} else if scriptName == POST {
@@ -88,14 +92,13 @@ func (a *Agent) launchScriptsConfiguration(typeOf string) error {
 		return err
 	}
 	log.Println("[INFO] " + scriptName + "-configuration script created successfully")
-	cmd := exec.Command("/bin/sh", ARTIFACTS_PATH+a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.InfoTimestampReference+scriptName+"configuration.sh") //nolint:gosec
-	out, err := cmd.Output()
+	out, err := runCommand(ctx, "/bin/sh", ARTIFACTS_PATH+a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.InfoTimestampReference+scriptName+"configuration.sh")
 	if err != nil {
 		log.Println("[ERROR] running the "+scriptName+"-configuration script", err.Error())
 		return err
 	}
 	log.Println(string(out)) // remove it
-	_ = a.doReportProgress(reportEnd, "Report end")
+	_ = a.doReportProgress(ctx, reportEnd, "Report end")
 	if scriptName == PRE {
 		_ = a.updateAndSaveStatus(StageTypePreScript, false, "")
 	} else if scriptName == POST {
@@ -104,3 +107,26 @@ func (a *Agent) launchScriptsConfiguration(typeOf string) error {
 	log.Println("[INFO] " + scriptName + "-Configuration script executed successfully")
 	return nil
 }
+
+// runCommand runs a command, such as a script, and returns its output. The command runs in its own
+// process group, so that it is killed along with the processes it started when ctx is done.
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...) //nolint:gosec
+	cmd.Stdout = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		log.Printf("[INFO] Killing %s", cmd)
+		err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	cmd.WaitDelay = COMMAND_WAIT_DELAY
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return out.Bytes(), ctx.Err()
+	}
+	return out.Bytes(), err
+}
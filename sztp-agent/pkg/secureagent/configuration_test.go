@@ -1,8 +1,13 @@
 package secureagent
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // nolint:funlen
@@ -43,6 +48,8 @@ func TestAgent_copyConfigurationFile(t *testing.T) {
 					IetfSztpConveyedInfoOnboardingInformation: struct {
 						InfoTimestampReference string
 						BootImage              struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -56,6 +63,8 @@ func TestAgent_copyConfigurationFile(t *testing.T) {
 					}{
 						InfoTimestampReference: " ../ ",
 						BootImage: struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -98,6 +107,8 @@ func TestAgent_copyConfigurationFile(t *testing.T) {
 					IetfSztpConveyedInfoOnboardingInformation: struct {
 						InfoTimestampReference string
 						BootImage              struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -111,6 +122,8 @@ func TestAgent_copyConfigurationFile(t *testing.T) {
 					}{
 						InfoTimestampReference: "PATHOK",
 						BootImage: struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -154,7 +167,7 @@ func TestAgent_copyConfigurationFile(t *testing.T) {
 				BootstrapServerRedirectInfo:   tt.fields.BootstrapServerRedirectInfo,
 				HttpClient:                    &http.Client{},
 			}
-			if err := a.copyConfigurationFile(); (err != nil) != tt.wantErr {
+			if err := a.copyConfigurationFile(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("copyConfigurationFile() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -204,6 +217,8 @@ func TestAgent_launchScriptsConfiguration(t *testing.T) {
 					IetfSztpConveyedInfoOnboardingInformation: struct {
 						InfoTimestampReference string
 						BootImage              struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -217,6 +232,8 @@ func TestAgent_launchScriptsConfiguration(t *testing.T) {
 					}{
 						InfoTimestampReference: "PATHOK",
 						BootImage: struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -260,6 +277,8 @@ func TestAgent_launchScriptsConfiguration(t *testing.T) {
 					IetfSztpConveyedInfoOnboardingInformation: struct {
 						InfoTimestampReference string
 						BootImage              struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -273,6 +292,8 @@ func TestAgent_launchScriptsConfiguration(t *testing.T) {
 					}{
 						InfoTimestampReference: "PATHOK",
 						BootImage: struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -316,6 +337,8 @@ func TestAgent_launchScriptsConfiguration(t *testing.T) {
 					IetfSztpConveyedInfoOnboardingInformation: struct {
 						InfoTimestampReference string
 						BootImage              struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -329,6 +352,8 @@ func TestAgent_launchScriptsConfiguration(t *testing.T) {
 					}{
 						InfoTimestampReference: " ../",
 						BootImage: struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -372,9 +397,35 @@ func TestAgent_launchScriptsConfiguration(t *testing.T) {
 				BootstrapServerRedirectInfo:   tt.fields.BootstrapServerRedirectInfo,
 				HttpClient:                    &http.Client{},
 			}
-			if err := a.launchScriptsConfiguration(tt.args.typeOf); (err != nil) != tt.wantErr {
+			if err := a.launchScriptsConfiguration(context.Background(), tt.args.typeOf); (err != nil) != tt.wantErr {
 				t.Errorf("launchScriptsConfiguration() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestRunCommand(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.sh")
+	if err := os.WriteFile(script, []byte("echo configured\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runCommand(context.Background(), "/bin/sh", script)
+	if err != nil || string(out) != "configured\n" {
+		t.Errorf("runCommand() = %q, %v, want %q, nil", out, err, "configured\n")
+	}
+
+	// The processes started by the script are killed along with it
+	if err := os.WriteFile(script, []byte("sleep 30 &\nsleep 30\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := runCommand(ctx, "/bin/sh", script); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("runCommand() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("runCommand() returned after %v, the script was not killed", elapsed)
+	}
+}
@@ -10,18 +10,16 @@ package secureagent
 
 import (
 	"bytes"
-	"encoding/asn1"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"net/url"
+	"net"
 	"reflect"
+	"strconv"
 	"time"
-
-	"github.com/github/smimesign/ietf-cms/protocol"
-	"github.com/opiproject/sztp/sztp-agent/pkg/dhcp"
 )
 
 const (
@@ -32,148 +30,280 @@ const (
 )
 
 // RunCommandDaemon runs the command in the background
-func (a *Agent) RunCommandDaemon() error {
+func (a *Agent) RunCommandDaemon(ctx context.Context) error {
 	if err := a.prepareStatus(); err != nil {
 		log.Println("failed to prepare status: ", err)
 		return err
 	}
 	_ = a.updateAndSaveStatus(StageTypeIsCompleted, true, "")
-	for {
-		err := a.performBootstrapSequence()
-		if err != nil {
-			log.Println("[ERROR] Failed to perform the bootstrap sequence: ", err.Error())
-			log.Println("[INFO] Retrying in 5 seconds")
-			time.Sleep(5 * time.Second)
-			_ = a.updateAndSaveStatus(StageTypeIsCompleted, false, err.Error())
-			continue
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var changes <-chan struct{}
+	if a.RemovableStoragePath == "" {
+		changes = a.watchBootstrapSources(watchCtx)
+	}
+	policy := a.GetRetryPolicy()
+	if policy == (RetryPolicy{}) {
+		policy = DefaultRetryPolicy()
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := a.performBootstrapSequence(ctx)
+		if err == nil {
+			_ = a.updateAndSaveStatus(StageTypeIsCompleted, false, "")
+			return nil
 		}
-		_ = a.updateAndSaveStatus(StageTypeIsCompleted, false, "")
-		return nil
+		if errors.Is(err, errRebootPending) {
+			log.Println("[INFO] The bootstrap sequence resumes after the reboot")
+			return nil
+		}
+		if ctx.Err() != nil {
+			return a.abortBootstrapSequence(ctx)
+		}
+		log.Println("[ERROR] Failed to perform the bootstrap sequence: ", err.Error())
+		_ = a.updateAndSaveStatus(StageTypeIsCompleted, false, err.Error())
+		wait := policy.NextInterval(attempt)
+		if policy.GiveUp(attempt, time.Since(start), wait) {
+			// The next run starts from scratch, e.g. when the reboot into the boot image kept failing
+			a.removeBootstrapState()
+			return fmt.Errorf("giving up the bootstrap sequence after %d attempts in %v: %w", attempt, time.Since(start).Round(time.Second), err)
+		}
+		log.Printf("[INFO] Retrying in %v", wait.Round(time.Millisecond))
+		_ = a.updateAndSaveNextRetry(time.Now().Add(wait))
+		if err := waitForRetry(ctx, changes, wait); err != nil {
+			return a.abortBootstrapSequence(ctx)
+		}
+		_ = a.updateAndSaveNextRetry(time.Time{})
 	}
 }
 
-func (a *Agent) performBootstrapSequence() error {
-	var err error
-	err = a.discoverBootstrapURLs()
-	if err != nil {
-		_ = a.updateAndSaveStatus(StageTypeParsing, false, err.Error())
-		return err
-	}
-	err = a.doRequestBootstrapServerOnboardingInfo()
-	if err != nil {
-		_ = a.updateAndSaveStatus(StageTypeOnboarding, false, err.Error())
-		return err
+// waitForRetry waits for the retry interval, or until the bootstrap URLs change. It returns the
+// error of ctx if it is done first.
+func waitForRetry(ctx context.Context, changes <-chan struct{}, interval time.Duration) error {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	case <-changes:
+		log.Println("[INFO] The Bootstrap URLs changed, retrying now")
 	}
-	err = a.doHandleBootstrapRedirect()
-	if err != nil {
-		_ = a.updateAndSaveStatus(StageTypeBootImage, false, err.Error())
-		return err
+	return nil
+}
+
+// abortBootstrapSequence records that the bootstrap sequence was stopped before completing, e.g. on
+// SIGTERM or SIGINT, and returns the error of ctx
+func (a *Agent) abortBootstrapSequence(ctx context.Context) error {
+	err := fmt.Errorf("bootstrap sequence aborted: %w", ctx.Err())
+	log.Println("[INFO] " + err.Error())
+	_ = a.updateAndSaveAborted(err.Error())
+	return err
+}
+
+// performBootstrapSequence runs the stages of the bootstrap sequence. Once a boot image is installed,
+// the device reboots into it and the stages completed before the reboot are skipped.
+func (a *Agent) performBootstrapSequence(ctx context.Context) error {
+	state := a.loadBootstrapState()
+	if state.pendingReboot() {
+		a.resumeBootstrapSequence(state)
+		if state.pendingReboot() {
+			// The agent was restarted, or the reboot failed, before the device rebooted
+			return a.reboot(ctx)
+		}
+	} else {
+		if err := a.requestBootstrappingData(ctx); err != nil {
+			return err
+		}
+		a.completeStage(state, StageTypeOnboarding)
 	}
-	err = a.downloadAndValidateImage()
-	if err != nil {
-		_ = a.updateAndSaveStatus(StageTypeBootImage, false, err.Error())
-		return err
+	stages := []struct {
+		stage StageType
+		run   func(ctx context.Context) error
+	}{
+		{stage: StageTypeBootImage, run: a.downloadAndValidateImage},
+		{stage: StageTypeConfig, run: a.copyConfigurationFile},
+		{stage: StageTypePreScript, run: func(ctx context.Context) error { return a.launchScriptsConfiguration(ctx, PRE) }},
+		{stage: StageTypePostScript, run: func(ctx context.Context) error { return a.launchScriptsConfiguration(ctx, POST) }},
 	}
-	err = a.copyConfigurationFile()
-	if err != nil {
-		_ = a.updateAndSaveStatus(StageTypeConfig, false, err.Error())
-		return err
+	for _, s := range stages {
+		if state.completed(s.stage) {
+			log.Printf("[INFO] Skipping the %s stage completed before", s.stage)
+			continue
+		}
+		if err := s.run(ctx); err != nil {
+			_ = a.updateAndSaveStatus(s.stage, false, err.Error())
+			return err
+		}
+		a.completeStage(state, s.stage)
+		if s.stage == StageTypeBootImage && a.bootImageInstalled() {
+			if err := a.prepareReboot(ctx, state); err != nil {
+				return err
+			}
+			return a.reboot(ctx)
+		}
 	}
-	err = a.launchScriptsConfiguration(PRE)
-	if err != nil {
-		_ = a.updateAndSaveStatus(StageTypePreScript, false, err.Error())
-		return err
+	_ = a.doReportProgress(ctx, ProgressTypeBootstrapComplete, "Bootstrap Complete")
+	_ = a.updateAndSaveStatus(StageTypeBootstrap, false, "")
+	return nil
+}
+
+// requestBootstrappingData retrieves the onboarding information, from removable storage or from
+// the discovered bootstrap servers, following the redirects
+func (a *Agent) requestBootstrappingData(ctx context.Context) error {
+	// A previous bootstrap sequence may have been redirected
+	a.resetRedirect()
+	var err error
+	if a.RemovableStoragePath != "" {
+		err = a.loadRemovableStorageBootstrappingData()
+		if err != nil {
+			_ = a.updateAndSaveStatus(onboardingErrorStage(err, StageTypeOnboarding), false, err.Error())
+			return err
+		}
+	} else if !a.loadSourcesBootstrappingData(ctx) {
+		err = a.discoverBootstrapURLs(ctx)
+		if err != nil {
+			_ = a.updateAndSaveStatus(StageTypeParsing, false, err.Error())
+			return err
+		}
+		err = a.doRequestBootstrapServersOnboardingInfo(ctx)
+		if err != nil {
+			_ = a.updateAndSaveStatus(onboardingErrorStage(err, StageTypeOnboarding), false, err.Error())
+			return err
+		}
 	}
-	err = a.launchScriptsConfiguration(POST)
+	err = a.doHandleBootstrapRedirect(ctx)
 	if err != nil {
-		_ = a.updateAndSaveStatus(StageTypePostScript, false, err.Error())
+		_ = a.updateAndSaveStatus(onboardingErrorStage(err, StageTypeRedirect), false, err.Error())
 		return err
 	}
-	_ = a.doReportProgress(ProgressTypeBootstrapComplete, "Bootstrap Complete")
-	_ = a.updateAndSaveStatus(StageTypeBootstrap, false, "")
 	return nil
 }
 
-func (a *Agent) discoverBootstrapURLs() error {
-	log.Println("[INFO] Discovering the Bootstrap URL")
-	if a.InputBootstrapURL != "" {
-		log.Println("[INFO] User gave us the Bootstrap URL: " + a.InputBootstrapURL)
-		a.SetBootstrapURL(a.InputBootstrapURL)
-		log.Println("[INFO] Bootstrap URL retrieved successfully: " + a.GetBootstrapURL())
-		return nil
+// doRequestBootstrapServersOnboardingInfo tries the discovered bootstrap URLs in order until
+// one of the bootstrap servers provides the bootstrapping data
+func (a *Agent) doRequestBootstrapServersOnboardingInfo(ctx context.Context) error {
+	urls := a.GetBootstrapURLs()
+	if len(urls) == 0 {
+		if a.GetBootstrapURL() == "" {
+			return errors.New("no bootstrap URL discovered")
+		}
+		urls = []string{a.GetBootstrapURL()}
 	}
-	if a.DhcpLeaseFile != "" {
-		log.Println("[INFO] User gave us the DHCP Lease File: " + a.DhcpLeaseFile)
-		urls, err := dhcp.GetBootstrapURLsViaLeaseFile(a.DhcpLeaseFile, SZTP_REDIRECT_URL)
-		if err != nil {
-			return err
+	var err error
+	for _, bootstrapURL := range urls {
+		a.SetBootstrapURL(bootstrapURL)
+		err = a.doRequestBootstrapServerOnboardingInfo(ctx)
+		if err == nil {
+			return nil
 		}
-		a.SetBootstrapURL(urls[0])
-		log.Println("[INFO] Bootstrap URL retrieved successfully: " + a.GetBootstrapURL())
-		return nil
+		log.Printf("[ERROR] Bootstrap server %s failed: %v", bootstrapURL, err)
 	}
-	log.Println("[INFO] User gave us nothing, discover the Bootstrap URL from Network Manager via dbus")
-	// TODO: fetch the Bootstrap URL from Network Manager via dbus in the future
-	log.Println("[INFO] Bootstrap URL retrieved successfully: " + a.GetBootstrapURL())
-	return nil
+	if len(urls) == 1 {
+		return err
+	}
+	return fmt.Errorf("none of the %d bootstrap URLs succeeded, last error: %w", len(urls), err)
 }
 
-func (a *Agent) doHandleBootstrapRedirect() error {
+func (a *Agent) doHandleBootstrapRedirect(ctx context.Context) error {
 	if reflect.ValueOf(a.BootstrapServerRedirectInfo).IsZero() {
 		return nil
 	}
 
 	log.Println("[INFO] Go Re-direct instead of On-boarding, processing...")
+	_ = a.updateAndSaveStatus(StageTypeRedirect, true, "")
 
-	// TODO: BootstrapServer can be an array
-	// TODO: do not ignore BootstrapServer[0].TrustAnchor
-	addr := a.BootstrapServerRedirectInfo.IetfSztpConveyedInfoRedirectInformation.BootstrapServer[0].Address
-	port := a.BootstrapServerRedirectInfo.IetfSztpConveyedInfoRedirectInformation.BootstrapServer[0].Port
+	servers := a.BootstrapServerRedirectInfo.IetfSztpConveyedInfoRedirectInformation.BootstrapServer
+	if len(servers) == 0 {
+		return errors.New("redirect-information does not list any bootstrap server")
+	}
+	// Every bootstrap server is tried with its own trust anchor, starting from the original client
+	bootstrapURL := a.GetBootstrapURL()
+	var err error
+	for _, server := range servers {
+		err = a.doRequestRedirectBootstrapServer(ctx, server.Address, server.Port, server.TrustAnchor)
+		if err == nil {
+			_ = a.updateAndSaveStatus(StageTypeRedirect, false, "")
+			return nil
+		}
+		log.Printf("[ERROR] Bootstrap server %q (port %d) failed: %v", server.Address, server.Port, err)
+		a.SetBootstrapURL(bootstrapURL)
+		if a.BaseHttpClient != nil {
+			a.HttpClient = a.BaseHttpClient
+			a.RedirectTrustAnchor = ""
+		}
+	}
+	return fmt.Errorf("none of the %d redirect bootstrap servers succeeded, last error: %w", len(servers), err)
+}
 
+// doRequestRedirectBootstrapServer requests the onboarding information from one of the
+// bootstrap servers listed in the redirect-information
+func (a *Agent) doRequestRedirectBootstrapServer(ctx context.Context, addr string, port int, trustAnchor string) error {
 	if addr == "" {
 		return errors.New("invalid redirect address")
 	}
-	if port <= 0 {
+	if port < 0 || port > 65535 {
 		return errors.New("invalid port")
 	}
-	// Change URL to point to new redirect IP and PORT
-	u, err := url.Parse(a.GetBootstrapURL())
-	if err != nil {
-		return err
+	// The port is optional and defaults to the HTTPS port
+	if port == 0 {
+		port = 443
+	}
+	// The redirect bootstrap server is only known by its address, whatever the bootstrapping data came from
+	a.SetBootstrapURL("https://" + net.JoinHostPort(addr, strconv.Itoa(port)) + BOOTSTRAP_PATH)
+	log.Println("[INFO] Trying the redirect bootstrap server: " + a.GetBootstrapURL())
+	if trustAnchor != "" {
+		if err := a.useTrustAnchor(trustAnchor); err != nil {
+			return err
+		}
 	}
-	u.Host = fmt.Sprintf("%s:%d", addr, port)
-	a.SetBootstrapURL(u.String())
 
 	// Request onboard ino again (with new URL now)
-	return a.doRequestBootstrapServerOnboardingInfo()
+	return a.doRequestBootstrapServerOnboardingInfo(ctx)
 }
 
-func (a *Agent) doRequestBootstrapServerOnboardingInfo() error {
+func (a *Agent) doRequestBootstrapServerOnboardingInfo(ctx context.Context) error {
 	log.Println("[INFO] Starting the Request to get On-boarding Information.")
-	res, err := a.doTLSRequest(a.GetInputJSONContent(), a.GetBootstrapURL(), false)
+	input, err := a.requestInputJSONContent()
+	if err != nil {
+		return err
+	}
+	res, err := a.doTLSRequest(ctx, input, a.GetBootstrapURL(), false)
 	if err != nil {
 		log.Println("[ERROR] ", err.Error())
 		return err
 	}
 	log.Println("[INFO] Response retrieved successfully")
-	_ = a.doReportProgress(ProgressTypeBootstrapInitiated, "Bootstrap Initiated")
+	_ = a.doReportProgress(ctx, ProgressTypeBootstrapInitiated, "Bootstrap Initiated")
 	_ = a.updateAndSaveStatus(StageTypeBootstrap, true, "")
 	crypto := res.IetfSztpBootstrapServerOutput.ConveyedInformation
 	newVal, err := base64.StdEncoding.DecodeString(crypto)
 	if err != nil {
 		return err
 	}
-	ci, err := protocol.ParseContentInfo(newVal)
+	if err := a.processBootstrappingData(newVal, res.IetfSztpBootstrapServerOutput.OwnershipVoucher, res.IetfSztpBootstrapServerOutput.OwnerCertificate); err != nil {
+		return err
+	}
+	_ = a.updateAndSaveBootstrapServer(a.GetBootstrapURL())
+	return nil
+}
+
+// processBootstrappingData decrypts and verifies the conveyed-information, whatever its source, and
+// stores the onboarding or redirect information it contains
+func (a *Agent) processBootstrappingData(conveyedInfo []byte, ownershipVoucher, ownerCertificate string) error {
+	newVal, err := a.decryptConveyedInformation(conveyedInfo)
+	if err != nil {
+		return err
+	}
+	ownerCerts, pinnedDomainCert, err := a.verifyOwnership(ownershipVoucher, ownerCertificate)
 	if err != nil {
 		return err
 	}
-	var data asn1.RawValue
-	_, kerr := asn1.Unmarshal(ci.Content.Bytes, &data)
-	if kerr != nil {
-		return kerr
+	data, err := parseConveyedInformation(newVal, ownerCerts, pinnedDomainCert, a.GetInsecure())
+	if err != nil {
+		return err
 	}
-	res.IetfSztpBootstrapServerOutput.ConveyedInformation = string(data.Bytes)
-	decoderoi := json.NewDecoder(bytes.NewReader(data.Bytes))
+	decoderoi := json.NewDecoder(bytes.NewReader(data))
 	decoderoi.DisallowUnknownFields()
 	var oi BootstrapServerOnboardingInfo
 	erroi := decoderoi.Decode(&oi)
@@ -182,7 +312,7 @@ func (a *Agent) doRequestBootstrapServerOnboardingInfo() error {
 		log.Printf("[INFO] The BootstrapServerOnBoardingInfo object retrieved is: %v", a.BootstrapServerOnboardingInfo)
 		return nil
 	}
-	decoderri := json.NewDecoder(bytes.NewReader(data.Bytes))
+	decoderri := json.NewDecoder(bytes.NewReader(data))
 	decoderri.DisallowUnknownFields()
 	var ri BootstrapServerRedirectInfo
 	errri := decoderri.Decode(&ri)
@@ -193,3 +323,12 @@ func (a *Agent) doRequestBootstrapServerOnboardingInfo() error {
 	}
 	return errri
 }
+
+// onboardingErrorStage returns the stage an onboarding request error is reported under,
+// decryption failures get their own stage so they can be told apart from transport errors
+func onboardingErrorStage(err error, stage StageType) StageType {
+	if errors.Is(err, errConveyedInformationDecryption) {
+		return StageTypeDecrypting
+	}
+	return stage
+}
@@ -5,15 +5,23 @@
 package secureagent
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"testing"
 
+	"errors"
 	"github.com/jarcoal/httpmock"
+	"time"
 )
 
 const DHCPTestContent = `lease {
@@ -27,9 +35,9 @@ const DHCPTestContent = `lease {
   option bootfile-name "test.cfg";
   option dhcp-message-type 5;
   option dhcp-server-identifier 10.127.127.2;
-  renew 1 2022/08/15 19:16:40;
-  rebind 1 2022/08/15 19:20:50;
-  expire 1 2022/08/15 19:22:05;
+  renew 1 2099/08/15 19:16:40;
+  rebind 1 2099/08/15 19:20:50;
+  expire 1 2099/08/15 19:22:05;
 }`
 
 //nolint:funlen
@@ -127,7 +135,7 @@ func TestAgent_discoverBootstrapURLs(t *testing.T) {
 				InputJSONContent:         tt.fields.InputJSONContent,
 				DhcpLeaseFile:            tt.fields.DhcpLeasesFile,
 			}
-			if err := a.discoverBootstrapURLs(); (err != nil) != tt.wantErr {
+			if err := a.discoverBootstrapURLs(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("runDaemon() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -166,6 +174,190 @@ func deleteTempTestFile(file string) {
 	}
 }
 
+const DHCPTestContentMultipleLeases = `lease {
+  interface "eth0";
+  fixed-address 10.127.127.100;
+  option sztp-redirect-urls "https://first/eth0";
+  renew 1 2022/08/15 19:16:40;
+}
+lease {
+  interface "eth1";
+  fixed-address 10.127.128.100;
+  option sztp-redirect-urls "https://second/eth1";
+  renew 1 2022/08/15 19:17:40;
+}
+lease {
+  interface "eth0";
+  fixed-address 10.127.127.100;
+  option sztp-redirect-urls "https://third/eth0";
+  renew 1 2022/08/15 19:18:40;
+}
+lease {
+  interface "eth0";
+  fixed-address 10.127.127.100;
+  option sztp-redirect-urls "https://first/eth0";
+  renew 1 2022/08/15 19:19:40;
+}`
+
+const DHCP6TestContent = `default-duid "\000\001\000\001,\271\023\013\002B\254\021\000\002";
+lease6 {
+  interface "eth2";
+  ia-na 1a:2b:3c:4d {
+    starts 4102444800;
+    renew 1800;
+    rebind 2880;
+    iaaddr 2001:db8::10 {
+      starts 4102444800;
+      preferred-life 3600;
+      max-life 7200;
+    }
+  }
+  option dhcp6.sztp-redirect-urls 0:1a:68:74:74:70:73:3a:2f:2f:5b:32:30:30:31:3a:64:62:38:3a:3a:31:5d:2f:65:74:68:32;
+}`
+
+func TestAgent_discoverBootstrapURLsOrder(t *testing.T) {
+	dir := t.TempDir()
+	leaseFile := filepath.Join(dir, "dhclient.leases")
+	if err := os.WriteFile(leaseFile, []byte(DHCPTestContentMultipleLeases), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	lease6File := filepath.Join(dir, "dhclient6.leases")
+	if err := os.WriteFile(lease6File, []byte(DHCP6TestContent), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	emptyLeaseFile := filepath.Join(dir, "empty.leases")
+	if err := os.WriteFile(emptyLeaseFile, []byte("lease {\n  interface \"eth0\";\n}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name              string
+		leaseFile         string
+		lease6File        string
+		interfacePriority []string
+		want              []string
+		wantErr           bool
+	}{
+		{
+			name:      "most recent lease first without duplicates",
+			leaseFile: leaseFile,
+			want:      []string{"https://first/eth0", "https://third/eth0", "https://second/eth1"},
+		},
+		{
+			name:              "prioritized interface first",
+			leaseFile:         leaseFile,
+			interfacePriority: []string{"eth1"},
+			want:              []string{"https://second/eth1", "https://first/eth0", "https://third/eth0"},
+		},
+		{
+			name:              "DHCPv6 URLs merged with the DHCPv4 ones",
+			leaseFile:         leaseFile,
+			lease6File:        lease6File,
+			interfacePriority: []string{"eth2"},
+			want:              []string{"https://[2001:db8::1]/eth2", "https://first/eth0", "https://third/eth0", "https://second/eth1"},
+		},
+		{
+			name:       "DHCPv6 lease file only",
+			lease6File: lease6File,
+			want:       []string{"https://[2001:db8::1]/eth2"},
+		},
+		{
+			name:      "no bootstrap URL in the lease file",
+			leaseFile: emptyLeaseFile,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{
+				DhcpLeaseFile:         tt.leaseFile,
+				Dhcp6LeaseFile:        tt.lease6File,
+				DhcpInterfacePriority: tt.interfacePriority,
+				StatusFilePath:        filepath.Join(dir, "status.json"),
+				ResultFilePath:        filepath.Join(dir, "result.json"),
+			}
+			err := a.discoverBootstrapURLs(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("discoverBootstrapURLs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(a.GetBootstrapURLs(), tt.want) {
+				t.Errorf("discoverBootstrapURLs() got = %v, want %v", a.GetBootstrapURLs(), tt.want)
+			}
+			if a.GetBootstrapURL() != tt.want[0] {
+				t.Errorf("discoverBootstrapURLs() bootstrap URL = %v, want %v", a.GetBootstrapURL(), tt.want[0])
+			}
+			status, err := a.getCurrStatus()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make([]DiscoveredBootstrapURL, 0, len(tt.want))
+			for _, u := range tt.want {
+				want = append(want, DiscoveredBootstrapURL{URL: u, Source: "dhcp-lease-file"})
+			}
+			if !reflect.DeepEqual(status.BootstrapURLs, want) {
+				t.Errorf("status bootstrap-urls = %v, want %v", status.BootstrapURLs, want)
+			}
+		})
+	}
+}
+
+func TestAgent_doRequestBootstrapServersOnboardingInfo(t *testing.T) {
+	onboarding := BootstrapServerPostOutput{}
+	onboarding.IetfSztpBootstrapServerOutput.ConveyedInformation = base64.StdEncoding.EncodeToString(
+		newTestContentInfo(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation)))
+	onboardingOutput, _ := json.Marshal(onboarding)
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(onboardingOutput)
+	}))
+	defer working.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	tests := []struct {
+		name             string
+		urls             []string
+		wantErr          bool
+		wantBootstrapURL string
+	}{
+		{
+			name:             "fall back to the next bootstrap URL",
+			urls:             []string{"http://127.0.0.1:0/unreachable", failing.URL, working.URL},
+			wantBootstrapURL: working.URL,
+		},
+		{
+			name:    "all bootstrap URLs fail",
+			urls:    []string{"http://127.0.0.1:0/unreachable", failing.URL},
+			wantErr: true,
+		},
+		{
+			name:    "no bootstrap URL",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a := &Agent{
+				BootstrapURLs:  tt.urls,
+				HttpClient:     &http.Client{},
+				StatusFilePath: filepath.Join(dir, "status.json"),
+				ResultFilePath: filepath.Join(dir, "result.json"),
+			}
+			err := a.doRequestBootstrapServersOnboardingInfo(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("doRequestBootstrapServersOnboardingInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && a.GetBootstrapURL() != tt.wantBootstrapURL {
+				t.Errorf("doRequestBootstrapServersOnboardingInfo() bootstrap URL = %v, want %v", a.GetBootstrapURL(), tt.wantBootstrapURL)
+			}
+		})
+	}
+}
+
 func TestAgent_doHandleBootstrapRedirect(t *testing.T) {
 	type fields struct {
 		InputBootstrapURL           string
@@ -236,19 +428,189 @@ func TestAgent_doHandleBootstrapRedirect(t *testing.T) {
 				BootstrapURL:                tt.fields.InputBootstrapURL,
 				BootstrapServerRedirectInfo: tt.fields.BootstrapServerRedirectInfo,
 			}
-			if err := a.doHandleBootstrapRedirect(); (err != nil) != tt.wantErr {
+			if err := a.doHandleBootstrapRedirect(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("doHandleBootstrapRedirect() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
+//nolint:funlen
+func TestAgent_doHandleBootstrapRedirectFallback(t *testing.T) {
+	onboarding := BootstrapServerPostOutput{}
+	onboarding.IetfSztpBootstrapServerOutput.ConveyedInformation = base64.StdEncoding.EncodeToString(
+		newTestContentInfo(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation)))
+	onboardingOutput, _ := json.Marshal(onboarding)
+	restconfError := BootstrapServerErrorOutput{}
+	restconfError.IetfRestconfErrors.Error = append(restconfError.IetfRestconfErrors.Error, struct {
+		ErrorType    string `json:"error-type"`
+		ErrorTag     string `json:"error-tag"`
+		ErrorMessage string `json:"error-message"`
+	}{ErrorType: "application", ErrorTag: "data-missing", ErrorMessage: "unknown device"})
+	restconfOutput, _ := json.Marshal(restconfError)
+
+	working := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(onboardingOutput)
+	}))
+	defer working.Close()
+	failing := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(restconfOutput)
+	}))
+	defer failing.Close()
+	// A listener closed right away gives a port refusing connections
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = closed.Close()
+
+	type server struct {
+		Address     string `json:"address"`
+		Port        int    `json:"port"`
+		TrustAnchor string `json:"trust-anchor"`
+	}
+	serverOf := func(addr string) server {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		portNumber, err := strconv.Atoi(port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server{Address: host, Port: portNumber}
+	}
+	const bootstrapURL = "http://bootstrap.example.com/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data"
+
+	tests := []struct {
+		name             string
+		servers          []server
+		withoutURL       bool
+		wantErr          bool
+		wantBootstrapURL string
+	}{
+		{
+			name:             "first bootstrap server succeeds",
+			servers:          []server{serverOf(working.Listener.Addr().String()), serverOf(failing.Listener.Addr().String())},
+			wantBootstrapURL: working.URL + "/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data",
+		},
+		{
+			name:             "redirected by bootstrapping data without a bootstrap URL",
+			servers:          []server{serverOf(working.Listener.Addr().String())},
+			withoutURL:       true,
+			wantBootstrapURL: working.URL + "/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data",
+		},
+		{
+			name: "fall back after connection, RESTCONF and address errors",
+			servers: []server{
+				serverOf(closed.Addr().String()),
+				serverOf(failing.Listener.Addr().String()),
+				{Address: "", Port: 0},
+				serverOf(working.Listener.Addr().String()),
+			},
+			wantBootstrapURL: working.URL + "/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data",
+		},
+		{
+			name:             "all bootstrap servers fail",
+			servers:          []server{serverOf(closed.Addr().String()), serverOf(failing.Listener.Addr().String())},
+			wantErr:          true,
+			wantBootstrapURL: bootstrapURL,
+		},
+		{
+			name:             "no bootstrap server",
+			servers:          []server{},
+			wantErr:          true,
+			wantBootstrapURL: bootstrapURL,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a := &Agent{
+				BootstrapURL:   bootstrapURL,
+				HttpClient:     working.Client(),
+				StatusFilePath: filepath.Join(dir, "status.json"),
+				ResultFilePath: filepath.Join(dir, "result.json"),
+			}
+			if tt.withoutURL {
+				a.SetBootstrapURL("")
+			}
+			a.BootstrapServerRedirectInfo.IetfSztpConveyedInfoRedirectInformation.BootstrapServer = make([]struct {
+				Address     string `json:"address"`
+				Port        int    `json:"port"`
+				TrustAnchor string `json:"trust-anchor"`
+			}, len(tt.servers))
+			for i, s := range tt.servers {
+				a.BootstrapServerRedirectInfo.IetfSztpConveyedInfoRedirectInformation.BootstrapServer[i] = s
+			}
+			err := a.doHandleBootstrapRedirect(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("doHandleBootstrapRedirect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if a.GetBootstrapURL() != tt.wantBootstrapURL {
+				t.Errorf("doHandleBootstrapRedirect() bootstrap URL = %v, want %v", a.GetBootstrapURL(), tt.wantBootstrapURL)
+			}
+			if tt.wantErr {
+				return
+			}
+			status, err := a.getCurrStatus()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.BootstrapServer != tt.wantBootstrapURL {
+				t.Errorf("status bootstrap-server = %v, want %v", status.BootstrapServer, tt.wantBootstrapURL)
+			}
+		})
+	}
+}
+
+func TestAgent_requestBootstrappingDataResetsRedirect(t *testing.T) {
+	onboarding := BootstrapServerPostOutput{}
+	onboarding.IetfSztpBootstrapServerOutput.ConveyedInformation = base64.StdEncoding.EncodeToString(
+		newTestContentInfo(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation)))
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(onboarding)
+	}))
+	defer svr.Close()
+	rootCert, _ := newTestCertificate(t, "root", nil, nil)
+	dir := t.TempDir()
+	client := &http.Client{}
+	a := &Agent{
+		InputBootstrapURL: svr.URL + "/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data",
+		HttpClient:        client,
+		StatusFilePath:    filepath.Join(dir, "status.json"),
+		ResultFilePath:    filepath.Join(dir, "result.json"),
+	}
+	// A previous bootstrap sequence was redirected
+	if err := a.useTrustAnchor(newTestCertificateBundle(t, rootCert)); err != nil {
+		t.Fatal(err)
+	}
+	a.BootstrapServerRedirectInfo.IetfSztpConveyedInfoRedirectInformation.BootstrapServer = []struct {
+		Address     string `json:"address"`
+		Port        int    `json:"port"`
+		TrustAnchor string `json:"trust-anchor"`
+	}{{Address: "redirect.example.com"}}
+
+	if err := a.requestBootstrappingData(context.Background()); err != nil {
+		t.Fatalf("requestBootstrappingData() error = %v", err)
+	}
+	if a.HttpClient != client || a.GetRedirectTrustAnchor() != "" {
+		t.Errorf("requestBootstrappingData() kept the redirect HTTP client")
+	}
+	if !reflect.ValueOf(a.BootstrapServerRedirectInfo).IsZero() || a.GetBootstrapURL() != a.InputBootstrapURL {
+		t.Errorf("requestBootstrappingData() followed the previous redirect to %s", a.GetBootstrapURL())
+	}
+}
+
 //nolint:funlen
 func TestAgent_doReqBootstrap(t *testing.T) {
 	var output []byte
 	expectedOnboarding := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "MIIDfwYLKoZIhvcNAQkQASugggNuBIIDansKICAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86b25ib2FyZGluZy1pbmZvcm1hdGlvbiI6IHsKICAgICJib290LWltYWdlIjogewogICAgICAiZG93bmxvYWQtdXJpIjogWwogICAgICAgICJodHRwOi8vd2ViOjgwODIvdmFyL2xpYi9taXNjL215LWJvb3QtaW1hZ2UuaW1nIiwKICAgICAgICAiZnRwOi8vd2ViOjMwODIvdmFyL2xpYi9taXNjL215LWJvb3QtaW1hZ2UuaW1nIgogICAgICBdLAogICAgICAiaW1hZ2UtdmVyaWZpY2F0aW9uIjogWwogICAgICAgIHsKICAgICAgICAgICJoYXNoLWFsZ29yaXRobSI6ICJpZXRmLXN6dHAtY29udmV5ZWQtaW5mbzpzaGEtMjU2IiwKICAgICAgICAgICJoYXNoLXZhbHVlIjogIjdiOmNhOmU2OmFjOjIzOjA2OmQ4Ojc5OjA2OjhjOmFjOjAzOjgwOmUyOjE2OjQ0OjdlOjQwOjZhOjY1OmZhOmQ0OjY5OjYxOjZlOjA1OmNlOmY1Ojg3OmRjOjJiOjk3IgogICAgICAgIH0KICAgICAgXQogICAgfSwKICAgICJwcmUtY29uZmlndXJhdGlvbi1zY3JpcHQiOiAiSXlFdlltbHVMMkpoYzJnS1pXTm9ieUFpYVc1emFXUmxJSFJvWlNCd2NtVXRZMjl1Wm1sbmRYSmhkR2x2YmkxelkzSnBjSFF1TGk0aUNnPT0iLAogICAgImNvbmZpZ3VyYXRpb24taGFuZGxpbmciOiAibWVyZ2UiLAogICAgImNvbmZpZ3VyYXRpb24iOiAiUEhSdmNDQjRiV3h1Y3owaWFIUjBjSE02TDJWNFlXMXdiR1V1WTI5dEwyTnZibVpwWnlJK0NpQWdQR0Z1ZVMxNGJXd3RZMjl1ZEdWdWRDMXZhMkY1THo0S1BDOTBiM0ErQ2c9PSIsCiAgICAicG9zdC1jb25maWd1cmF0aW9uLXNjcmlwdCI6ICJJeUV2WW1sdUwySmhjMmdLWldOb2J5QWlhVzV6YVdSbElIUm9aU0J3YjNOMExXTnZibVpwWjNWeVlYUnBiMjR0YzJOeWFYQjBMaTR1SWdvPSIKICB9Cn0=",
 		},
@@ -256,6 +618,8 @@ func TestAgent_doReqBootstrap(t *testing.T) {
 	expectedRedirect := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "MIIHlgYLKoZIhvcNAQkQASugggeFBIIHgXsKICAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86cmVkaXJlY3QtaW5mb3JtYXRpb24iOiB7CiAgICAiYm9vdHN0cmFwLXNlcnZlciI6IFsKICAgICAgewogICAgICAgICJhZGRyZXNzIjogIjEyNy4wLjAuMSIsCiAgICAgICAgInBvcnQiOiAzODQ0MywKICAgICAgICAidHJ1c3QtYW5jaG9yIjogIk1JSUZEd1lKS29aSWh2Y05BUWNDb0lJRkFEQ0NCUHdDQVFFeEFEQUxCZ2txaGtpRzl3MEJCd0dnZ2dUa01JSUNXVENDQWYrZ0F3SUJBZ0lCQVRBS0JnZ3Foa2pPUFFRREFqQjFNUXN3Q1FZRFZRUUdFd0pZV0RFZE1Cc0dBMVVFQ0F3VVRYa2dVM1JoZEdVZ2IzSWdVSEp2ZG1sdVkyVXhHREFXQmdOVkJBb01EMDE1SUU5eVoyRnVhWHBoZEdsdmJqRVFNQTRHQTFVRUN3d0hUWGtnVlc1cGRERWJNQmtHQTFVRUF3d1NjMkpwTDNObGNuWmxjaTl5YjI5MExXTmhNQ0FYRFRJeU1UQXhOekV5TVRZeE5Gb1lEems1T1RreE1qTXhNak0xT1RVNVdqQjFNUXN3Q1FZRFZRUUdFd0pZV0RFZE1Cc0dBMVVFQ0F3VVRYa2dVM1JoZEdVZ2IzSWdVSEp2ZG1sdVkyVXhHREFXQmdOVkJBb01EMDE1SUU5eVoyRnVhWHBoZEdsdmJqRVFNQTRHQTFVRUN3d0hUWGtnVlc1cGRERWJNQmtHQTFVRUF3d1NjMkpwTDNObGNuWmxjaTl5YjI5MExXTmhNRmt3RXdZSEtvWkl6ajBDQVFZSUtvWkl6ajBEQVFjRFFnQUVQOFhDSEJzYkQwS3lQWk9DdjI3clI5cDhTd2FDK3R0U1Q1cGpKMmtOUUF2UFVyWXZKT2RGWkJCd20xTmtLU3ducjZQdmFNdGgxdi92VmxRV0U3b0dBNk4rTUh3d0hRWURWUjBPQkJZRUZNNTBPVmp2WW5Ed1NTZ3dNNnB1bEN4aXhJQ1hNQXdHQTFVZEV3UUZNQU1CQWY4d0RnWURWUjBQQVFIL0JBUURBZ0VHTUQwR0ExVWRId1EyTURRd01xQXdvQzZHTEdoMGRIQTZMeTlqY213dVpYaGhiWEJzWlM1amIyMC9ZMkU5YzJKcE9uTmxjblpsY2pweWIyOTBMV05oTUFvR0NDcUdTTTQ5QkFNQ0EwZ0FNRVVDSUJHRHdFcXBVaFNaQUs0bjh1K1BhUUZyU2VHa2QvQkJaT3F6cXZBYTlkNjBBaUVBcEVYdWRSY0xwRkV5SHBOeldrMlFoV1IycDNrMCtuaHRGMHpROFZ1VTdHY3dnZ0tETUlJQ0tLQURBZ0VDQWdFQ01Bb0dDQ3FHU000OUJBTUNNSFV4Q3pBSkJnTlZCQVlUQWxoWU1SMHdHd1lEVlFRSURCUk5lU0JUZEdGMFpTQnZjaUJRY205MmFXNWpaVEVZTUJZR0ExVUVDZ3dQVFhrZ1QzSm5ZVzVwZW1GMGFXOXVNUkF3RGdZRFZRUUxEQWROZVNCVmJtbDBNUnN3R1FZRFZRUUREQkp6WW1rdmMyVnlkbVZ5TDNKdmIzUXRZMkV3SUJjTk1qSXhNREUzTVRJeE5qRTBXaGdQT1RrNU9URXlNekV5TXpVNU5UbGFNSHN4Q3pBSkJnTlZCQVlUQWxoWU1SMHdHd1lEVlFRSURCUk5lU0JUZEdGMFpTQnZjaUJRY205MmFXNWpaVEVZTUJZR0ExVUVDZ3dQVFhrZ1QzSm5ZVzVwZW1GMGFXOXVNUkF3RGdZRFZRUUxEQWROZVNCVmJtbDBNU0V3SHdZRFZRUUREQmh6WW1rdmMyVnlkbVZ5TDJsdWRHVnliV1ZrYVdGMFpURXdXVEFUQmdjcWhrak9QUUlCQmdncWhrak9QUU1CQndOQ0FBU0xYQVBGNFo5Skw4OTQxbllRU3VoWFMrWTJxbjlPdGp5cG9leXJPVkl4ZDc1dngyN1dYRWtWcmk3Q2NnQURlenFpK2RvZjRLd2pzRWljdDJCNlp0aDdvNEdnTUlHZE1CMEdBMVVkRGdRV0JCUUQ3L1FEazhrL2hiWHltY28zRElBdWV0dnV4ekFmQmdOVkhTTUVHREFXZ0JUT2REbFk3Mkp3OEVrb01ET3FicFFzWXNTQWx6QU1CZ05WSFJNRUJUQURBUUgvTUE0R0ExVWREd0VCL3dRRUF3SUJCakE5QmdOVkhSOEVOakEwTURLZ01LQXVoaXhvZEhSd09pOHZZM0pzTG1WNFlXMXdiR1V1WTI5dFAyTmhQWE5pYVRwelpYSjJaWEk2Y205dmRDMWpZVEFLQmdncWhrak9QUVFEQWdOSkFEQkdBaUVBa0lKOG9HMjhsWmhWejNGWGRsNFgwWExwZlY3T3k5ZFdlTGVHMUhtRmwzTUNJUUNURFZRQ3lQTXNhOXNLdFBzcGNOQXlYazBOUVIrRVdpQjBzcldrVzYyd0J6RUEiCiAgICAgIH0KICAgIF0KICB9Cn0=",
 		},
@@ -263,6 +627,8 @@ func TestAgent_doReqBootstrap(t *testing.T) {
 	expectedFailedBase64 := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "{wrongBASE64}",
 		},
@@ -422,7 +788,7 @@ func TestAgent_doReqBootstrap(t *testing.T) {
 				DhcpLeaseFile:            tt.fields.DhcpLeaseFile,
 				HttpClient:               &http.Client{},
 			}
-			if err := a.doRequestBootstrapServerOnboardingInfo(); (err != nil) != tt.wantErr {
+			if err := a.doRequestBootstrapServerOnboardingInfo(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("doRequestBootstrapServer() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -449,6 +815,8 @@ func TestAgent_performBootstrapSequence(t *testing.T) {
 	expectedOnboarding := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "MIIDYwYLKoZIhvcNAQkQASugggNSBIIDTnsKICAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86b25ib2FyZGluZy1pbmZvcm1hdGlvbiI6IHsKICAgICJib290LWltYWdlIjogewogICAgICAiZG93bmxvYWQtdXJpIjogWwogICAgICAgICJodHRwczovL3dlYjo0NDMvdGVzdC5pbWciLAogICAgICAgICJmdHBzOi8vd2ViOjk5MC90ZXN0LmltZyIKICAgICAgXSwKICAgICAgImltYWdlLXZlcmlmaWNhdGlvbiI6IFsKICAgICAgICB7CiAgICAgICAgICAiaGFzaC1hbGdvcml0aG0iOiAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86c2hhLTI1NiIsCiAgICAgICAgICAiaGFzaC12YWx1ZSI6ICJlMzpiMDpjNDo0Mjo5ODpmYzoxYzoxNDo5YTpmYjpmNDpjODo5OTo2ZjpiOToyNDoyNzphZTo0MTplNDo2NDo5Yjo5Mzo0YzphNDo5NTo5OToxYjo3ODo1MjpiODo1NSIKICAgICAgICB9CiAgICAgIF0KICAgIH0sCiAgICAicHJlLWNvbmZpZ3VyYXRpb24tc2NyaXB0IjogIkl5RXZZbWx1TDJKaGMyZ0taV05vYnlBaWFXNXphV1JsSUhSb1pTQjBhR2x5WkMxd2NtVXRZMjl1Wm1sbmRYSmhkR2x2YmkxelkzSnBjSFF1TGk0aUNnPT0iLAogICAgImNvbmZpZ3VyYXRpb24taGFuZGxpbmciOiAibWVyZ2UiLAogICAgImNvbmZpZ3VyYXRpb24iOiAiUEhSdmNDQjRiV3h1Y3owaWFIUjBjSE02TDJWNFlXMXdiR1V1WTI5dEwyTnZibVpwWnlJK0NpQWdQR0Z1ZVMxNGJXd3RZMjl1ZEdWdWRDMXZhMkY1THo0S1BDOTBiM0ErQ2c9PSIsCiAgICAicG9zdC1jb25maWd1cmF0aW9uLXNjcmlwdCI6ICJJeUV2WW1sdUwySmhjMmdLWldOb2J5QWlhVzV6YVdSbElIUm9aU0IwYUdseVpDMXdiM04wTFdOdmJtWnBaM1Z5WVhScGIyNHRjMk55YVhCMExpNHVJZ289IgogIH0KfQ==",
 		},
@@ -456,6 +824,8 @@ func TestAgent_performBootstrapSequence(t *testing.T) {
 	expectedRedirect := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "MIIDfQYLKoZIhvcNAQkQASugggNsBIIDaHsKICAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86b25ib2FyZGluZy1pbmZvcm1hdGlvbiI6IHsKICAgICJib290LWltYWdlIjogewogICAgICAiZG93bmxvYWQtdXJpIjogWwogICAgICAgICJodHRwczovL3dlYjo0NDMvc2Vjb25kLWJvb3QtaW1hZ2UuaW1nIiwKICAgICAgICAiZnRwczovL3dlYjo5OTAvc2Vjb25kLWJvb3QtaW1hZ2UuaW1nIgogICAgICBdLAogICAgICAiaW1hZ2UtdmVyaWZpY2F0aW9uIjogWwogICAgICAgIHsKICAgICAgICAgICJoYXNoLWFsZ29yaXRobSI6ICJpZXRmLXN6dHAtY29udmV5ZWQtaW5mbzpzaGEtMjU2IiwKICAgICAgICAgICJoYXNoLXZhbHVlIjogIjdiOmNhOmU2OmFjOjIzOjA2OmQ4Ojc5OjA2OjhjOmFjOjAzOjgwOmUyOjE2OjQ0OjdlOjQwOjZhOjY1OmZhOmQ0OjY5OjYxOjZlOjA1OmNlOmY1Ojg3OmRjOjJiOjk3IgogICAgICAgIH0KICAgICAgXQogICAgfSwKICAgICJwcmUtY29uZmlndXJhdGlvbi1zY3JpcHQiOiAiSXlFdlltbHVMMkpoYzJnS1pXTm9ieUFpYVc1emFXUmxJSFJvWlNCelpXTnZibVF0Y0hKbExXTnZibVpwWjNWeVlYUnBiMjR0YzJOeWFYQjBMaTR1SWdvPSIsCiAgICAiY29uZmlndXJhdGlvbi1oYW5kbGluZyI6ICJtZXJnZSIsCiAgICAiY29uZmlndXJhdGlvbiI6ICJQSFJ2Y0NCNGJXeHVjejBpYUhSMGNITTZMMlY0WVcxd2JHVXVZMjl0TDJOdmJtWnBaeUkrQ2lBZ1BHRnVlUzE0Yld3dFkyOXVkR1Z1ZEMxdmEyRjVMejRLUEM5MGIzQStDZz09IiwKICAgICJwb3N0LWNvbmZpZ3VyYXRpb24tc2NyaXB0IjogIkl5RXZZbWx1TDJKaGMyZ0taV05vYnlBaWFXNXphV1JsSUhSb1pTQnpaV052Ym1RdGNHOXpkQzFqYjI1bWFXZDFjbUYwYVc5dUxYTmpjbWx3ZEM0dUxpSUsiCiAgfQp9",
 		},
@@ -463,6 +833,8 @@ func TestAgent_performBootstrapSequence(t *testing.T) {
 	expectedFailedBase64 := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "{wrongBASE64}",
 		},
@@ -470,6 +842,8 @@ func TestAgent_performBootstrapSequence(t *testing.T) {
 	expectedFailedImage := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "MIIDfwYLKoZIhvcNAQkQASugggNuBIIDansKICAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86b25ib2FyZGluZy1pbmZvcm1hdGlvbiI6IHsKICAgICJib290LWltYWdlIjogewogICAgICAiZG93bmxvYWQtdXJpIjogWwogICAgICAgICJodHRwOi8vd2ViOjgwODIvdmFyL2xpYi9taXNjL215LWJvb3QtaW1hZ2UuaW1nIiwKICAgICAgICAiZnRwOi8vd2ViOjMwODIvdmFyL2xpYi9taXNjL215LWJvb3QtaW1hZ2UuaW1nIgogICAgICBdLAogICAgICAiaW1hZ2UtdmVyaWZpY2F0aW9uIjogWwogICAgICAgIHsKICAgICAgICAgICJoYXNoLWFsZ29yaXRobSI6ICJpZXRmLXN6dHAtY29udmV5ZWQtaW5mbzpzaGEtMjU2IiwKICAgICAgICAgICJoYXNoLXZhbHVlIjogIjdiOmNhOmU2OmFjOjIzOjA2OmQ4Ojc5OjA2OjhjOmFjOjAzOjgwOmUyOjE2OjQ0OjdlOjQwOjZhOjY1OmZhOmQ0OjY5OjYxOjZlOjA1OmNlOmY1Ojg3OmRjOjJiOjk3IgogICAgICAgIH0KICAgICAgXQogICAgfSwKICAgICJwcmUtY29uZmlndXJhdGlvbi1zY3JpcHQiOiAiSXlFdlltbHVMMkpoYzJnS1pXTm9ieUFpYVc1emFXUmxJSFJvWlNCd2NtVXRZMjl1Wm1sbmRYSmhkR2x2YmkxelkzSnBjSFF1TGk0aUNnPT0iLAogICAgImNvbmZpZ3VyYXRpb24taGFuZGxpbmciOiAibWVyZ2UiLAogICAgImNvbmZpZ3VyYXRpb24iOiAiUEhSdmNDQjRiV3h1Y3owaWFIUjBjSE02TDJWNFlXMXdiR1V1WTI5dEwyTnZibVpwWnlJK0NpQWdQR0Z1ZVMxNGJXd3RZMjl1ZEdWdWRDMXZhMkY1THo0S1BDOTBiM0ErQ2c9PSIsCiAgICAicG9zdC1jb25maWd1cmF0aW9uLXNjcmlwdCI6ICJJeUV2WW1sdUwySmhjMmdLWldOb2J5QWlhVzV6YVdSbElIUm9aU0J3YjNOMExXTnZibVpwWjNWeVlYUnBiMjR0YzJOeWFYQjBMaTR1SWdvPSIKICB9Cn0=",
 		},
@@ -477,6 +851,8 @@ func TestAgent_performBootstrapSequence(t *testing.T) {
 	expectedFailedPreScript := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "MIIDbwYLKoZIhvcNAQkQASugggNeBIIDWnsKICAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86b25ib2FyZGluZy1pbmZvcm1hdGlvbiI6IHsKICAgICJib290LWltYWdlIjogewogICAgICAiZG93bmxvYWQtdXJpIjogWwogICAgICAgICJodHRwczovL3dlYjo0NDMvdGVzdC5pbWciLAogICAgICAgICJmdHBzOi8vd2ViOjk5MC90ZXN0LmltZyIKICAgICAgXSwKICAgICAgImltYWdlLXZlcmlmaWNhdGlvbiI6IFsKICAgICAgICB7CiAgICAgICAgICAiaGFzaC1hbGdvcml0aG0iOiAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86c2hhLTI1NiIsCiAgICAgICAgICAiaGFzaC12YWx1ZSI6ICJlMzpiMDpjNDo0Mjo5ODpmYzoxYzoxNDo5YTpmYjpmNDpjODo5OTo2ZjpiOToyNDoyNzphZTo0MTplNDo2NDo5Yjo5Mzo0YzphNDo5NTo5OToxYjo3ODo1MjpiODo1NSIKICAgICAgICB9CiAgICAgIF0KICAgIH0sCiAgICAicHJlLWNvbmZpZ3VyYXRpb24tc2NyaXB0IjogIkl5RXZZbWx1TDJKaGMyZ0taV05vYnlBaWFXNXphV1JsSUhSb1pTQjBhR2x5WkMxd2NtVXRZMjl1Wm1sbmRYSmhkR2x2YmkxelkzSnBjSFF1TGk0aUNtVnljbTl5IiwKICAgICJjb25maWd1cmF0aW9uLWhhbmRsaW5nIjogIm1lcmdlIiwKICAgICJjb25maWd1cmF0aW9uIjogIlBIUnZjQ0I0Yld4dWN6MGlhSFIwY0hNNkwyVjRZVzF3YkdVdVkyOXRMMk52Ym1acFp5SStDaUFnUEdGdWVTMTRiV3d0WTI5dWRHVnVkQzF2YTJGNUx6NEtQQzkwYjNBK0NnPT0iLAogICAgInBvc3QtY29uZmlndXJhdGlvbi1zY3JpcHQiOiAiSXlFdlltbHVMMkpoYzJnS1pXTm9ieUFpYVc1emFXUmxJSFJvWlNCMGFHbHlaQzF3YjNOMExXTnZibVpwWjNWeVlYUnBiMjR0YzJOeWFYQjBMaTR1SWdwbGNuSnZjZz09IgogIH0KfQ==",
 		},
@@ -484,6 +860,8 @@ func TestAgent_performBootstrapSequence(t *testing.T) {
 	expectedFailedPostScript := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "MIIDawYLKoZIhvcNAQkQASugggNaBIIDVnsKICAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86b25ib2FyZGluZy1pbmZvcm1hdGlvbiI6IHsKICAgICJib290LWltYWdlIjogewogICAgICAiZG93bmxvYWQtdXJpIjogWwogICAgICAgICJodHRwczovL3dlYjo0NDMvdGVzdC5pbWciLAogICAgICAgICJmdHBzOi8vd2ViOjk5MC90ZXN0LmltZyIKICAgICAgXSwKICAgICAgImltYWdlLXZlcmlmaWNhdGlvbiI6IFsKICAgICAgICB7CiAgICAgICAgICAiaGFzaC1hbGdvcml0aG0iOiAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86c2hhLTI1NiIsCiAgICAgICAgICAiaGFzaC12YWx1ZSI6ICJlMzpiMDpjNDo0Mjo5ODpmYzoxYzoxNDo5YTpmYjpmNDpjODo5OTo2ZjpiOToyNDoyNzphZTo0MTplNDo2NDo5Yjo5Mzo0YzphNDo5NTo5OToxYjo3ODo1MjpiODo1NSIKICAgICAgICB9CiAgICAgIF0KICAgIH0sCiAgICAicHJlLWNvbmZpZ3VyYXRpb24tc2NyaXB0IjogIkl5RXZZbWx1TDJKaGMyZ0taV05vYnlBaWFXNXphV1JsSUhSb1pTQjBhR2x5WkMxd2NtVXRZMjl1Wm1sbmRYSmhkR2x2YmkxelkzSnBjSFF1TGk0aUNnPT0iLAogICAgImNvbmZpZ3VyYXRpb24taGFuZGxpbmciOiAibWVyZ2UiLAogICAgImNvbmZpZ3VyYXRpb24iOiAiUEhSdmNDQjRiV3h1Y3owaWFIUjBjSE02TDJWNFlXMXdiR1V1WTI5dEwyTnZibVpwWnlJK0NpQWdQR0Z1ZVMxNGJXd3RZMjl1ZEdWdWRDMXZhMkY1THo0S1BDOTBiM0ErQ2c9PSIsCiAgICAicG9zdC1jb25maWd1cmF0aW9uLXNjcmlwdCI6ICJJeUV2WW1sdUwySmhjMmdLWldOb2J5QWlhVzV6YVdSbElIUm9aU0IwYUdseVpDMXdiM04wTFdOdmJtWnBaM1Z5WVhScGIyNHRjMk55YVhCMExpNHVJZ3BsY25KdmNnbz0iCiAgfQp9",
 		},
@@ -717,7 +1095,7 @@ func TestAgent_performBootstrapSequence(t *testing.T) {
 				BootstrapServerRedirectInfo:   tt.fields.BootstrapServerRedirectInfo,
 				HttpClient:                    &http.Client{},
 			}
-			if err := a.performBootstrapSequence(); (err != nil) != tt.wantErr {
+			if err := a.performBootstrapSequence(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("RunCommand() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -746,6 +1124,8 @@ func TestAgent_DaemonCommand(t *testing.T) {
 	expectedOnboarding := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "MIIDYwYLKoZIhvcNAQkQASugggNSBIIDTnsKICAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86b25ib2FyZGluZy1pbmZvcm1hdGlvbiI6IHsKICAgICJib290LWltYWdlIjogewogICAgICAiZG93bmxvYWQtdXJpIjogWwogICAgICAgICJodHRwczovL3dlYjo0NDMvdGVzdC5pbWciLAogICAgICAgICJmdHBzOi8vd2ViOjk5MC90ZXN0LmltZyIKICAgICAgXSwKICAgICAgImltYWdlLXZlcmlmaWNhdGlvbiI6IFsKICAgICAgICB7CiAgICAgICAgICAiaGFzaC1hbGdvcml0aG0iOiAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86c2hhLTI1NiIsCiAgICAgICAgICAiaGFzaC12YWx1ZSI6ICJlMzpiMDpjNDo0Mjo5ODpmYzoxYzoxNDo5YTpmYjpmNDpjODo5OTo2ZjpiOToyNDoyNzphZTo0MTplNDo2NDo5Yjo5Mzo0YzphNDo5NTo5OToxYjo3ODo1MjpiODo1NSIKICAgICAgICB9CiAgICAgIF0KICAgIH0sCiAgICAicHJlLWNvbmZpZ3VyYXRpb24tc2NyaXB0IjogIkl5RXZZbWx1TDJKaGMyZ0taV05vYnlBaWFXNXphV1JsSUhSb1pTQjBhR2x5WkMxd2NtVXRZMjl1Wm1sbmRYSmhkR2x2YmkxelkzSnBjSFF1TGk0aUNnPT0iLAogICAgImNvbmZpZ3VyYXRpb24taGFuZGxpbmciOiAibWVyZ2UiLAogICAgImNvbmZpZ3VyYXRpb24iOiAiUEhSdmNDQjRiV3h1Y3owaWFIUjBjSE02TDJWNFlXMXdiR1V1WTI5dEwyTnZibVpwWnlJK0NpQWdQR0Z1ZVMxNGJXd3RZMjl1ZEdWdWRDMXZhMkY1THo0S1BDOTBiM0ErQ2c9PSIsCiAgICAicG9zdC1jb25maWd1cmF0aW9uLXNjcmlwdCI6ICJJeUV2WW1sdUwySmhjMmdLWldOb2J5QWlhVzV6YVdSbElIUm9aU0IwYUdseVpDMXdiM04wTFdOdmJtWnBaM1Z5WVhScGIyNHRjMk55YVhCMExpNHVJZ289IgogIH0KfQ==",
 		},
@@ -807,9 +1187,42 @@ func TestAgent_DaemonCommand(t *testing.T) {
 				BootstrapServerRedirectInfo:   tt.fields.BootstrapServerRedirectInfo,
 				HttpClient:                    &http.Client{},
 			}
-			if err := a.RunCommandDaemon(); (err != nil) != tt.wantErr {
+			if err := a.RunCommandDaemon(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("RunCommand() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestAgent_RunCommandDaemonAborted(t *testing.T) {
+	dir := t.TempDir()
+	a := &Agent{
+		StatusFilePath: filepath.Join(dir, "status.json"),
+		ResultFilePath: filepath.Join(dir, "result.json"),
+		SymLinkDir:     filepath.Join(dir, "run"),
+		RetryPolicy:    DefaultRetryPolicy(),
+	}
+	a.SetBootstrapSources([]BootstrapSource{&testBootstrapSource{name: "bmc", err: errors.New("BMC unreachable")}})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// Stopped while waiting for the retry
+		for {
+			if status, err := a.getCurrStatus(); err == nil && status.NextRetry != 0 {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	err := a.RunCommandDaemon(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunCommandDaemon() error = %v, want %v", err, context.Canceled)
+	}
+	status, err := a.getCurrStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Stage != StageAborted || status.NextRetry != 0 || status.IsCompleted.End == 0 {
+		t.Errorf("status = %+v, want aborted", status)
+	}
+}
@@ -0,0 +1,441 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/github/smimesign/ietf-cms/oid"
+	"github.com/github/smimesign/ietf-cms/protocol"
+)
+
+// Object identifiers used by the CMS EnvelopedData content type (RFC 5652, RFC 3560, RFC 5753, RFC 3565)
+var (
+	oidContentTypeEnvelopedData   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidKeyEncryptionRSAOAEP       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 7}
+	oidKeyAgreementECDHSHA256KDF  = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 1}
+	oidKeyAgreementECDHSHA384KDF  = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 2}
+	oidKeyAgreementECDHSHA512KDF  = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 3}
+	oidKeyWrapAES128              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 5}
+	oidKeyWrapAES192              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 25}
+	oidKeyWrapAES256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 45}
+	oidContentEncryptionAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidContentEncryptionAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidContentEncryptionAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// errConveyedInformationDecryption marks the errors raised while decrypting the conveyed information
+var errConveyedInformationDecryption = errors.New("conveyed-information decryption failed")
+
+// envelopedData is the EnvelopedData structure of RFC 5652 section 6.1
+type envelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+	UnprotectedAttrs     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type keyAgreeRecipientInfo struct {
+	Version                int
+	Originator             asn1.RawValue `asn1:"explicit,tag:0"`
+	UKM                    []byte        `asn1:"optional,explicit,tag:1"`
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	RecipientEncryptedKeys []recipientEncryptedKey
+}
+
+type recipientEncryptedKey struct {
+	RID          asn1.RawValue
+	EncryptedKey []byte
+}
+
+type originatorPublicKey struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+type recipientKeyIdentifier struct {
+	SubjectKeyIdentifier []byte
+	Date                 asn1.RawValue `asn1:"optional"`
+	Other                asn1.RawValue `asn1:"optional"`
+}
+
+type rsaOAEPParameters struct {
+	HashFunc pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:0"`
+}
+
+// eccCMSSharedInfo is the ECC-CMS-SharedInfo structure of RFC 5753 section 7.2
+type eccCMSSharedInfo struct {
+	KeyInfo     pkix.AlgorithmIdentifier
+	EntityUInfo []byte `asn1:"optional,explicit,tag:0"`
+	SuppPubInfo []byte `asn1:"explicit,tag:2"`
+}
+
+// decryptConveyedInformation decrypts the conveyed-information when it is an EnvelopedData
+// encrypted for the device certificate. The decrypted content, which may itself be signed,
+// is returned as a ContentInfo so it can be handed to parseConveyedInformation. Conveyed
+// information that is not encrypted is returned as is.
+func (a *Agent) decryptConveyedInformation(conveyedInfo []byte) ([]byte, error) {
+	ci, err := protocol.ParseContentInfo(conveyedInfo)
+	if err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidContentTypeEnvelopedData) {
+		return conveyedInfo, nil
+	}
+	log.Println("[INFO] Decrypting the conveyed-information with the device private key")
+	_ = a.updateAndSaveStatus(StageTypeDecrypting, true, "")
+	contentType, content, err := a.decryptEnvelopedData(ci.Content.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errConveyedInformationDecryption, err)
+	}
+	_ = a.updateAndSaveStatus(StageTypeDecrypting, false, "")
+	if !contentType.Equal(oid.ContentTypeSignedData) {
+		// Only the SignedData content is already DER encoded, data contents are raw octets
+		content, err = asn1.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return asn1.Marshal(protocol.ContentInfo{
+		ContentType: contentType,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: content, IsCompound: true},
+	})
+}
+
+// decryptEnvelopedData returns the type and the decrypted value of the EnvelopedData content
+func (a *Agent) decryptEnvelopedData(der []byte) (asn1.ObjectIdentifier, []byte, error) {
+	var ed envelopedData
+	if rest, err := asn1.Unmarshal(der, &ed); err != nil {
+		return nil, nil, err
+	} else if len(rest) > 0 {
+		return nil, nil, errors.New("trailing data after EnvelopedData")
+	}
+	keyPair, err := tls.LoadX509KeyPair(a.GetDeviceEndEntityCert(), a.GetDevicePrivateKey())
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading device key pair: %w", err)
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	cek, err := decryptContentEncryptionKey(ed.RecipientInfos, cert, keyPair.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	eci := ed.EncryptedContentInfo
+	encrypted, err := octetStringValue(eci.EncryptedContent)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := decryptContent(eci.ContentEncryptionAlgorithm, cek, encrypted)
+	if err != nil {
+		return nil, nil, err
+	}
+	return eci.ContentType, content, nil
+}
+
+// decryptContentEncryptionKey recovers the content-encryption key from the recipient info
+// addressed to the device certificate
+func decryptContentEncryptionKey(recipientInfos []asn1.RawValue, cert *x509.Certificate, key crypto.PrivateKey) ([]byte, error) {
+	for _, ri := range recipientInfos {
+		switch {
+		case ri.Class == asn1.ClassUniversal && ri.Tag == asn1.TagSequence:
+			var ktri keyTransRecipientInfo
+			if _, err := asn1.Unmarshal(ri.FullBytes, &ktri); err != nil {
+				return nil, err
+			}
+			if !recipientIdentifierMatches(ktri.RID, cert) {
+				continue
+			}
+			return decryptKeyTrans(ktri, key)
+		case ri.Class == asn1.ClassContextSpecific && ri.Tag == 1:
+			var kari keyAgreeRecipientInfo
+			if _, err := asn1.UnmarshalWithParams(ri.FullBytes, &kari, "tag:1"); err != nil {
+				return nil, err
+			}
+			for _, rek := range kari.RecipientEncryptedKeys {
+				if recipientIdentifierMatches(rek.RID, cert) {
+					return decryptKeyAgree(kari, rek.EncryptedKey, key)
+				}
+			}
+		}
+	}
+	return nil, errors.New("no recipient info matches the device certificate")
+}
+
+// recipientIdentifierMatches compares an issuerAndSerialNumber or subjectKeyIdentifier
+// recipient identifier to the device certificate
+func recipientIdentifierMatches(rid asn1.RawValue, cert *x509.Certificate) bool {
+	switch {
+	case rid.Class == asn1.ClassUniversal && rid.Tag == asn1.TagSequence:
+		var ias protocol.IssuerAndSerialNumber
+		if _, err := asn1.Unmarshal(rid.FullBytes, &ias); err != nil {
+			return false
+		}
+		return bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && ias.SerialNumber.Cmp(cert.SerialNumber) == 0
+	case rid.Class == asn1.ClassContextSpecific && rid.Tag == 0 && !rid.IsCompound:
+		// KeyTransRecipientInfo subjectKeyIdentifier [0] IMPLICIT SubjectKeyIdentifier
+		return len(cert.SubjectKeyId) > 0 && bytes.Equal(rid.Bytes, cert.SubjectKeyId)
+	case rid.Class == asn1.ClassContextSpecific && rid.Tag == 0:
+		// KeyAgreeRecipientIdentifier rKeyId [0] IMPLICIT RecipientKeyIdentifier
+		var rki recipientKeyIdentifier
+		if _, err := asn1.UnmarshalWithParams(rid.FullBytes, &rki, "tag:0"); err != nil {
+			return false
+		}
+		return len(cert.SubjectKeyId) > 0 && bytes.Equal(rki.SubjectKeyIdentifier, cert.SubjectKeyId)
+	default:
+		return false
+	}
+}
+
+func decryptKeyTrans(ktri keyTransRecipientInfo, key crypto.PrivateKey) ([]byte, error) {
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key transport requires an RSA device private key")
+	}
+	switch alg := ktri.KeyEncryptionAlgorithm; {
+	case alg.Algorithm.Equal(oid.PublicKeyAlgorithmRSA):
+		return rsa.DecryptPKCS1v15(nil, rsaKey, ktri.EncryptedKey)
+	case alg.Algorithm.Equal(oidKeyEncryptionRSAOAEP):
+		hash := crypto.SHA1
+		if len(alg.Parameters.FullBytes) > 0 {
+			var params rsaOAEPParameters
+			if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+				return nil, err
+			}
+			if params.HashFunc.Algorithm != nil {
+				var found bool
+				if hash, found = oid.DigestAlgorithmToCryptoHash[params.HashFunc.Algorithm.String()]; !found {
+					return nil, fmt.Errorf("unsupported RSAES-OAEP hash algorithm: %v", params.HashFunc.Algorithm)
+				}
+			}
+		}
+		return rsa.DecryptOAEP(hash.New(), nil, rsaKey, ktri.EncryptedKey, nil)
+	default:
+		return nil, fmt.Errorf("unsupported key encryption algorithm: %v", alg.Algorithm)
+	}
+}
+
+func decryptKeyAgree(kari keyAgreeRecipientInfo, encryptedKey []byte, key crypto.PrivateKey) ([]byte, error) {
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key agreement requires an EC device private key")
+	}
+	var hash crypto.Hash
+	switch alg := kari.KeyEncryptionAlgorithm.Algorithm; {
+	case alg.Equal(oidKeyAgreementECDHSHA256KDF):
+		hash = crypto.SHA256
+	case alg.Equal(oidKeyAgreementECDHSHA384KDF):
+		hash = crypto.SHA384
+	case alg.Equal(oidKeyAgreementECDHSHA512KDF):
+		hash = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("unsupported key agreement algorithm: %v", alg)
+	}
+	var wrapAlgorithm pkix.AlgorithmIdentifier
+	if _, err := asn1.Unmarshal(kari.KeyEncryptionAlgorithm.Parameters.FullBytes, &wrapAlgorithm); err != nil {
+		return nil, fmt.Errorf("invalid key wrap algorithm: %w", err)
+	}
+	kekLen, err := keyWrapKeyLength(wrapAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	// Only the originatorKey [1] choice is used with ephemeral-static ECDH
+	var originatorChoice asn1.RawValue
+	if _, err := asn1.Unmarshal(kari.Originator.Bytes, &originatorChoice); err != nil {
+		return nil, err
+	}
+	if originatorChoice.Class != asn1.ClassContextSpecific || originatorChoice.Tag != 1 {
+		return nil, errors.New("unsupported key agreement originator")
+	}
+	var originator originatorPublicKey
+	if _, err := asn1.UnmarshalWithParams(originatorChoice.FullBytes, &originator, "tag:1"); err != nil {
+		return nil, err
+	}
+	ecdhKey, err := ecKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdhKey.Curve().NewPublicKey(originator.PublicKey.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid originator public key: %w", err)
+	}
+	sharedSecret, err := ecdhKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	suppPubInfo := make([]byte, 4)
+	binary.BigEndian.PutUint32(suppPubInfo, uint32(kekLen*8))
+	sharedInfo, err := asn1.Marshal(eccCMSSharedInfo{
+		KeyInfo:     wrapAlgorithm,
+		EntityUInfo: kari.UKM,
+		SuppPubInfo: suppPubInfo,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return aesKeyUnwrap(ansiX963KDF(hash, sharedSecret, sharedInfo, kekLen), encryptedKey)
+}
+
+func keyWrapKeyLength(algorithm asn1.ObjectIdentifier) (int, error) {
+	switch {
+	case algorithm.Equal(oidKeyWrapAES128):
+		return 16, nil
+	case algorithm.Equal(oidKeyWrapAES192):
+		return 24, nil
+	case algorithm.Equal(oidKeyWrapAES256):
+		return 32, nil
+	default:
+		return 0, fmt.Errorf("unsupported key wrap algorithm: %v", algorithm)
+	}
+}
+
+// ansiX963KDF derives a key encryption key as specified by RFC 5753 section 7.2
+func ansiX963KDF(hash crypto.Hash, sharedSecret, sharedInfo []byte, length int) []byte {
+	var out []byte
+	counter := make([]byte, 4)
+	for i := uint32(1); len(out) < length; i++ {
+		binary.BigEndian.PutUint32(counter, i)
+		h := hash.New()
+		h.Write(sharedSecret)
+		h.Write(counter)
+		h.Write(sharedInfo)
+		out = h.Sum(out)
+	}
+	return out[:length]
+}
+
+// aesKeyUnwrap implements the AES key unwrap algorithm of RFC 3394
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errors.New("invalid wrapped key length")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a)^t)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			copy(a, buf[:8])
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	defaultIV := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	if subtle.ConstantTimeCompare(a, defaultIV) != 1 {
+		return nil, errors.New("key unwrap integrity check failed")
+	}
+	return r, nil
+}
+
+// decryptContent decrypts the AES-CBC encrypted content of an EnvelopedData
+func decryptContent(algorithm pkix.AlgorithmIdentifier, cek, encrypted []byte) ([]byte, error) {
+	var keyLen int
+	switch {
+	case algorithm.Algorithm.Equal(oidContentEncryptionAES128CBC):
+		keyLen = 16
+	case algorithm.Algorithm.Equal(oidContentEncryptionAES192CBC):
+		keyLen = 24
+	case algorithm.Algorithm.Equal(oidContentEncryptionAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported content encryption algorithm: %v", algorithm.Algorithm)
+	}
+	if len(cek) != keyLen {
+		return nil, errors.New("content-encryption key length does not match the algorithm")
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("invalid content encryption IV: %w", err)
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid content encryption IV length")
+	}
+	if len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted content length")
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, encrypted)
+	padding := int(content[len(content)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("invalid content padding")
+	}
+	for _, b := range content[len(content)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("invalid content padding")
+		}
+	}
+	return content[:len(content)-padding], nil
+}
+
+// octetStringValue returns the value of an implicitly tagged OCTET STRING, which BER
+// encoders may split into several segments
+func octetStringValue(rv asn1.RawValue) ([]byte, error) {
+	if rv.FullBytes == nil {
+		return nil, errors.New("EnvelopedData has no encrypted content")
+	}
+	if !rv.IsCompound {
+		return rv.Bytes, nil
+	}
+	var value []byte
+	for rest := rv.Bytes; len(rest) > 0; {
+		var segment asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &segment); err != nil {
+			return nil, err
+		}
+		part, err := octetStringValue(segment)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, part...)
+	}
+	return value, nil
+}
@@ -0,0 +1,367 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/github/smimesign/ietf-cms/oid"
+	"github.com/github/smimesign/ietf-cms/protocol"
+)
+
+type testRecipient struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestRecipient(t *testing.T, key crypto.Signer) testRecipient {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testRecipient{cert: cert, key: key}
+}
+
+// newTestDeviceAgent writes the recipient key pair to disk and returns an agent using it
+func newTestDeviceAgent(t *testing.T, recipient testRecipient) *Agent {
+	t.Helper()
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(recipient.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "private_key.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, "my_cert.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: recipient.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &Agent{
+		DevicePrivateKey:    keyPath,
+		DeviceEndEntityCert: certPath,
+		StatusFilePath:      filepath.Join(dir, "status.json"),
+		ResultFilePath:      filepath.Join(dir, "result.json"),
+	}
+}
+
+func testAESKeyWrap(t *testing.T, kek, key []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(key) / 8
+	a := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	r := append([]byte{}, key...)
+	buf := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, a)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Encrypt(buf, buf)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^uint64(n*j+i))
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	return append(a, r...)
+}
+
+func newTestKeyTransRecipientInfo(t *testing.T, recipient testRecipient, cek []byte, oaep bool) asn1.RawValue {
+	t.Helper()
+	rid, err := protocol.NewIssuerAndSerialNumber(recipient.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := recipient.cert.PublicKey.(*rsa.PublicKey)
+	ktri := keyTransRecipientInfo{RID: rid}
+	if oaep {
+		params, err := asn1.Marshal(rsaOAEPParameters{HashFunc: pkix.AlgorithmIdentifier{Algorithm: oid.DigestAlgorithmSHA256}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ktri.KeyEncryptionAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidKeyEncryptionRSAOAEP, Parameters: asn1.RawValue{FullBytes: params}}
+		ktri.EncryptedKey, err = rsa.EncryptOAEP(crypto.SHA256.New(), rand.Reader, pub, cek, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		ktri.KeyEncryptionAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oid.PublicKeyAlgorithmRSA, Parameters: asn1.NullRawValue}
+		ktri.EncryptedKey, err = rsa.EncryptPKCS1v15(rand.Reader, pub, cek)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	der, err := asn1.Marshal(ktri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return asn1.RawValue{FullBytes: der}
+}
+
+func newTestKeyAgreeRecipientInfo(t *testing.T, recipient testRecipient, cek []byte) asn1.RawValue {
+	t.Helper()
+	rid, err := protocol.NewIssuerAndSerialNumber(recipient.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientKey, err := recipient.cert.PublicKey.(*ecdsa.PublicKey).ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedSecret, err := ephemeral.ECDH(recipientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidKeyWrapAES128}
+	sharedInfo, err := asn1.Marshal(eccCMSSharedInfo{KeyInfo: wrapAlgorithm, SuppPubInfo: []byte{0, 0, 0, 128}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek := ansiX963KDF(crypto.SHA256, sharedSecret, sharedInfo, 16)
+	wrapParams, err := asn1.Marshal(wrapAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := ephemeral.PublicKey().Bytes()
+	originator, err := asn1.MarshalWithParams(originatorPublicKey{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oid.PublicKeyAlgorithmECDSA},
+		PublicKey: asn1.BitString{Bytes: publicKey, BitLength: len(publicKey) * 8},
+	}, "tag:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.MarshalWithParams(keyAgreeRecipientInfo{
+		Version:                3,
+		Originator:             asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: originator, IsCompound: true},
+		KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidKeyAgreementECDHSHA256KDF, Parameters: asn1.RawValue{FullBytes: wrapParams}},
+		RecipientEncryptedKeys: []recipientEncryptedKey{{RID: rid, EncryptedKey: testAESKeyWrap(t, kek, cek)}},
+	}, "tag:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return asn1.RawValue{FullBytes: der}
+}
+
+// newTestEnvelopedData encrypts content with AES-256-CBC for the recipient, using key transport
+// for RSA recipients and ephemeral-static ECDH for EC recipients
+func newTestEnvelopedData(t *testing.T, contentType asn1.ObjectIdentifier, content []byte, recipient testRecipient, oaep bool) []byte {
+	t.Helper()
+	cek := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(cek); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+	padding := aes.BlockSize - len(content)%aes.BlockSize
+	encrypted := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := envelopedData{
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                contentType,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidContentEncryptionAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted},
+		},
+	}
+	if _, ok := recipient.key.(*rsa.PrivateKey); ok {
+		ed.RecipientInfos = []asn1.RawValue{newTestKeyTransRecipientInfo(t, recipient, cek, oaep)}
+	} else {
+		ed.Version = 2
+		ed.RecipientInfos = []asn1.RawValue{newTestKeyAgreeRecipientInfo(t, recipient, cek)}
+	}
+	edDER, err := asn1.Marshal(ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(protocol.ContentInfo{
+		ContentType: oidContentTypeEnvelopedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: edDER, IsCompound: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+//nolint:funlen
+func TestAgent_decryptConveyedInformation(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaRecipient := newTestRecipient(t, rsaKey)
+	ecRecipient := newTestRecipient(t, ecKey)
+	otherRecipient := newTestRecipient(t, otherKey)
+
+	ownerCert, ownerKey := newTestCertificate(t, "owner", nil, nil)
+	signed, err := protocol.ParseContentInfo(newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ownerCert, ownerKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := newTestEnvelopedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ecRecipient, false)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name       string
+		recipient  testRecipient
+		info       []byte
+		ownerCerts []*x509.Certificate
+		want       []byte
+		wantErr    bool
+	}{
+		{
+			name:      "not encrypted",
+			recipient: ecRecipient,
+			info:      newTestContentInfo(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation)),
+			want:      []byte(testConveyedInformation),
+		},
+		{
+			name:      "RSA key transport",
+			recipient: rsaRecipient,
+			info:      newTestEnvelopedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), rsaRecipient, false),
+			want:      []byte(testConveyedInformation),
+		},
+		{
+			name:      "RSAES-OAEP key transport",
+			recipient: rsaRecipient,
+			info:      newTestEnvelopedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), rsaRecipient, true),
+			want:      []byte(testConveyedInformation),
+		},
+		{
+			name:      "ECDH key agreement",
+			recipient: ecRecipient,
+			info:      newTestEnvelopedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ecRecipient, false),
+			want:      []byte(testConveyedInformation),
+		},
+		{
+			name:       "signed then encrypted",
+			recipient:  ecRecipient,
+			info:       newTestEnvelopedData(t, oid.ContentTypeSignedData, signed.Content.Bytes, ecRecipient, false),
+			ownerCerts: []*x509.Certificate{ownerCert},
+			want:       []byte(testConveyedInformation),
+		},
+		{
+			name:      "encrypted for another device",
+			recipient: ecRecipient,
+			info:      newTestEnvelopedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), otherRecipient, false),
+			wantErr:   true,
+		},
+		{
+			name:      "tampered encrypted content",
+			recipient: ecRecipient,
+			info:      tampered,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestDeviceAgent(t, tt.recipient)
+			decrypted, err := a.decryptConveyedInformation(tt.info)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decryptConveyedInformation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if onboardingErrorStage(err, StageTypeOnboarding) != StageTypeDecrypting {
+					t.Errorf("decryptConveyedInformation() error %v is not reported under the decrypting stage", err)
+				}
+				return
+			}
+			var pinnedDomainCert *x509.Certificate
+			if tt.ownerCerts != nil {
+				pinnedDomainCert = tt.ownerCerts[0]
+			}
+			got, err := parseConveyedInformation(decrypted, tt.ownerCerts, pinnedDomainCert, false)
+			if err != nil {
+				t.Fatalf("parseConveyedInformation() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("decryptConveyedInformation() got = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_aesKeyUnwrap(t *testing.T) {
+	// RFC 3394 section 4.1 test vector
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F")
+	wrapped, _ := hex.DecodeString("1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5")
+	want, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF")
+	got, err := aesKeyUnwrap(kek, wrapped)
+	if err != nil {
+		t.Fatalf("aesKeyUnwrap() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("aesKeyUnwrap() got = %x, want %x", got, want)
+	}
+	wrapped[0] ^= 0xff
+	if _, err := aesKeyUnwrap(kek, wrapped); err == nil {
+		t.Errorf("aesKeyUnwrap() expected an integrity check error")
+	}
+}
+
+func Test_onboardingErrorStage(t *testing.T) {
+	if got := onboardingErrorStage(errors.New("connection refused"), StageTypeOnboarding); got != StageTypeOnboarding {
+		t.Errorf("onboardingErrorStage() = %v, want %v", got, StageTypeOnboarding)
+	}
+	if got := onboardingErrorStage(errConveyedInformationDecryption, StageTypeBootImage); got != StageTypeDecrypting {
+		t.Errorf("onboardingErrorStage() = %v, want %v", got, StageTypeDecrypting)
+	}
+}
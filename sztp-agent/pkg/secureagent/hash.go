@@ -0,0 +1,81 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// The hash algorithm identities of the ietf-sztp-conveyed-info YANG module
+const (
+	HashAlgorithmSHA256 = "ietf-sztp-conveyed-info:sha-256"
+	HashAlgorithmSHA384 = "ietf-sztp-conveyed-info:sha-384"
+	HashAlgorithmSHA512 = "ietf-sztp-conveyed-info:sha-512"
+)
+
+// HashAlgorithms maps the identities of the hash algorithms, as found in the image-verification
+// entries, to the constructors of their hash
+type HashAlgorithms map[string]func() hash.Hash
+
+// DefaultHashAlgorithms returns the hash algorithms of RFC 8572 and its derived identities.
+// Vendors can add their own identities and register the result with SetHashAlgorithms.
+func DefaultHashAlgorithms() HashAlgorithms {
+	return HashAlgorithms{
+		HashAlgorithmSHA256: sha256.New,
+		HashAlgorithmSHA384: sha512.New384,
+		HashAlgorithmSHA512: sha512.New,
+	}
+}
+
+// hashAlgorithms returns the registered hash algorithms, or the default ones
+func (a *Agent) hashAlgorithms() HashAlgorithms {
+	if algorithms := a.GetHashAlgorithms(); len(algorithms) > 0 {
+		return algorithms
+	}
+	return DefaultHashAlgorithms()
+}
+
+// imageDigests hashes the boot image with every hash algorithm of its image-verification entries at once
+type imageDigests map[string]hash.Hash
+
+// newImageDigests returns the digests of the image-verification entries, an error when one of their
+// hash algorithms is not registered
+func (a *Agent) newImageDigests() (imageDigests, error) {
+	algorithms := a.hashAlgorithms()
+	digests := imageDigests{}
+	for _, verification := range a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage.ImageVerification {
+		newHash, ok := algorithms[verification.HashAlgorithm]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash algorithm %q", verification.HashAlgorithm)
+		}
+		if _, ok := digests[verification.HashAlgorithm]; !ok {
+			digests[verification.HashAlgorithm] = newHash()
+		}
+	}
+	return digests, nil
+}
+
+// writer returns a writer hashing with every digest
+func (d imageDigests) writer() io.Writer {
+	writers := make([]io.Writer, 0, len(d))
+	for _, digest := range d {
+		writers = append(writers, digest)
+	}
+	return io.MultiWriter(writers...)
+}
+
+// normalizeHashValue returns the hex-encoded hash value, the YANG hex-string separates its bytes with colons
+func normalizeHashValue(hashValue string) string {
+	return strings.ToLower(strings.ReplaceAll(hashValue, ":", ""))
+}
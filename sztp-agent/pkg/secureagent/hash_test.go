@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// imageVerification returns an image-verification entry, in JSON
+func imageVerification(algorithm string, hashValue []byte) string {
+	return fmt.Sprintf(`{"hash-algorithm": %q, "hash-value": %q}`, algorithm, hex.EncodeToString(hashValue))
+}
+
+func TestAgent_newImageDigests(t *testing.T) {
+	tests := []struct {
+		name       string
+		algorithms HashAlgorithms
+		algorithm  string
+		wantErr    bool
+	}{
+		{name: "sha-256", algorithm: HashAlgorithmSHA256},
+		{name: "sha-384", algorithm: HashAlgorithmSHA384},
+		{name: "sha-512", algorithm: HashAlgorithmSHA512},
+		{name: "unknown", algorithm: "example:sha-1", wantErr: true},
+		{name: "registered", algorithms: HashAlgorithms{"example:sha-1": sha1.New}, algorithm: "example:sha-1"},
+		{name: "not registered", algorithms: HashAlgorithms{"example:sha-1": sha1.New}, algorithm: HashAlgorithmSHA256, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{}
+			a.SetHashAlgorithms(tt.algorithms)
+			bootImage := &a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage
+			if err := json.Unmarshal([]byte("["+imageVerification(tt.algorithm, nil)+"]"), &bootImage.ImageVerification); err != nil {
+				t.Fatal(err)
+			}
+			digests, err := a.newImageDigests()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newImageDigests() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && digests[tt.algorithm] == nil {
+				t.Errorf("newImageDigests() = %v, want a digest for %s", digests, tt.algorithm)
+			}
+		})
+	}
+}
+
+//nolint:funlen
+func TestAgent_downloadAndValidateImageHashAlgorithms(t *testing.T) {
+	image := []byte("boot image")
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(image)
+	}))
+	defer svr.Close()
+	sha256Sum := sha256.Sum256(image)
+	sha384Sum := sha512.Sum384(image)
+	sha512Sum := sha512.Sum512(image)
+	sha1Sum := sha1.Sum(image) //nolint:gosec
+	tests := []struct {
+		name          string
+		algorithms    HashAlgorithms
+		verifications []string
+		wantErr       string
+	}{
+		{
+			name:          "every algorithm",
+			verifications: []string{imageVerification(HashAlgorithmSHA512, sha512Sum[:]), imageVerification(HashAlgorithmSHA384, sha384Sum[:]), imageVerification(HashAlgorithmSHA256, sha256Sum[:])},
+		},
+		{
+			name:          "colon separated hash value",
+			verifications: []string{fmt.Sprintf(`{"hash-algorithm": %q, "hash-value": %q}`, HashAlgorithmSHA384, strings.ReplaceAll(fmt.Sprintf("% X", sha384Sum[:]), " ", ":"))},
+		},
+		{
+			name:          "one mismatching entry",
+			verifications: []string{imageVerification(HashAlgorithmSHA256, sha256Sum[:]), imageVerification(HashAlgorithmSHA512, sha256Sum[:])},
+			wantErr:       "checksum mismatch for ietf-sztp-conveyed-info:sha-512",
+		},
+		{
+			name:          "unsupported algorithm",
+			verifications: []string{imageVerification(HashAlgorithmSHA256, sha256Sum[:]), imageVerification("example:sha-1", sha1Sum[:])},
+			wantErr:       `unsupported hash algorithm "example:sha-1"`,
+		},
+		{
+			name:          "vendor algorithm",
+			algorithms:    HashAlgorithms{HashAlgorithmSHA256: sha256.New, "example:sha-1": sha1.New},
+			verifications: []string{imageVerification(HashAlgorithmSHA256, sha256Sum[:]), imageVerification("example:sha-1", sha1Sum[:])},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a := &Agent{
+				StatusFilePath: filepath.Join(dir, "status.json"),
+				ResultFilePath: filepath.Join(dir, "result.json"),
+				HttpClient:     &http.Client{},
+				HashAlgorithms: tt.algorithms,
+			}
+			bootImage := &a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage
+			bootImage.DownloadURI = []string{svr.URL + "/image.img"}
+			if err := json.Unmarshal([]byte("["+strings.Join(tt.verifications, ",")+"]"), &bootImage.ImageVerification); err != nil {
+				t.Fatal(err)
+			}
+			err := a.downloadAndValidateImage(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("downloadAndValidateImage() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("downloadAndValidateImage() error = %v", err)
+			}
+			if _, err := os.Stat(a.imageCachePath()); !os.IsNotExist(err) {
+				t.Errorf("boot image not removed once verified: %v", err)
+			}
+		})
+	}
+}
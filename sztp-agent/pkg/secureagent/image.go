@@ -8,10 +8,13 @@ Copyright (C) 2022 Red Hat.
 package secureagent
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -19,71 +22,345 @@ import (
 	"time"
 )
 
-//nolint:funlen
-func (a *Agent) downloadAndValidateImage() error {
-	log.Printf("[INFO] Starting the Download Image: %v", a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage.DownloadURI)
-	_ = a.doReportProgress(ProgressTypeBootImageInitiated, "BootImage Initiated")
+// downloadAndValidateImage downloads the boot image and installs it. The download-uri entries are
+// mirrors of the same image, they are tried in order until one serves an image passing every
+// image-verification.
+func (a *Agent) downloadAndValidateImage(ctx context.Context) error {
+	bootImage := a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage
+	log.Printf("[INFO] Starting the Download Image: %v", bootImage.DownloadURI)
+	_ = a.doReportProgress(ctx, ProgressTypeBootImageInitiated, "BootImage Initiated")
 	_ = a.updateAndSaveStatus(StageTypeBootImage, true, "")
+	if len(bootImage.DownloadURI) == 0 {
+		log.Println("[INFO] No boot image to download")
+		_ = a.updateAndSaveStatus(StageTypeBootImage, false, "")
+		return nil
+	}
+	running, mismatch := a.checkBootImage(OS_RELEASE_FILE)
+	if running {
+		log.Println("[INFO] The device already runs the boot image, skipping its download")
+		_ = a.doReportProgress(ctx, ProgressTypeBootImageComplete, "BootImage already running")
+		_ = a.updateAndSaveStatus(StageTypeBootImage, false, "")
+		return nil
+	}
+	if mismatch != "" {
+		log.Println("[INFO] " + mismatch)
+		_ = a.doReportProgress(ctx, ProgressTypeBootImageMismatch, mismatch)
+	}
+	// The image could not be verified whatever the mirror
+	if err := a.checkImageVerification(); err != nil {
+		return err
+	}
 	// Download the image from DownloadURI and save it to a file
 	a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.InfoTimestampReference = fmt.Sprintf("%8d", time.Now().Unix())
-	for i, item := range a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage.DownloadURI {
-		// TODO: maybe need to file download to a function in util.go
-		log.Printf("[INFO] Downloading Image %v", item)
-		// Create a empty file
-		file, err := os.Create(ARTIFACTS_PATH + a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.InfoTimestampReference + filepath.Base(item))
-		if err != nil {
+	var filePath string
+	var err error
+	for _, item := range bootImage.DownloadURI {
+		filePath, err = a.downloadAndVerifyImage(ctx, item)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		log.Printf("[ERROR] Boot image mirror %s failed: %v", item, err)
+	}
+	if err != nil {
+		if len(bootImage.DownloadURI) == 1 || ctx.Err() != nil {
 			return err
 		}
+		return fmt.Errorf("none of the %d boot image mirrors succeeded, last error: %w", len(bootImage.DownloadURI), err)
+	}
+	if err := a.installBootImage(ctx, filePath); err != nil {
+		return err
+	}
+	// The image is kept until it is installed, the next attempt does not download it again
+	if err := os.Remove(filePath); err != nil {
+		log.Println("[ERROR] Error when removing:", err)
+	}
+	// An installed boot image is reported as boot-image-installed-rebooting instead
+	if !a.bootImageInstalled() {
+		_ = a.doReportProgress(ctx, ProgressTypeBootImageComplete, "BootImage Complete")
+	}
+	_ = a.updateAndSaveStatus(StageTypeBootImage, false, "")
+	return nil
+}
+
+// checkImageVerification checks that the boot image can be verified, all its hash algorithms must
+// be registered and its hash values hexadecimal, the first one names the downloaded file
+func (a *Agent) checkImageVerification() error {
+	verifications := a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage.ImageVerification
+	if len(verifications) == 0 {
+		return errors.New("no image-verification to verify the boot image with")
+	}
+	for _, verification := range verifications {
+		if _, err := hex.DecodeString(normalizeHashValue(verification.HashValue)); err != nil || verification.HashValue == "" {
+			return fmt.Errorf("invalid %s hash-value %q", verification.HashAlgorithm, verification.HashValue)
+		}
+	}
+	_, err := a.newImageDigests()
+	return err
+}
+
+// downloadAndVerifyImage downloads the boot image from one of its mirrors, resuming the partial
+// download of a previous attempt, and verifies it against every image-verification and, when an
+// image-signing trust anchor is configured, against its detached signature. The image failing the
+// verification is removed.
+func (a *Agent) downloadAndVerifyImage(ctx context.Context, uri string) (string, error) {
+	digests, err := a.newImageDigests()
+	if err != nil {
+		return "", err
+	}
+	// The signature tells how to hash the image, it is downloaded first
+	signature, err := a.downloadImageSignature(ctx, uri)
+	if err != nil {
+		return "", a.reportImageSignatureError(ctx, err)
+	}
+	writer := digests.writer()
+	if signature != nil {
+		writer = io.MultiWriter(writer, signature)
+	}
+	log.Printf("[INFO] Downloading Image %v", uri)
+	filePath := a.imageCachePath()
+	size, err := a.downloadFile(ctx, uri, filePath, writer)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("[INFO] Downloaded file: %s with size: %d", filePath, size)
+	log.Println("[INFO] Verify the file checksum: ", filePath)
+	err = a.verifyImage(digests)
+	if err == nil && signature != nil {
+		if err = signature.verify(); err != nil {
+			err = a.reportImageSignatureError(ctx, fmt.Errorf("boot image %s: %w", uri, err))
+		}
+	}
+	if err != nil {
+		if rerr := os.Remove(filePath); rerr != nil {
+			log.Println("[ERROR] Error when removing:", rerr)
+		}
+		return "", err
+	}
+	log.Println("[INFO] Checksum verified successfully")
+	if signature != nil {
+		log.Println("[INFO] Signature verified successfully")
+	}
+	return filePath, nil
+}
+
+// reportImageSignatureError reports the failed verification of the boot image signature to the
+// bootstrap server, and returns it
+func (a *Agent) reportImageSignatureError(ctx context.Context, err error) error {
+	log.Println("[ERROR] " + err.Error())
+	_ = a.doReportProgress(ctx, ProgressTypeBootImageError, err.Error())
+	return err
+}
+
+// imageCachePath returns where the boot image is downloaded. It is named after its hash value so
+// that the download of the same image resumes, whatever the mirror and across the attempts. The
+// hash value is checked by checkImageVerification.
+func (a *Agent) imageCachePath() string {
+	verifications := a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage.ImageVerification
+	return ARTIFACTS_PATH + "sztp-boot-image-" + normalizeHashValue(verifications[0].HashValue)
+}
+
+// verifyImage verifies the digests of the image file against every image-verification
+func (a *Agent) verifyImage(digests imageDigests) error {
+	for _, verification := range a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage.ImageVerification {
+		checksum := hex.EncodeToString(digests[verification.HashAlgorithm].Sum(nil))
+		original := normalizeHashValue(verification.HashValue)
+		log.Printf("%s calculated: %s", verification.HashAlgorithm, checksum)
+		log.Printf("%s expected  : %s", verification.HashAlgorithm, original)
+		if checksum != original {
+			return fmt.Errorf("checksum mismatch for %s", verification.HashAlgorithm)
+		}
+	}
+	return nil
+}
 
-		response, err := a.HttpClient.Get(item)
+// downloadFile downloads a file with a GET request. The partially downloaded file of a previous
+// attempt is resumed with a Range request, and kept when the download fails or is cancelled. The
+// whole file is written to digest, hashing it while it is downloaded, and the progress is saved in
+// the downloading-file stage of the status.
+func (a *Agent) downloadFile(ctx context.Context, uri string, filePath string, digest io.Writer) (size int64, err error) {
+	_ = a.updateAndSaveStatus(StageTypeDownloadingFile, true, "")
+	file, err := os.OpenFile(filepath.Clean(filePath), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		errMsg := ""
 		if err != nil {
-			return err
+			errMsg = err.Error()
+			// Nothing to resume
+			if size == 0 {
+				_ = os.Remove(filePath)
+			}
 		}
+		_ = a.updateAndSaveStatus(StageTypeDownloadingFile, false, errMsg)
+	}()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
 
-		sizeorigin, _ := strconv.Atoi(response.Header.Get("Content-Length"))
-		downloadSize := int64(sizeorigin)
-		log.Printf("[INFO] Downloading the image with size: %v", downloadSize)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return offset, err
+	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	response, err := a.downloadHTTPClient().Do(request)
+	if err != nil {
+		return offset, err
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			log.Println("[ERROR] Error when closing:", err)
+		}
+	}()
+
+	start, total, err := downloadRange(response, offset)
+	if errors.Is(err, errCachedFileMismatch) {
+		// The next attempt starts over
+		return 0, err
+	}
+	if err != nil {
+		return offset, err
+	}
+	if start < offset {
+		log.Println("[INFO] The server does not resume the download, starting over")
+		if err := file.Truncate(0); err != nil {
+			return 0, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+	} else if start > 0 {
+		log.Printf("[INFO] Resuming the download at %d bytes", start)
+		// The part downloaded before is hashed now, the rest while it is downloaded
+		if _, err := io.Copy(digest, io.NewSectionReader(file, 0, start)); err != nil {
+			return start, err
+		}
+	}
+	if start > 0 && start == total {
+		log.Println("[INFO] The file is already downloaded")
+		return start, nil
+	}
+	log.Printf("[INFO] Downloading the image with size: %v", total)
 
-		if response.StatusCode != 200 {
-			return errors.New("received non 200 response code")
+	progress := &downloadProgress{a: a, uri: uri, bytes: start, total: total}
+	progress.save()
+	written, err := io.Copy(io.MultiWriter(file, digest, progress), response.Body)
+	progress.save()
+	size = start + written
+	if err == nil && total > 0 && size != total {
+		err = fmt.Errorf("downloaded %d bytes instead of %d", size, total)
+	}
+	return size, err
+}
+
+// errCachedFileMismatch is returned when the partially downloaded file is larger than the file to download
+var errCachedFileMismatch = errors.New("the partially downloaded file does not match the file to download")
+
+// downloadRange returns where the content of the response starts in the file, and the size of the
+// file, 0 when unknown. The content starts at the offset when the download is resumed, at 0 when
+// the server sends the whole file, and is empty when the file was already downloaded.
+func downloadRange(response *http.Response, offset int64) (start int64, total int64, err error) {
+	switch response.StatusCode {
+	case http.StatusOK:
+		if response.ContentLength < 0 {
+			return 0, 0, nil
 		}
-		size, err := io.Copy(file, response.Body)
+		return 0, response.ContentLength, nil
+	case http.StatusPartialContent:
+		start, total, err = parseContentRange(response.Header.Get("Content-Range"))
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
-		defer func() {
-			if err := file.Close(); err != nil {
-				log.Println("[ERROR] Error when closing:", err)
-			}
-		}()
-		defer func() {
-			if err := response.Body.Close(); err != nil {
-				log.Println("[ERROR] Error when closing:", err)
-			}
-		}()
-
-		log.Printf("[INFO] Downloaded file: %s with size: %d", ARTIFACTS_PATH+a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.InfoTimestampReference+filepath.Base(item), size)
-		log.Println("[INFO] Verify the file checksum: ", ARTIFACTS_PATH+a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.InfoTimestampReference+filepath.Base(item))
-		switch a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage.ImageVerification[i].HashAlgorithm {
-		case "ietf-sztp-conveyed-info:sha-256":
-			filePath := ARTIFACTS_PATH + a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.InfoTimestampReference + filepath.Base(item)
-			checksum, err := calculateSHA256File(filePath)
-			original := strings.ReplaceAll(a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage.ImageVerification[i].HashValue, ":", "")
-			if err != nil {
-				log.Println("[ERROR] Could not calculate checksum", err)
-			}
-			log.Println("calculated: " + checksum)
-			log.Println("expected  : " + original)
-			if checksum != original {
-				return errors.New("checksum mismatch")
-			}
-			log.Println("[INFO] Checksum verified successfully")
-			_ = a.doReportProgress(ProgressTypeBootImageComplete, "BootImage Complete")
-			_ = a.updateAndSaveStatus(StageTypeBootImage, false, "")
-			return nil
-		default:
-			return errors.New("unsupported hash algorithm")
+		if start != offset {
+			return 0, 0, fmt.Errorf("received the range starting at %d instead of %d", start, offset)
 		}
+		return start, total, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		_, total, err = parseContentRange(response.Header.Get("Content-Range"))
+		if err != nil || total != offset {
+			return 0, 0, errCachedFileMismatch
+		}
+		return offset, total, nil
+	default:
+		return 0, 0, fmt.Errorf("received non 200 response code: %d", response.StatusCode)
 	}
-	return nil
+}
+
+// parseContentRange parses a Content-Range header, "bytes 100-199/200", or "bytes */200" when the
+// requested range is not satisfiable. The total is 0 when unknown.
+func parseContentRange(contentRange string) (start int64, total int64, err error) {
+	invalid := fmt.Errorf("invalid Content-Range %q", contentRange)
+	unit, byteRange, ok := strings.Cut(contentRange, " ")
+	if !ok || unit != "bytes" {
+		return 0, 0, invalid
+	}
+	byteRange, size, ok := strings.Cut(byteRange, "/")
+	if !ok {
+		return 0, 0, invalid
+	}
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, invalid
+		}
+	}
+	if byteRange == "*" {
+		return 0, total, nil
+	}
+	first, _, _ := strings.Cut(byteRange, "-")
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, invalid
+	}
+	return start, total, nil
+}
+
+// downloadProgress counts the downloaded bytes, and saves them in the status at most every
+// DOWNLOAD_PROGRESS_INTERVAL
+type downloadProgress struct {
+	a     *Agent
+	uri   string
+	bytes int64
+	total int64
+	saved time.Time
+}
+
+// Write counts the bytes written
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.bytes += int64(len(b))
+	if time.Since(p.saved) >= DOWNLOAD_PROGRESS_INTERVAL {
+		p.save()
+	}
+	return len(b), nil
+}
+
+// save saves the progress in the status
+func (p *downloadProgress) save() {
+	p.saved = time.Now()
+	if err := p.a.updateAndSaveDownloadProgress(p.uri, p.bytes, p.total); err != nil {
+		log.Println("[ERROR] Failed to save the download progress: ", err)
+	}
+}
+
+// checkBootImage tells whether the device already runs the os-name and os-version of the boot
+// image, according to the os-release file, and describes the mismatch otherwise. Without os-name
+// and os-version, the boot image is downloaded and there is no mismatch.
+func (a *Agent) checkBootImage(osReleaseFile string) (bool, string) {
+	bootImage := a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage
+	if bootImage.OsName == "" || bootImage.OsVersion == "" || len(bootImage.DownloadURI) == 0 {
+		return false, ""
+	}
+	osName, osVersion, err := readOSRelease(osReleaseFile)
+	if err != nil {
+		log.Printf("[WARNING] Error loading os-release file, downloading the boot image: %v", err)
+		return false, ""
+	}
+	if osName == bootImage.OsName && osVersion == bootImage.OsVersion {
+		return true, ""
+	}
+	return false, fmt.Sprintf("Running %s %s instead of %s %s", osName, osVersion, bootImage.OsName, bootImage.OsVersion)
 }
@@ -1,9 +1,19 @@
 package secureagent
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 //nolint:funlen
@@ -53,6 +63,8 @@ func TestAgent_downloadAndValidateImage(t *testing.T) {
 					IetfSztpConveyedInfoOnboardingInformation: struct {
 						InfoTimestampReference string
 						BootImage              struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -66,6 +78,8 @@ func TestAgent_downloadAndValidateImage(t *testing.T) {
 					}{
 						InfoTimestampReference: "",
 						BootImage: struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -102,6 +116,8 @@ func TestAgent_downloadAndValidateImage(t *testing.T) {
 					IetfSztpConveyedInfoOnboardingInformation: struct {
 						InfoTimestampReference string
 						BootImage              struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -115,6 +131,8 @@ func TestAgent_downloadAndValidateImage(t *testing.T) {
 					}{
 						InfoTimestampReference: "TIMESTAMP",
 						BootImage: struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -151,6 +169,8 @@ func TestAgent_downloadAndValidateImage(t *testing.T) {
 					IetfSztpConveyedInfoOnboardingInformation: struct {
 						InfoTimestampReference string
 						BootImage              struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -164,6 +184,8 @@ func TestAgent_downloadAndValidateImage(t *testing.T) {
 					}{
 						InfoTimestampReference: "TIMESTAMP",
 						BootImage: struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -200,6 +222,8 @@ func TestAgent_downloadAndValidateImage(t *testing.T) {
 					IetfSztpConveyedInfoOnboardingInformation: struct {
 						InfoTimestampReference string
 						BootImage              struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -213,6 +237,8 @@ func TestAgent_downloadAndValidateImage(t *testing.T) {
 					}{
 						InfoTimestampReference: "TIMESTAMP",
 						BootImage: struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -255,6 +281,8 @@ func TestAgent_downloadAndValidateImage(t *testing.T) {
 					IetfSztpConveyedInfoOnboardingInformation: struct {
 						InfoTimestampReference string
 						BootImage              struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -268,6 +296,8 @@ func TestAgent_downloadAndValidateImage(t *testing.T) {
 					}{
 						InfoTimestampReference: "TIMESTAMP",
 						BootImage: struct {
+							OsName            string   `json:"os-name,omitempty"`
+							OsVersion         string   `json:"os-version,omitempty"`
 							DownloadURI       []string `json:"download-uri"`
 							ImageVerification []struct {
 								HashAlgorithm string `json:"hash-algorithm"`
@@ -311,9 +341,297 @@ func TestAgent_downloadAndValidateImage(t *testing.T) {
 				BootstrapServerRedirectInfo:   tt.fields.BootstrapServerRedirectInfo,
 				HttpClient:                    &http.Client{},
 			}
-			if err := a.downloadAndValidateImage(); (err != nil) != tt.wantErr {
+			if err := a.downloadAndValidateImage(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("downloadAndValidateImage() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+//nolint:funlen
+func TestAgent_downloadFile(t *testing.T) {
+	image := []byte("boot image")
+	started := make(chan struct{})
+	var ranges []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		switch r.URL.Path {
+		case "/missing.img":
+			w.WriteHeader(http.StatusNotFound)
+		case "/slow.img":
+			_, _ = w.Write([]byte("partial content"))
+			w.(http.Flusher).Flush()
+			close(started)
+			<-r.Context().Done()
+		case "/no-range.img":
+			_, _ = w.Write(image)
+		default:
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(image))
+		}
+	}))
+	defer svr.Close()
+	dir := t.TempDir()
+	a := &Agent{
+		HttpClient:     &http.Client{},
+		StatusFilePath: filepath.Join(dir, "status.json"),
+		ResultFilePath: filepath.Join(dir, "result.json"),
+	}
+	sum := sha256.Sum256(image)
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		path      string
+		partial   string
+		wantRange string
+		wantErr   error
+	}{
+		{name: "full download", path: "/full.img"},
+		{name: "resumed download", path: "/full.img", partial: "boot", wantRange: "bytes=4-"},
+		{name: "already downloaded", path: "/full.img", partial: "boot image", wantRange: "bytes=10-"},
+		{name: "resume not supported", path: "/no-range.img", partial: "corrupted", wantRange: "bytes=9-"},
+		{name: "larger partial download", path: "/full.img", partial: "boot image, corrupted", wantRange: "bytes=21-", wantErr: errCachedFileMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(dir, "image.img")
+			defer os.Remove(filePath)
+			if tt.partial != "" {
+				if err := os.WriteFile(filePath, []byte(tt.partial), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ranges = nil
+			digest := sha256.New()
+			size, err := a.downloadFile(context.Background(), svr.URL+tt.path, filePath, digest)
+			if len(ranges) != 1 || ranges[0] != tt.wantRange {
+				t.Errorf("requested ranges = %q, want %q", ranges, tt.wantRange)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("downloadFile() error = %v, want %v", err, tt.wantErr)
+				}
+				if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+					t.Errorf("mismatching partial download not removed: %v", err)
+				}
+				return
+			}
+			if err != nil || size != int64(len(image)) {
+				t.Fatalf("downloadFile() = %v, %v, want %v, nil", size, err, len(image))
+			}
+			if got, _ := os.ReadFile(filePath); !bytes.Equal(got, image) {
+				t.Errorf("downloaded file = %q, want %q", got, image)
+			}
+			if got := hex.EncodeToString(digest.Sum(nil)); got != checksum {
+				t.Errorf("digest = %v, want %v", got, checksum)
+			}
+		})
+	}
+	status, err := a.getCurrStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.DownloadingFile.URI != svr.URL+"/no-range.img" || status.DownloadingFile.Bytes != 10 || status.DownloadingFile.Total != 10 || status.DownloadingFile.End == 0 {
+		t.Errorf("downloading-file status = %+v, want the completed download", status.DownloadingFile)
+	}
+
+	missing := filepath.Join(dir, "missing.img")
+	if _, err := a.downloadFile(context.Background(), svr.URL+"/missing.img", missing, sha256.New()); err == nil {
+		t.Error("downloadFile() succeeded for a missing image")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("failed download not removed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	slow := filepath.Join(dir, "slow.img")
+	go func() {
+		<-started
+		// Cancelled once the partial content is written
+		for i := 0; i < 100; i++ {
+			if info, err := os.Stat(slow); err == nil && info.Size() > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+	if _, err := a.downloadFile(ctx, svr.URL+"/slow.img", slow, sha256.New()); !errors.Is(err, context.Canceled) {
+		t.Errorf("downloadFile() error = %v, want %v", err, context.Canceled)
+	}
+	if got, _ := os.ReadFile(slow); string(got) != "partial content" {
+		t.Errorf("partial download = %q, want it kept to resume", got)
+	}
+}
+
+func Test_parseContentRange(t *testing.T) {
+	tests := []struct {
+		contentRange string
+		wantStart    int64
+		wantTotal    int64
+		wantErr      bool
+	}{
+		{contentRange: "bytes 100-199/200", wantStart: 100, wantTotal: 200},
+		{contentRange: "bytes 100-199/*", wantStart: 100},
+		{contentRange: "bytes */200", wantTotal: 200},
+		{contentRange: "bytes", wantErr: true},
+		{contentRange: "items 100-199/200", wantErr: true},
+		{contentRange: "bytes 100-199", wantErr: true},
+		{contentRange: "bytes a-199/200", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentRange, func(t *testing.T) {
+			start, total, err := parseContentRange(tt.contentRange)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseContentRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if start != tt.wantStart || total != tt.wantTotal {
+				t.Errorf("parseContentRange() = %v, %v, want %v, %v", start, total, tt.wantStart, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestAgent_checkBootImage(t *testing.T) {
+	osRelease := filepath.Join(t.TempDir(), "os-release")
+	if err := os.WriteFile(osRelease, []byte("NAME=\"Debian GNU/Linux\"\nVERSION_ID=\"12\"\nVERSION=\"12 (bookworm)\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		osName       string
+		osVersion    string
+		downloadURI  []string
+		osRelease    string
+		wantRunning  bool
+		wantMismatch string
+	}{
+		{name: "running", osName: "Debian GNU/Linux", osVersion: "12 (bookworm)", downloadURI: []string{"http://image"}, osRelease: osRelease, wantRunning: true},
+		{name: "other version", osName: "Debian GNU/Linux", osVersion: "13 (trixie)", downloadURI: []string{"http://image"}, osRelease: osRelease, wantMismatch: "Running Debian GNU/Linux 12 (bookworm) instead of Debian GNU/Linux 13 (trixie)"},
+		{name: "no os-version", osName: "Debian GNU/Linux", downloadURI: []string{"http://image"}, osRelease: osRelease},
+		{name: "no boot image", osName: "Debian GNU/Linux", osVersion: "12 (bookworm)", osRelease: osRelease},
+		{name: "no os-release", osName: "Debian GNU/Linux", osVersion: "12 (bookworm)", downloadURI: []string{"http://image"}, osRelease: filepath.Join(t.TempDir(), "missing")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{}
+			bootImage := &a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage
+			bootImage.OsName = tt.osName
+			bootImage.OsVersion = tt.osVersion
+			bootImage.DownloadURI = tt.downloadURI
+			running, mismatch := a.checkBootImage(tt.osRelease)
+			if running != tt.wantRunning || mismatch != tt.wantMismatch {
+				t.Errorf("checkBootImage() = %v, %q, want %v, %q", running, mismatch, tt.wantRunning, tt.wantMismatch)
+			}
+		})
+	}
+}
+
+func TestAgent_downloadAndValidateImageRunning(t *testing.T) {
+	osName, osVersion, err := readOSRelease(OS_RELEASE_FILE)
+	if err != nil {
+		t.Skipf("no os-release file: %v", err)
+	}
+	dir := t.TempDir()
+	a := &Agent{
+		StatusFilePath: filepath.Join(dir, "status.json"),
+		ResultFilePath: filepath.Join(dir, "result.json"),
+		HttpClient:     &http.Client{},
+		ImageInstaller: &BlockDeviceInstaller{Device: filepath.Join(dir, "missing")},
+	}
+	bootImage := &a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage
+	bootImage.OsName = osName
+	bootImage.OsVersion = osVersion
+	// Nothing is downloaded
+	bootImage.DownloadURI = []string{"http://127.0.0.1:0/image.img"}
+	if err := a.downloadAndValidateImage(context.Background()); err != nil {
+		t.Fatalf("downloadAndValidateImage() error = %v", err)
+	}
+	if a.bootImageInstalled() {
+		t.Error("bootImageInstalled() = true, want the running boot image not installed again")
+	}
+	bootImage.OsVersion = osVersion + "-next"
+	if err := a.downloadAndValidateImage(context.Background()); err == nil {
+		t.Error("downloadAndValidateImage() skipped the download of another version")
+	}
+}
+
+func TestAgent_downloadAndValidateImageMirrors(t *testing.T) {
+	image := []byte("boot image")
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dead/image.img":
+			w.WriteHeader(http.StatusNotFound)
+		case "/corrupt/image.img":
+			_, _ = w.Write([]byte("corrupted boot image"))
+		default:
+			_, _ = w.Write(image)
+		}
+	}))
+	defer svr.Close()
+	sum := sha256.Sum256(image)
+	hashValue := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name         string
+		downloadURI  []string
+		verification string
+		wantErr      string
+	}{
+		{
+			name:         "first mirrors failing",
+			downloadURI:  []string{svr.URL + "/dead/image.img", svr.URL + "/corrupt/image.img", svr.URL + "/good/image.img"},
+			verification: `[{"hash-algorithm": "ietf-sztp-conveyed-info:sha-256", "hash-value": "` + hashValue + `"}]`,
+		},
+		{
+			name:         "more verifications than mirrors",
+			downloadURI:  []string{svr.URL + "/good/image.img"},
+			verification: `[{"hash-algorithm": "ietf-sztp-conveyed-info:sha-256", "hash-value": "` + hashValue + `"}, {"hash-algorithm": "ietf-sztp-conveyed-info:sha-256", "hash-value": "` + strings.ToUpper(hashValue) + `"}]`,
+		},
+		{
+			name:         "every mirror failing",
+			downloadURI:  []string{svr.URL + "/dead/image.img", svr.URL + "/corrupt/image.img"},
+			verification: `[{"hash-algorithm": "ietf-sztp-conveyed-info:sha-256", "hash-value": "` + hashValue + `"}]`,
+			wantErr:      "none of the 2 boot image mirrors succeeded, last error: checksum mismatch for ietf-sztp-conveyed-info:sha-256",
+		},
+		{
+			name:         "no verification",
+			downloadURI:  []string{svr.URL + "/good/image.img"},
+			verification: `[]`,
+			wantErr:      "no image-verification to verify the boot image with",
+		},
+		{
+			name:         "hash value escaping the artifacts directory",
+			downloadURI:  []string{svr.URL + "/good/image.img"},
+			verification: `[{"hash-algorithm": "ietf-sztp-conveyed-info:sha-256", "hash-value": "../../etc/passwd"}]`,
+			wantErr:      `invalid ietf-sztp-conveyed-info:sha-256 hash-value "../../etc/passwd"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a := &Agent{
+				StatusFilePath: filepath.Join(dir, "status.json"),
+				ResultFilePath: filepath.Join(dir, "result.json"),
+				HttpClient:     &http.Client{},
+			}
+			bootImage := &a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage
+			bootImage.DownloadURI = tt.downloadURI
+			if err := json.Unmarshal([]byte(tt.verification), &bootImage.ImageVerification); err != nil {
+				t.Fatal(err)
+			}
+			err := a.downloadAndValidateImage(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("downloadAndValidateImage() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("downloadAndValidateImage() error = %v", err)
+			}
+			if _, err := os.Stat(a.imageCachePath()); !os.IsNotExist(err) {
+				t.Errorf("boot image not removed once verified: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The built-in boot image installers, selected by the Type of the ImageInstallerConfig
+const (
+	InstallerBlockDevice = "block-device"
+	InstallerCommand     = "command"
+	InstallerGrub        = "grub"
+	InstallerKexec       = "kexec"
+)
+
+// errRebootPending is returned by the bootstrap sequence once the device is rebooting into the
+// installed boot image, the sequence resumes after the reboot
+var errRebootPending = errors.New("rebooting into the installed boot image")
+
+// ImageInstaller installs the downloaded and verified boot image, the device boots it after the reboot
+type ImageInstaller interface {
+	// Name identifies the installer in the logs and the errors
+	Name() string
+	// Install installs the image file
+	Install(ctx context.Context, imagePath string) error
+}
+
+// Rebooter is implemented by the installers that boot the installed image themselves, the reboot
+// command of the agent is used for the others
+type Rebooter interface {
+	Reboot(ctx context.Context) error
+}
+
+// ImageInstallerConfig selects one of the built-in installers and configures it
+type ImageInstallerConfig struct {
+	Type        string // InstallerBlockDevice, InstallerCommand, InstallerGrub or InstallerKexec, no installer when empty
+	Device      string // The block device or partition the image is written to
+	Command     string // The vendor install command, run by /bin/sh with the image path as $1
+	Path        string // Where the image is copied for the GRUB menu entry to boot it
+	GrubEntry   string // The GRUB menu entry booted once, by grub-reboot
+	GrubCommand string // The command booting the GRUB menu entry once, grub-reboot when empty
+	Initrd      string // The initrd loaded by kexec along with the image kernel
+	CommandLine string // The kernel command line of kexec, the current one is reused when empty
+}
+
+// NewImageInstaller returns the installer selected by the configuration, nil when none is
+func NewImageInstaller(config ImageInstallerConfig) (ImageInstaller, error) {
+	switch config.Type {
+	case "":
+		return nil, nil
+	case InstallerBlockDevice:
+		if config.Device == "" {
+			return nil, errors.New("the block-device installer needs a device")
+		}
+		return &BlockDeviceInstaller{Device: config.Device}, nil
+	case InstallerCommand:
+		if config.Command == "" {
+			return nil, errors.New("the command installer needs a command")
+		}
+		return &CommandInstaller{Command: config.Command}, nil
+	case InstallerGrub:
+		if config.Path == "" || config.GrubEntry == "" {
+			return nil, errors.New("the grub installer needs an image path and a menu entry")
+		}
+		return &GrubInstaller{Path: config.Path, Entry: config.GrubEntry, Command: config.GrubCommand}, nil
+	case InstallerKexec:
+		return &KexecInstaller{Initrd: config.Initrd, CommandLine: config.CommandLine}, nil
+	default:
+		return nil, fmt.Errorf("unknown boot image installer %q", config.Type)
+	}
+}
+
+// BlockDeviceInstaller writes the image, e.g. a raw disk or filesystem image, to a block device or partition
+type BlockDeviceInstaller struct {
+	Device string // e.g. /dev/sda2
+}
+
+// Name identifies the installer in the logs and the errors
+func (i *BlockDeviceInstaller) Name() string {
+	return InstallerBlockDevice
+}
+
+// Install writes the image at the beginning of the device
+func (i *BlockDeviceInstaller) Install(ctx context.Context, imagePath string) error {
+	image, err := os.Open(filepath.Clean(imagePath))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := image.Close(); err != nil {
+			log.Println("[ERROR] Error when closing:", err)
+		}
+	}()
+	// The device is neither created nor truncated
+	device, err := os.OpenFile(filepath.Clean(i.Device), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(device, &contextReader{ctx: ctx, r: image})
+	if err == nil {
+		err = device.Sync()
+	}
+	if cerr := device.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", i.Device, err)
+	}
+	log.Printf("[INFO] Wrote %d bytes to %s", size, i.Device)
+	return nil
+}
+
+// CommandInstaller hands the image to a vendor install command
+type CommandInstaller struct {
+	Command string // run by /bin/sh with the image path as $1, e.g. "sonic-installer install -y $1"
+}
+
+// Name identifies the installer in the logs and the errors
+func (i *CommandInstaller) Name() string {
+	return InstallerCommand
+}
+
+// Install runs the install command
+func (i *CommandInstaller) Install(ctx context.Context, imagePath string) error {
+	out, err := runCommand(ctx, "/bin/sh", "-c", i.Command, "sh", imagePath)
+	log.Println(string(out))
+	return err
+}
+
+// GrubInstaller copies the image where a GRUB menu entry boots it from, e.g. a kernel or an ISO, and
+// makes the entry the default of the next boot only
+type GrubInstaller struct {
+	Path    string // e.g. /boot/sztp/vmlinuz
+	Entry   string // the menu entry booting Path
+	Command string // grub-reboot when empty, grub2-reboot on some distributions
+}
+
+// Name identifies the installer in the logs and the errors
+func (i *GrubInstaller) Name() string {
+	return InstallerGrub
+}
+
+// Install copies the image and selects the menu entry for the next boot
+func (i *GrubInstaller) Install(ctx context.Context, imagePath string) error {
+	if err := copyFile(ctx, imagePath, i.Path); err != nil {
+		return err
+	}
+	command := i.Command
+	if command == "" {
+		command = "grub-reboot"
+	}
+	out, err := runCommand(ctx, command, i.Entry)
+	log.Println(string(out))
+	return err
+}
+
+// KexecInstaller loads the image, a kernel, with kexec. The reboot then boots it directly, without
+// going through the firmware and the bootloader.
+type KexecInstaller struct {
+	Initrd      string // the initrd, none when empty
+	CommandLine string // the kernel command line, the current one when empty
+}
+
+// Name identifies the installer in the logs and the errors
+func (i *KexecInstaller) Name() string {
+	return InstallerKexec
+}
+
+// Install loads the kernel image
+func (i *KexecInstaller) Install(ctx context.Context, imagePath string) error {
+	out, err := runCommand(ctx, "kexec", i.loadArgs(imagePath)...)
+	log.Println(string(out))
+	return err
+}
+
+// loadArgs returns the kexec arguments loading the image
+func (i *KexecInstaller) loadArgs(imagePath string) []string {
+	args := []string{"--load", imagePath}
+	if i.Initrd != "" {
+		args = append(args, "--initrd="+i.Initrd)
+	}
+	if i.CommandLine != "" {
+		args = append(args, "--append="+i.CommandLine)
+	} else {
+		args = append(args, "--reuse-cmdline")
+	}
+	return args
+}
+
+// Reboot stops the services cleanly and boots the loaded kernel
+func (i *KexecInstaller) Reboot(ctx context.Context) error {
+	_, err := runCommand(ctx, "systemctl", "kexec")
+	return err
+}
+
+// installBootImage installs the verified boot image with the configured installer
+func (a *Agent) installBootImage(ctx context.Context, imagePath string) error {
+	installer := a.GetImageInstaller()
+	if installer == nil {
+		log.Println("[INFO] No boot image installer configured, the boot image is only downloaded and verified")
+		return nil
+	}
+	log.Printf("[INFO] Installing the boot image %s with the %s installer", imagePath, installer.Name())
+	if err := installer.Install(ctx, imagePath); err != nil {
+		return fmt.Errorf("%s installer: %w", installer.Name(), err)
+	}
+	log.Println("[INFO] Boot image installed successfully")
+	return nil
+}
+
+// bootImageInstalled tells whether the boot image stage installed a boot image, the device then
+// reboots into it. The boot image the device already runs is not installed again.
+func (a *Agent) bootImageInstalled() bool {
+	if a.GetImageInstaller() == nil || len(a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage.DownloadURI) == 0 {
+		return false
+	}
+	running, _ := a.checkBootImage(OS_RELEASE_FILE)
+	return !running
+}
+
+// reboot reboots the device into the installed boot image, with the installer when it boots the
+// image itself or with the reboot command. It returns errRebootPending once the reboot is started.
+func (a *Agent) reboot(ctx context.Context) error {
+	var err error
+	if rebooter, ok := a.GetImageInstaller().(Rebooter); ok {
+		log.Printf("[INFO] Rebooting with the %s installer", a.GetImageInstaller().Name())
+		err = rebooter.Reboot(ctx)
+	} else if a.GetRebootCommand() != "" {
+		log.Println("[INFO] Rebooting with: " + a.GetRebootCommand())
+		_, err = runCommand(ctx, "/bin/sh", "-c", a.GetRebootCommand())
+	} else {
+		log.Println("[WARNING] No reboot command configured, the bootstrap sequence resumes once the device is rebooted")
+	}
+	if err != nil {
+		return fmt.Errorf("rebooting into the boot image: %w", err)
+	}
+	return errRebootPending
+}
+
+// copyFile copies a file through a temporary file, the destination is replaced atomically
+func copyFile(ctx context.Context, src, dst string) (err error) {
+	in, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			log.Println("[ERROR] Error when closing:", err)
+		}
+	}()
+	if err := ensureDirExists(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	tmp := filepath.Clean(dst + ".tmp")
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+	}()
+	_, err = io.Copy(out, &contextReader{ctx: ctx, r: in})
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// contextReader stops reading when ctx is done, so that long copies can be cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read reads from the underlying reader unless ctx is done
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// currentBootID returns the identifier of the current boot, empty when unknown
+func currentBootID() string {
+	id, err := os.ReadFile(BOOT_ID_FILE)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newLoopbackDevice creates a file standing for the block device, filled with 0xff
+func newLoopbackDevice(t *testing.T, size int) string {
+	t.Helper()
+	device := filepath.Join(t.TempDir(), "loop0")
+	if err := os.WriteFile(device, bytes.Repeat([]byte{0xff}, size), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+func writeTestImage(t *testing.T, content string) string {
+	t.Helper()
+	image := filepath.Join(t.TempDir(), "image.img")
+	if err := os.WriteFile(image, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func TestNewImageInstaller(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ImageInstallerConfig
+		want    ImageInstaller
+		wantErr bool
+	}{
+		{name: "none", config: ImageInstallerConfig{}, want: nil},
+		{name: "block device", config: ImageInstallerConfig{Type: "block-device", Device: "/dev/sda2"}, want: &BlockDeviceInstaller{Device: "/dev/sda2"}},
+		{name: "block device without device", config: ImageInstallerConfig{Type: "block-device"}, wantErr: true},
+		{name: "command", config: ImageInstallerConfig{Type: "command", Command: "install $1"}, want: &CommandInstaller{Command: "install $1"}},
+		{name: "command without command", config: ImageInstallerConfig{Type: "command"}, wantErr: true},
+		{name: "grub", config: ImageInstallerConfig{Type: "grub", Path: "/boot/sztp", GrubEntry: "sztp"}, want: &GrubInstaller{Path: "/boot/sztp", Entry: "sztp"}},
+		{name: "grub2", config: ImageInstallerConfig{Type: "grub", Path: "/boot/sztp", GrubEntry: "sztp", GrubCommand: "grub2-reboot"}, want: &GrubInstaller{Path: "/boot/sztp", Entry: "sztp", Command: "grub2-reboot"}},
+		{name: "grub without entry", config: ImageInstallerConfig{Type: "grub", Path: "/boot/sztp"}, wantErr: true},
+		{name: "kexec", config: ImageInstallerConfig{Type: "kexec", Initrd: "/boot/initrd"}, want: &KexecInstaller{Initrd: "/boot/initrd"}},
+		{name: "unknown", config: ImageInstallerConfig{Type: "floppy"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewImageInstaller(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewImageInstaller() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewImageInstaller() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlockDeviceInstaller_Install(t *testing.T) {
+	device := newLoopbackDevice(t, 64)
+	installer := &BlockDeviceInstaller{Device: device}
+	if err := installer.Install(context.Background(), writeTestImage(t, "boot image")); err != nil {
+		t.Fatalf("Install() error = %v", err)
+	}
+	got, err := os.ReadFile(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The device is not truncated
+	want := append([]byte("boot image"), bytes.Repeat([]byte{0xff}, 54)...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("device content = %q, want %q", got, want)
+	}
+
+	installer.Device = filepath.Join(t.TempDir(), "missing")
+	if err := installer.Install(context.Background(), writeTestImage(t, "boot image")); err == nil {
+		t.Error("Install() created the missing device")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	installer.Device = device
+	if err := installer.Install(ctx, writeTestImage(t, "boot image")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Install() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestCommandInstaller_Install(t *testing.T) {
+	installed := filepath.Join(t.TempDir(), "installed.img")
+	installer := &CommandInstaller{Command: `cp "$1" ` + installed}
+	if err := installer.Install(context.Background(), writeTestImage(t, "boot image")); err != nil {
+		t.Fatalf("Install() error = %v", err)
+	}
+	if got, _ := os.ReadFile(installed); string(got) != "boot image" {
+		t.Errorf("installed image = %q, want %q", got, "boot image")
+	}
+	installer.Command = "exit 3"
+	if err := installer.Install(context.Background(), writeTestImage(t, "boot image")); err == nil {
+		t.Error("Install() ignored the failure of the command")
+	}
+}
+
+func TestGrubInstaller_Install(t *testing.T) {
+	dir := t.TempDir()
+	grubReboot := filepath.Join(dir, "grub-reboot")
+	//nolint:gosec
+	if err := os.WriteFile(grubReboot, []byte("#!/bin/sh\necho \"$1\" > "+filepath.Join(dir, "next-entry")+"\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	installer := &GrubInstaller{Path: filepath.Join(dir, "boot", "sztp.img"), Entry: "SZTP boot image", Command: grubReboot}
+	if err := installer.Install(context.Background(), writeTestImage(t, "boot image")); err != nil {
+		t.Fatalf("Install() error = %v", err)
+	}
+	if got, _ := os.ReadFile(installer.Path); string(got) != "boot image" {
+		t.Errorf("copied image = %q, want %q", got, "boot image")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "next-entry")); string(got) != "SZTP boot image\n" {
+		t.Errorf("next entry = %q, want %q", got, "SZTP boot image\n")
+	}
+}
+
+func TestKexecInstaller_loadArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		installer KexecInstaller
+		want      []string
+	}{
+		{name: "current command line", installer: KexecInstaller{}, want: []string{"--load", "/tmp/vmlinuz", "--reuse-cmdline"}},
+		{name: "initrd and command line", installer: KexecInstaller{Initrd: "/tmp/initrd", CommandLine: "console=ttyS0"}, want: []string{"--load", "/tmp/vmlinuz", "--initrd=/tmp/initrd", "--append=console=ttyS0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.installer.loadArgs("/tmp/vmlinuz"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgent_performBootstrapSequenceInstall(t *testing.T) {
+	image := []byte("boot image")
+	sum := sha256.Sum256(image)
+	var svr *httptest.Server
+	svr = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "get-bootstrapping-data"):
+			onboarding := `{"ietf-sztp-conveyed-info:onboarding-information": {"boot-image": {
+				"download-uri": ["` + svr.URL + `/install.img"],
+				"image-verification": [{"hash-algorithm": "ietf-sztp-conveyed-info:sha-256", "hash-value": "` + hex.EncodeToString(sum[:]) + `"}]
+			}}}`
+			var output BootstrapServerPostOutput
+			output.IetfSztpBootstrapServerOutput.ConveyedInformation = base64.StdEncoding.EncodeToString(newTestContentInfo(t, oidContentTypeSztpConveyedInfoJSON, []byte(onboarding)))
+			_ = json.NewEncoder(w).Encode(output)
+		case r.URL.Path == "/install.img":
+			_, _ = w.Write(image)
+		}
+	}))
+	defer svr.Close()
+	dir := t.TempDir()
+	device := newLoopbackDevice(t, 16)
+	a := newStateTestAgent(t)
+	a.HttpClient = &http.Client{}
+	a.InputBootstrapURL = svr.URL + "/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data"
+	a.SetImageInstaller(&BlockDeviceInstaller{Device: device})
+	a.SetRebootCommand("touch " + filepath.Join(dir, "rebooted"))
+
+	if err := a.performBootstrapSequence(context.Background()); !errors.Is(err, errRebootPending) {
+		t.Fatalf("performBootstrapSequence() error = %v, want %v", err, errRebootPending)
+	}
+	if got, _ := os.ReadFile(device); !bytes.HasPrefix(got, image) {
+		t.Errorf("device content = %q, want the boot image", got)
+	}
+	if _, err := os.Stat(a.imageCachePath()); !os.IsNotExist(err) {
+		t.Errorf("boot image not removed once installed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "rebooted")); err != nil {
+		t.Errorf("reboot command not run: %v", err)
+	}
+	state := a.loadBootstrapState()
+	if !state.pendingReboot() || !state.completed(StageTypeOnboarding) || !state.completed(StageTypeBootImage) || state.completed(StageTypeConfig) {
+		t.Errorf("state = %+v, want pending the reboot", state)
+	}
+	if state.BootstrapURL != a.InputBootstrapURL || len(state.OnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage.DownloadURI) != 1 {
+		t.Errorf("state = %+v, want the onboarding information of the bootstrap server", state)
+	}
+	status, err := a.getCurrStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Stage != "pending-reboot-in-progress" || status.BootImage.End == 0 || status.Config.Start != 0 {
+		t.Errorf("status = %+v, want pending the reboot", status)
+	}
+}
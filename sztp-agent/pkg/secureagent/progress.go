@@ -10,6 +10,7 @@ Copyright (C) 2022 Red Hat.
 package secureagent
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"log"
@@ -109,7 +110,12 @@ func (s ProgressType) String() string {
 	return "unknown"
 }
 
-func (a *Agent) doReportProgress(s ProgressType, message string) error {
+func (a *Agent) doReportProgress(ctx context.Context, s ProgressType, message string) error {
+	if a.GetBootstrapURL() == "" {
+		// The bootstrapping data came from removable storage
+		log.Println("[INFO] No bootstrap server to report the progress to: " + s.String())
+		return nil
+	}
 	log.Println("[INFO] Starting the Report Progress request.")
 	url := strings.ReplaceAll(a.GetBootstrapURL(), "get-bootstrapping-data", "report-progress")
 	var p ProgressJSON
@@ -131,7 +137,7 @@ func (a *Agent) doReportProgress(s ProgressType, message string) error {
 	}
 	a.SetProgressJSON(p)
 	inputJSON, _ := json.Marshal(a.GetProgressJSON())
-	res, err := a.doTLSRequest(string(inputJSON), url, true)
+	res, err := a.doTLSRequest(ctx, string(inputJSON), url, true)
 	if err != nil {
 		log.Println("[ERROR] ", err.Error())
 		return err
@@ -5,6 +5,7 @@
 package secureagent
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -62,6 +63,8 @@ func TestAgent_doReportProgress(t *testing.T) {
 	expected := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "MIIDfwYLKoZIhvcNAQkQASugggNuBIIDansKICAiaWV0Zi1zenRwLWNvbnZleWVkLWluZm86b25ib2FyZGluZy1pbmZvcm1hdGlvbiI6IHsKICAgICJib290LWltYWdlIjogewogICAgICAiZG93bmxvYWQtdXJpIjogWwogICAgICAgICJodHRwOi8vd2ViOjgwODIvdmFyL2xpYi9taXNjL215LWJvb3QtaW1hZ2UuaW1nIiwKICAgICAgICAiZnRwOi8vd2ViOjMwODIvdmFyL2xpYi9taXNjL215LWJvb3QtaW1hZ2UuaW1nIgogICAgICBdLAogICAgICAiaW1hZ2UtdmVyaWZpY2F0aW9uIjogWwogICAgICAgIHsKICAgICAgICAgICJoYXNoLWFsZ29yaXRobSI6ICJpZXRmLXN6dHAtY29udmV5ZWQtaW5mbzpzaGEtMjU2IiwKICAgICAgICAgICJoYXNoLXZhbHVlIjogIjdiOmNhOmU2OmFjOjIzOjA2OmQ4Ojc5OjA2OjhjOmFjOjAzOjgwOmUyOjE2OjQ0OjdlOjQwOjZhOjY1OmZhOmQ0OjY5OjYxOjZlOjA1OmNlOmY1Ojg3OmRjOjJiOjk3IgogICAgICAgIH0KICAgICAgXQogICAgfSwKICAgICJwcmUtY29uZmlndXJhdGlvbi1zY3JpcHQiOiAiSXlFdlltbHVMMkpoYzJnS1pXTm9ieUFpYVc1emFXUmxJSFJvWlNCd2NtVXRZMjl1Wm1sbmRYSmhkR2x2YmkxelkzSnBjSFF1TGk0aUNnPT0iLAogICAgImNvbmZpZ3VyYXRpb24taGFuZGxpbmciOiAibWVyZ2UiLAogICAgImNvbmZpZ3VyYXRpb24iOiAiUEhSdmNDQjRiV3h1Y3owaWFIUjBjSE02TDJWNFlXMXdiR1V1WTI5dEwyTnZibVpwWnlJK0NpQWdQR0Z1ZVMxNGJXd3RZMjl1ZEdWdWRDMXZhMkY1THo0S1BDOTBiM0ErQ2c9PSIsCiAgICAicG9zdC1jb25maWd1cmF0aW9uLXNjcmlwdCI6ICJJeUV2WW1sdUwySmhjMmdLWldOb2J5QWlhVzV6YVdSbElIUm9aU0J3YjNOMExXTnZibVpwWjNWeVlYUnBiMjR0YzJOeWFYQjBMaTR1SWdvPSIKICB9Cn0=",
 		},
@@ -69,6 +72,8 @@ func TestAgent_doReportProgress(t *testing.T) {
 	expectedFailedBase64 := BootstrapServerPostOutput{
 		IetfSztpBootstrapServerOutput: struct {
 			ConveyedInformation string `json:"conveyed-information"`
+			OwnerCertificate    string `json:"owner-certificate,omitempty"`
+			OwnershipVoucher    string `json:"ownership-voucher,omitempty"`
 		}{
 			ConveyedInformation: "{wrongBASE64}",
 		},
@@ -160,7 +165,7 @@ func TestAgent_doReportProgress(t *testing.T) {
 				ProgressJSON:             tt.fields.ProgressJSON,
 				HttpClient:               &http.Client{},
 			}
-			if err := a.doReportProgress(ProgressTypeBootstrapInitiated, "Bootstrap Initiated"); (err != nil) != tt.wantErr {
+			if err := a.doReportProgress(context.Background(), ProgressTypeBootstrapInitiated, "Bootstrap Initiated"); (err != nil) != tt.wantErr {
 				t.Errorf("doReportProgress() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -0,0 +1,92 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// RetryPolicy is how the daemon retries a failed bootstrap sequence. The waits grow exponentially
+// and are randomized so that devices failing together, e.g. during a bootstrap server outage, do
+// not retry together.
+type RetryPolicy struct {
+	InitialInterval time.Duration // The wait after the first failure
+	MaxInterval     time.Duration // The longest wait, before jitter
+	Multiplier      float64       // The growth of the wait after each failure
+	Jitter          float64       // The randomization factor, the wait is picked in [wait*(1-Jitter), wait*(1+Jitter)]
+	MaxAttempts     int           // The attempts before giving up, 0 for no limit
+	MaxElapsedTime  time.Duration // The time before giving up, 0 for no limit
+}
+
+// DefaultRetryPolicy returns the policy of the daemon when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialInterval: DAEMON_RETRY_INTERVAL,
+		MaxInterval:     5 * time.Minute,
+		Multiplier:      2,
+		Jitter:          0.2,
+	}
+}
+
+// Validate checks that the policy is usable
+func (p RetryPolicy) Validate() error {
+	switch {
+	case p.InitialInterval <= 0:
+		return errors.New("the initial retry interval must be positive")
+	case p.MaxInterval < p.InitialInterval:
+		return errors.New("the max retry interval must not be lower than the initial one")
+	case p.Multiplier < 1:
+		return errors.New("the retry multiplier must be at least 1")
+	case p.Jitter < 0 || p.Jitter > 1:
+		return errors.New("the retry jitter must be between 0 and 1")
+	case p.MaxAttempts < 0:
+		return errors.New("the max retry attempts must not be negative")
+	case p.MaxElapsedTime < 0:
+		return errors.New("the max retry elapsed time must not be negative")
+	}
+	return nil
+}
+
+// NextInterval returns the randomized wait after the given number of failed attempts
+func (p RetryPolicy) NextInterval(attempt int) time.Duration {
+	return p.interval(attempt, randomFraction())
+}
+
+// interval returns the wait after the given number of failed attempts, random is in [0, 1)
+func (p RetryPolicy) interval(attempt int, random float64) time.Duration {
+	wait := float64(p.InitialInterval) * math.Pow(p.Multiplier, float64(attempt-1))
+	if wait > float64(p.MaxInterval) {
+		wait = float64(p.MaxInterval)
+	}
+	wait *= 1 + p.Jitter*(2*random-1)
+	return time.Duration(wait)
+}
+
+// GiveUp tells whether to stop retrying after the given number of failed attempts, when the next
+// one would start after the max elapsed time
+func (p RetryPolicy) GiveUp(attempt int, elapsed, wait time.Duration) bool {
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return true
+	}
+	return p.MaxElapsedTime > 0 && elapsed+wait > p.MaxElapsedTime
+}
+
+// randomFraction returns a random number in [0, 1). The seed of math/rand may be shared by the
+// devices, crypto/rand is used instead.
+func randomFraction() float64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return float64(time.Now().UnixNano()%1000) / 1000
+	}
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
@@ -0,0 +1,155 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_interval(t *testing.T) {
+	p := RetryPolicy{InitialInterval: 5 * time.Second, MaxInterval: time.Minute, Multiplier: 2, Jitter: 0.5}
+	tests := []struct {
+		name    string
+		attempt int
+		random  float64
+		want    time.Duration
+	}{
+		{name: "first retry", attempt: 1, random: 0.5, want: 5 * time.Second},
+		{name: "exponential growth", attempt: 3, random: 0.5, want: 20 * time.Second},
+		{name: "capped", attempt: 10, random: 0.5, want: time.Minute},
+		{name: "capped for a huge attempt", attempt: 100000, random: 0.5, want: time.Minute},
+		{name: "lowest jitter", attempt: 2, random: 0, want: 5 * time.Second},
+		{name: "highest jitter", attempt: 2, random: 1, want: 15 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.interval(tt.attempt, tt.random); got != tt.want {
+				t.Errorf("interval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_NextInterval(t *testing.T) {
+	p := RetryPolicy{InitialInterval: 10 * time.Second, MaxInterval: time.Minute, Multiplier: 2, Jitter: 0.2}
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		got := p.NextInterval(1)
+		if got < 8*time.Second || got > 12*time.Second {
+			t.Fatalf("NextInterval() = %v, want within 20%% of 10s", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) == 1 {
+		t.Error("NextInterval() is not randomized")
+	}
+}
+
+func TestRetryPolicy_GiveUp(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		elapsed time.Duration
+		wait    time.Duration
+		want    bool
+	}{
+		{name: "no limit", policy: RetryPolicy{}, attempt: 1000, elapsed: time.Hour, want: false},
+		{name: "attempts left", policy: RetryPolicy{MaxAttempts: 3}, attempt: 2, want: false},
+		{name: "max attempts", policy: RetryPolicy{MaxAttempts: 3}, attempt: 3, want: true},
+		{name: "time left", policy: RetryPolicy{MaxElapsedTime: time.Minute}, elapsed: 30 * time.Second, wait: 20 * time.Second, want: false},
+		{name: "next attempt too late", policy: RetryPolicy{MaxElapsedTime: time.Minute}, elapsed: 50 * time.Second, wait: 20 * time.Second, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.GiveUp(tt.attempt, tt.elapsed, tt.wait); got != tt.want {
+				t.Errorf("GiveUp() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_Validate(t *testing.T) {
+	valid := DefaultRetryPolicy()
+	tests := []struct {
+		name    string
+		modify  func(p *RetryPolicy)
+		wantErr bool
+	}{
+		{name: "default", modify: func(_ *RetryPolicy) {}},
+		{name: "fixed interval", modify: func(p *RetryPolicy) { p.Multiplier = 1; p.Jitter = 0; p.MaxInterval = p.InitialInterval }},
+		{name: "no initial interval", modify: func(p *RetryPolicy) { p.InitialInterval = 0 }, wantErr: true},
+		{name: "max below initial", modify: func(p *RetryPolicy) { p.MaxInterval = time.Second }, wantErr: true},
+		{name: "shrinking", modify: func(p *RetryPolicy) { p.Multiplier = 0.5 }, wantErr: true},
+		{name: "jitter above 1", modify: func(p *RetryPolicy) { p.Jitter = 1.5 }, wantErr: true},
+		{name: "negative attempts", modify: func(p *RetryPolicy) { p.MaxAttempts = -1 }, wantErr: true},
+		{name: "negative elapsed time", modify: func(p *RetryPolicy) { p.MaxElapsedTime = -time.Second }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid
+			tt.modify(&p)
+			if err := p.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAgent_RunCommandDaemonRetryPolicy(t *testing.T) {
+	dir := t.TempDir()
+	failing := &testBootstrapSource{name: "bmc", err: errors.New("BMC unreachable")}
+	a := &Agent{
+		StatusFilePath: filepath.Join(dir, "status.json"),
+		ResultFilePath: filepath.Join(dir, "result.json"),
+		SymLinkDir:     filepath.Join(dir, "run"),
+		RetryPolicy:    RetryPolicy{InitialInterval: 10 * time.Millisecond, MaxInterval: 10 * time.Millisecond, Multiplier: 1, MaxAttempts: 3},
+	}
+	a.SetBootstrapSources([]BootstrapSource{failing})
+	err := a.RunCommandDaemon(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Fatalf("RunCommandDaemon() error = %v, want giving up after 3 attempts", err)
+	}
+	status, err := a.getCurrStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.IsCompleted.Errors) != 3 {
+		t.Errorf("status is-completed errors = %v, want 3 errors", status.IsCompleted.Errors)
+	}
+	if status.NextRetry != 0 {
+		t.Errorf("status next-retry = %v, want none after giving up", status.NextRetry)
+	}
+}
+
+func TestAgent_updateAndSaveNextRetry(t *testing.T) {
+	dir := t.TempDir()
+	a := &Agent{
+		StatusFilePath: filepath.Join(dir, "status.json"),
+		ResultFilePath: filepath.Join(dir, "result.json"),
+	}
+	next := time.Unix(1700000000, 0)
+	if err := a.updateAndSaveNextRetry(next); err != nil {
+		t.Fatal(err)
+	}
+	status, err := a.getCurrStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.NextRetry != 1700000000 {
+		t.Errorf("status next-retry = %v, want %v", status.NextRetry, 1700000000)
+	}
+	if err := a.updateAndSaveNextRetry(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ = a.getCurrStatus(); status.NextRetry != 0 {
+		t.Errorf("status next-retry = %v, want cleared", status.NextRetry)
+	}
+}
@@ -8,17 +8,28 @@ Copyright (C) 2022 Red Hat.
 // Package secureagent implements the secure agent
 package secureagent
 
-import "log"
+import (
+	"context"
+	"errors"
+	"log"
+)
 
 // RunCommand runs the command in the background
-func (a *Agent) RunCommand() error {
+func (a *Agent) RunCommand(ctx context.Context) error {
 	log.Println("runCommand started")
 	if err := a.prepareStatus(); err != nil {
 		log.Println("failed to prepare status: ", err)
 		return err
 	}
-	err := a.performBootstrapSequence()
+	err := a.performBootstrapSequence(ctx)
+	if errors.Is(err, errRebootPending) {
+		log.Println("runCommand finished, the bootstrap sequence resumes after the reboot")
+		return nil
+	}
 	if err != nil {
+		if ctx.Err() != nil {
+			return a.abortBootstrapSequence(ctx)
+		}
 		log.Println("Error in performBootstrapSequence inside runCommand: ", err)
 		return err
 	}
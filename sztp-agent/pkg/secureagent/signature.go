@@ -0,0 +1,326 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/github/smimesign/ietf-cms/protocol"
+	"golang.org/x/crypto/blake2b"
+)
+
+// The formats of the detached boot image signatures, selected by the ImageSignatureFormat of the agent
+const (
+	ImageSignatureCMS      = "cms"
+	ImageSignatureMinisign = "minisign"
+)
+
+// imageSignatureExtensions are appended to the download-uri of the boot image to download its signature
+var imageSignatureExtensions = map[string]string{
+	ImageSignatureCMS:      ".p7s",
+	ImageSignatureMinisign: ".minisig",
+}
+
+// maxImageSignatureSize bounds the download of the signature, unlike the image it is kept in memory
+const maxImageSignatureSize = 1 << 20
+
+// imageSignature is a detached signature of the boot image. The image is written to it while it is
+// downloaded, so that it is hashed without being read again.
+type imageSignature interface {
+	io.Writer
+	// verify verifies the signature of the image written so far against the trust anchor
+	verify() error
+}
+
+// imageSignatureFormat returns the configured signature format, CMS when none is
+func (a *Agent) imageSignatureFormat() string {
+	if a.GetImageSignatureFormat() == "" {
+		return ImageSignatureCMS
+	}
+	return a.GetImageSignatureFormat()
+}
+
+// downloadImageSignature downloads the detached signature of the boot image downloaded from uri, and
+// parses it with the image-signing trust anchor. It returns nil when no trust anchor is configured.
+func (a *Agent) downloadImageSignature(ctx context.Context, uri string) (imageSignature, error) {
+	if a.GetImageSigningTrustAnchor() == "" {
+		return nil, nil
+	}
+	extension, ok := imageSignatureExtensions[a.imageSignatureFormat()]
+	if !ok {
+		return nil, fmt.Errorf("unknown boot image signature format %q", a.imageSignatureFormat())
+	}
+	signatureURL, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	signatureURL.Path += extension
+	log.Printf("[INFO] Downloading the boot image signature %s", signatureURL)
+	signature, err := a.downloadSmallFile(ctx, signatureURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("downloading the boot image signature %s: %w", signatureURL, err)
+	}
+	parsed, err := a.parseImageSignature(signature)
+	if err != nil {
+		return nil, fmt.Errorf("boot image signature %s: %w", signatureURL, err)
+	}
+	return parsed, nil
+}
+
+// parseImageSignature parses the signature in the configured format, with the image-signing trust anchor
+func (a *Agent) parseImageSignature(signature []byte) (imageSignature, error) {
+	if a.imageSignatureFormat() == ImageSignatureMinisign {
+		publicKey, err := os.ReadFile(filepath.Clean(a.GetImageSigningTrustAnchor()))
+		if err != nil {
+			return nil, err
+		}
+		return newMinisignSignature(signature, publicKey)
+	}
+	roots, err := loadCertPool(a.GetImageSigningTrustAnchor())
+	if err != nil {
+		return nil, err
+	}
+	return newCMSSignature(signature, roots)
+}
+
+// downloadSmallFile downloads a file to memory, up to maxImageSignatureSize
+func (a *Agent) downloadSmallFile(ctx context.Context, uri string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := a.downloadHTTPClient().Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			log.Println("[ERROR] Error when closing:", err)
+		}
+	}()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received non 200 response code: %d", response.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxImageSignatureSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxImageSignatureSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxImageSignatureSize)
+	}
+	return body, nil
+}
+
+// cmsSignature is a detached CMS SignedData over the boot image, as created by
+// "openssl cms -sign -binary -in image -signer cert.pem -inkey key.pem -outform DER -out image.p7s".
+// Every signer must chain to the trust anchor.
+type cmsSignature struct {
+	signedData *protocol.SignedData
+	roots      *x509.CertPool
+	digests    map[crypto.Hash]hash.Hash
+}
+
+// newCMSSignature parses a detached CMS signature, in DER or PEM
+func newCMSSignature(signature []byte, roots *x509.CertPool) (*cmsSignature, error) {
+	if block, _ := pem.Decode(signature); block != nil {
+		signature = block.Bytes
+	}
+	ci, err := protocol.ParseContentInfo(signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CMS boot image signature: %w", err)
+	}
+	signedData, err := ci.SignedDataContent()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CMS boot image signature: %w", err)
+	}
+	if signedData.EncapContentInfo.EContent.Bytes != nil {
+		return nil, errors.New("the CMS boot image signature is not detached")
+	}
+	if len(signedData.SignerInfos) == 0 {
+		return nil, errors.New("the CMS boot image signature has no signer")
+	}
+	digests := map[crypto.Hash]hash.Hash{}
+	for _, signerInfo := range signedData.SignerInfos {
+		digestAlgorithm, err := signerInfo.Hash()
+		if err != nil || !digestAlgorithm.Available() {
+			return nil, fmt.Errorf("unsupported CMS boot image signature digest algorithm: %v", signerInfo.DigestAlgorithm.Algorithm)
+		}
+		if _, ok := digests[digestAlgorithm]; !ok {
+			digests[digestAlgorithm] = digestAlgorithm.New()
+		}
+	}
+	return &cmsSignature{signedData: signedData, roots: roots, digests: digests}, nil
+}
+
+// Write hashes the image with the digest algorithm of every signer
+func (s *cmsSignature) Write(p []byte) (int, error) {
+	for _, digest := range s.digests {
+		_, _ = digest.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify verifies the signature of every signer, and that its certificate chains to the trust anchor
+func (s *cmsSignature) verify() error {
+	certs, err := s.signedData.X509Certificates()
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		intermediates.AddCert(cert)
+	}
+	for _, signerInfo := range s.signedData.SignerInfos {
+		if err := s.verifySigner(signerInfo, certs, intermediates); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifySigner verifies the signature of one signer. The signature covers the signed attributes,
+// whose message digest must be the digest of the image.
+func (s *cmsSignature) verifySigner(signerInfo protocol.SignerInfo, certs []*x509.Certificate, intermediates *x509.CertPool) error {
+	if signerInfo.SignedAttrs == nil {
+		// The signature would be over the image itself, which is not kept in memory
+		return errors.New("CMS boot image signatures without signed attributes are not supported")
+	}
+	contentType, err := signerInfo.GetContentTypeAttribute()
+	if err != nil {
+		return err
+	}
+	if !contentType.Equal(s.signedData.EncapContentInfo.EContentType) {
+		return errors.New("the content-type attribute of the CMS boot image signature does not match its content")
+	}
+	messageDigest, err := signerInfo.GetMessageDigestAttribute()
+	if err != nil {
+		return err
+	}
+	digestAlgorithm, _ := signerInfo.Hash()
+	if !bytes.Equal(messageDigest, s.digests[digestAlgorithm].Sum(nil)) {
+		return errors.New("the boot image does not match its CMS signature")
+	}
+	cert, err := signerInfo.FindCertificate(certs)
+	if err != nil {
+		return fmt.Errorf("the CMS boot image signature does not hold its signer certificate: %w", err)
+	}
+	signatureAlgorithm := signerInfo.X509SignatureAlgorithm()
+	if signatureAlgorithm == x509.UnknownSignatureAlgorithm {
+		return errors.New("unsupported CMS boot image signature algorithm")
+	}
+	signedMessage, err := signerInfo.SignedAttrs.MarshaledForVerification()
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignature(signatureAlgorithm, signedMessage, signerInfo.Signature); err != nil {
+		return fmt.Errorf("invalid CMS boot image signature by %s: %w", cert.Subject, err)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         s.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("the CMS boot image signer %s is not trusted: %w", cert.Subject, err)
+	}
+	return nil
+}
+
+// minisignSignature is a prehashed minisign signature over the boot image, as created by
+// "minisign -S -m image", verified against the minisign public key
+type minisignSignature struct {
+	publicKey       ed25519.PublicKey
+	signature       []byte
+	trustedComment  string
+	globalSignature []byte
+	digest          hash.Hash
+}
+
+// newMinisignSignature parses a minisign signature, and checks that it was made by the public key
+func newMinisignSignature(signature []byte, publicKeyFile []byte) (*minisignSignature, error) {
+	keyID, publicKey, err := parseMinisignPublicKey(publicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "untrusted comment:") || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return nil, errors.New("invalid minisign boot image signature")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(decoded) != 2+8+ed25519.SignatureSize {
+		return nil, errors.New("invalid minisign boot image signature")
+	}
+	if string(decoded[:2]) != "ED" {
+		return nil, errors.New("the minisign boot image signature is not prehashed, sign the image with minisign -H")
+	}
+	if !bytes.Equal(decoded[2:10], keyID) {
+		return nil, fmt.Errorf("the minisign boot image signature was made by the key %016X instead of %016X",
+			binary.LittleEndian.Uint64(decoded[2:10]), binary.LittleEndian.Uint64(keyID))
+	}
+	globalSignature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSignature) != ed25519.SignatureSize {
+		return nil, errors.New("invalid minisign boot image signature")
+	}
+	digest, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &minisignSignature{
+		publicKey:       publicKey,
+		signature:       decoded[10:],
+		trustedComment:  strings.TrimSuffix(strings.TrimPrefix(lines[2], "trusted comment: "), "\r"),
+		globalSignature: globalSignature,
+		digest:          digest,
+	}, nil
+}
+
+// parseMinisignPublicKey parses a minisign public key file, or the base64 encoded key alone
+func parseMinisignPublicKey(publicKeyFile []byte) ([]byte, ed25519.PublicKey, error) {
+	lines := strings.Split(strings.TrimSpace(string(publicKeyFile)), "\n")
+	encoded := strings.TrimSpace(lines[len(lines)-1])
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(decoded) != 2+8+ed25519.PublicKeySize || string(decoded[:2]) != "Ed" {
+		return nil, nil, errors.New("invalid minisign public key")
+	}
+	return decoded[2:10], ed25519.PublicKey(decoded[10:]), nil
+}
+
+// Write hashes the image with BLAKE2b-512
+func (s *minisignSignature) Write(p []byte) (int, error) {
+	return s.digest.Write(p)
+}
+
+// verify verifies the signature of the image digest, and the signature of the trusted comment
+func (s *minisignSignature) verify() error {
+	if !ed25519.Verify(s.publicKey, s.digest.Sum(nil), s.signature) {
+		return errors.New("the boot image does not match its minisign signature")
+	}
+	if !ed25519.Verify(s.publicKey, append(append([]byte{}, s.signature...), s.trustedComment...), s.globalSignature) {
+		return errors.New("invalid trusted comment in the minisign boot image signature")
+	}
+	log.Println("[INFO] Minisign trusted comment: " + s.trustedComment)
+	return nil
+}
@@ -0,0 +1,233 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cms "github.com/github/smimesign/ietf-cms"
+	"golang.org/x/crypto/blake2b"
+)
+
+func newTestCMSSignature(t *testing.T, image []byte, cert *x509.Certificate, key crypto.Signer) []byte {
+	t.Helper()
+	signature, err := cms.SignDetached(image, []*x509.Certificate{cert}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// newTestMinisignKey returns a minisign public key file and its private key
+func newTestMinisignKey(t *testing.T, keyID string) (string, ed25519.PrivateKey) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := append([]byte("Ed"+keyID), publicKey...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(key) + "\n", privateKey
+}
+
+// newTestMinisignSignature returns a prehashed minisign signature
+func newTestMinisignSignature(image []byte, keyID string, privateKey ed25519.PrivateKey, trustedComment string) []byte {
+	digest := blake2b.Sum512(image)
+	signature := ed25519.Sign(privateKey, digest[:])
+	globalSignature := ed25519.Sign(privateKey, append(append([]byte{}, signature...), trustedComment...))
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append([]byte("ED"+keyID), signature...)) + "\n" +
+		"trusted comment: " + trustedComment + "\n" +
+		base64.StdEncoding.EncodeToString(globalSignature) + "\n")
+}
+
+//nolint:funlen
+func TestAgent_downloadAndValidateImageSignature(t *testing.T) {
+	image := []byte("boot image")
+	root, rootKey := newTestCertificate(t, "image signing root", nil, nil)
+	signer, signerKey := newTestCertificate(t, "image signer", root, rootKey)
+	untrusted, untrustedKey := newTestCertificate(t, "untrusted signer", nil, nil)
+	rootPEM := writeTestCertificatePEM(t, root)
+	publicKey, privateKey := newTestMinisignKey(t, "01234567")
+	_, otherPrivateKey := newTestMinisignKey(t, "76543210")
+	minisignPublicKey := filepath.Join(t.TempDir(), "minisign.pub")
+	if err := os.WriteFile(minisignPublicKey, []byte(publicKey), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var files map[string][]byte
+	var requested []string
+	var reports []ProgressJSON
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		if r.URL.Path == "/report-progress" {
+			var progress ProgressJSON
+			_ = json.NewDecoder(r.Body).Decode(&progress)
+			reports = append(reports, progress)
+			return
+		}
+		content, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	defer svr.Close()
+	sum := sha256.Sum256(image)
+
+	tests := []struct {
+		name        string
+		format      string
+		trustAnchor string
+		files       map[string][]byte
+		wantErr     string
+	}{
+		{
+			name:   "no trust anchor",
+			format: ImageSignatureCMS,
+		},
+		{
+			name:        "cms",
+			format:      ImageSignatureCMS,
+			trustAnchor: rootPEM,
+			files:       map[string][]byte{"/image.img.p7s": newTestCMSSignature(t, image, signer, signerKey)},
+		},
+		{
+			name:        "cms untrusted signer",
+			format:      ImageSignatureCMS,
+			trustAnchor: rootPEM,
+			files:       map[string][]byte{"/image.img.p7s": newTestCMSSignature(t, image, untrusted, untrustedKey)},
+			wantErr:     "the CMS boot image signer CN=untrusted signer is not trusted",
+		},
+		{
+			name:        "cms other image",
+			format:      ImageSignatureCMS,
+			trustAnchor: rootPEM,
+			files:       map[string][]byte{"/image.img.p7s": newTestCMSSignature(t, []byte("other image"), signer, signerKey)},
+			wantErr:     "boot image " + svr.URL + "/image.img: the boot image does not match its CMS signature",
+		},
+		{
+			name:        "cms missing signature",
+			format:      ImageSignatureCMS,
+			trustAnchor: rootPEM,
+			wantErr:     "downloading the boot image signature " + svr.URL + "/image.img.p7s: received non 200 response code: 404",
+		},
+		{
+			name:        "minisign",
+			format:      ImageSignatureMinisign,
+			trustAnchor: minisignPublicKey,
+			files:       map[string][]byte{"/image.img.minisig": newTestMinisignSignature(image, "01234567", privateKey, "timestamp:1700000000\tfile:image.img")},
+		},
+		{
+			name:        "minisign other key",
+			format:      ImageSignatureMinisign,
+			trustAnchor: minisignPublicKey,
+			files:       map[string][]byte{"/image.img.minisig": newTestMinisignSignature(image, "76543210", otherPrivateKey, "timestamp:1700000000\tfile:image.img")},
+			wantErr:     "the minisign boot image signature was made by the key 3031323334353637 instead of 3736353433323130",
+		},
+		{
+			name:        "minisign other image",
+			format:      ImageSignatureMinisign,
+			trustAnchor: minisignPublicKey,
+			files:       map[string][]byte{"/image.img.minisig": newTestMinisignSignature([]byte("other image"), "01234567", privateKey, "timestamp:1700000000\tfile:image.img")},
+			wantErr:     "the boot image does not match its minisign signature",
+		},
+		{
+			name:        "minisign forged trusted comment",
+			format:      ImageSignatureMinisign,
+			trustAnchor: minisignPublicKey,
+			files: map[string][]byte{"/image.img.minisig": []byte(strings.Replace(string(newTestMinisignSignature(image, "01234567", privateKey, "timestamp:1700000000\tfile:image.img")),
+				"file:image.img", "file:other.img", 1))},
+			wantErr: "invalid trusted comment in the minisign boot image signature",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files = map[string][]byte{"/image.img": image}
+			for path, content := range tt.files {
+				files[path] = content
+			}
+			requested = nil
+			reports = nil
+			dir := t.TempDir()
+			a := &Agent{
+				BootstrapURL:   svr.URL + "/get-bootstrapping-data",
+				StatusFilePath: filepath.Join(dir, "status.json"),
+				ResultFilePath: filepath.Join(dir, "result.json"),
+				HttpClient:     &http.Client{},
+			}
+			a.SetImageSigningTrustAnchor(tt.trustAnchor)
+			a.SetImageSignatureFormat(tt.format)
+			bootImage := &a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.BootImage
+			bootImage.DownloadURI = []string{svr.URL + "/image.img"}
+			if err := json.Unmarshal([]byte("["+imageVerification(HashAlgorithmSHA256, sum[:])+"]"), &bootImage.ImageVerification); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(a.imageCachePath())
+
+			err := a.downloadAndValidateImage(context.Background())
+			var bootImageErrors []string
+			for _, report := range reports {
+				if report.IetfSztpBootstrapServerInput.ProgressType == "boot-image-error" {
+					bootImageErrors = append(bootImageErrors, report.IetfSztpBootstrapServerInput.Message)
+				}
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("downloadAndValidateImage() error = %v", err)
+				}
+				if len(bootImageErrors) != 0 {
+					t.Errorf("boot-image-error reported: %q", bootImageErrors)
+				}
+				if tt.trustAnchor == "" && strings.Contains(strings.Join(requested, " "), "/image.img.") {
+					t.Errorf("requested %q, want the signature not downloaded", requested)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("downloadAndValidateImage() error = %v, want %q", err, tt.wantErr)
+			}
+			if len(bootImageErrors) != 1 || bootImageErrors[0] != err.Error() {
+				t.Errorf("boot-image-error reported = %q, want %q", bootImageErrors, err.Error())
+			}
+			if _, err := os.Stat(a.imageCachePath()); !os.IsNotExist(err) {
+				t.Errorf("image failing the signature verification not removed: %v", err)
+			}
+		})
+	}
+}
+
+func Test_parseMinisignPublicKey(t *testing.T) {
+	publicKey, privateKey := newTestMinisignKey(t, "01234567")
+	keyID, key, err := parseMinisignPublicKey([]byte(publicKey))
+	if err != nil {
+		t.Fatalf("parseMinisignPublicKey() error = %v", err)
+	}
+	if string(keyID) != "01234567" || !key.Equal(privateKey.Public()) {
+		t.Errorf("parseMinisignPublicKey() = %s, %s, want 01234567, %s", keyID, hex.EncodeToString(key), hex.EncodeToString(privateKey.Public().(ed25519.PublicKey)))
+	}
+	// The base64 encoded key alone
+	lines := strings.Split(strings.TrimSpace(publicKey), "\n")
+	if _, _, err := parseMinisignPublicKey([]byte(lines[1])); err != nil {
+		t.Errorf("parseMinisignPublicKey() error = %v", err)
+	}
+	if _, _, err := parseMinisignPublicKey([]byte("untrusted comment: minisign public key\nRWQ=")); err == nil {
+		t.Error("parseMinisignPublicKey() accepted a truncated key")
+	}
+}
@@ -0,0 +1,465 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/opiproject/sztp/sztp-agent/pkg/dhcp"
+	"github.com/opiproject/sztp/sztp-agent/pkg/dns"
+)
+
+// The names of the bootstrap sources
+const (
+	BootstrapSourceURL            = "bootstrap-url"
+	BootstrapSourceLeaseFile      = "dhcp-lease-file"
+	BootstrapSourceDhcpClient     = "dhcp-client"
+	BootstrapSourceNetworkManager = "network-manager"
+	BootstrapSourceDNS            = "dns"
+)
+
+// BootstrapSource discovers bootstrap server URLs. The agent queries its sources in order and
+// tries the URLs of the first sources first.
+type BootstrapSource interface {
+	// Name identifies the source in the status file
+	Name() string
+	// BootstrapURLs returns the bootstrap URLs, in the order they should be tried
+	BootstrapURLs(ctx context.Context) ([]string, error)
+}
+
+// WatchedBootstrapSource is a BootstrapSource that notifies when its bootstrap URLs change, so that
+// the daemon retries with them right away
+type WatchedBootstrapSource interface {
+	BootstrapSource
+	// Watch notifies each time the bootstrap URLs change, until ctx is done
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
+// BootstrappingDataSource is a BootstrapSource that may also provide the bootstrapping data itself,
+// without a bootstrap server
+type BootstrappingDataSource interface {
+	BootstrapSource
+	// BootstrappingData returns the bootstrapping data, in the order it should be tried
+	BootstrappingData(ctx context.Context) ([]BootstrappingData, error)
+}
+
+// BootstrappingData is bootstrapping data provided without a bootstrap server, the DER encoded artifacts
+type BootstrappingData struct {
+	ConveyedInformation []byte
+	OwnerCertificate    []byte
+	OwnershipVoucher    []byte
+}
+
+// DiscoveredBootstrapURL is a bootstrap URL along with the source that discovered it
+type DiscoveredBootstrapURL struct {
+	URL    string `json:"url"`
+	Source string `json:"source"`
+}
+
+// URLSource is a bootstrap URL given by the user
+type URLSource struct {
+	URL string
+}
+
+// Name identifies the source in the status file
+func (s *URLSource) Name() string {
+	return BootstrapSourceURL
+}
+
+// BootstrapURLs returns the bootstrap URL given by the user
+func (s *URLSource) BootstrapURLs(_ context.Context) ([]string, error) {
+	log.Println("[INFO] User gave us the Bootstrap URL: " + s.URL)
+	return []string{s.URL}, nil
+}
+
+// LeaseFileSource reads the sztp-redirect-urls option of dhclient lease files
+type LeaseFileSource struct {
+	LeaseFiles        []string // DHCPv4 and DHCPv6 lease files, their URLs are merged
+	InterfacePriority []string // Interfaces whose leases are tried first, in order
+}
+
+// Name identifies the source in the status file
+func (s *LeaseFileSource) Name() string {
+	return BootstrapSourceLeaseFile
+}
+
+// BootstrapURLs returns the URLs of the lease files, most recent leases first
+func (s *LeaseFileSource) BootstrapURLs(_ context.Context) ([]string, error) {
+	var candidates []dhcp.BootstrapURL
+	for _, leaseFile := range s.LeaseFiles {
+		log.Println("[INFO] User gave us the DHCP Lease File: " + leaseFile)
+		leaseCandidates, err := dhcp.GetBootstrapURLCandidatesViaLeaseFile(leaseFile, SZTP_REDIRECT_URL)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, leaseCandidates...)
+	}
+	urls := dhcp.SortBootstrapURLs(candidates, s.InterfacePriority)
+	if len(urls) == 0 {
+		return nil, errors.New("no bootstrap URL found in the DHCP lease files")
+	}
+	return urls, nil
+}
+
+// Watch notifies when a new lease changes the URLs of the lease files
+func (s *LeaseFileSource) Watch(ctx context.Context) (<-chan struct{}, error) {
+	changes := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, leaseFile := range s.LeaseFiles {
+		updates, err := dhcp.WatchLeaseFile(ctx, leaseFile, SZTP_REDIRECT_URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to watch %s: %w", leaseFile, err)
+		}
+		wg.Add(1)
+		go func(leaseFile string) {
+			defer wg.Done()
+			for urls := range updates {
+				log.Printf("[INFO] New lease in %s with the Bootstrap URLs: %v", leaseFile, dhcp.SortBootstrapURLs(urls, s.InterfacePriority))
+				select {
+				case changes <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(leaseFile)
+	}
+	go func() {
+		wg.Wait()
+		close(changes)
+	}()
+	return changes, nil
+}
+
+// DhcpClientSource requests the sztp-redirect-urls option with the built-in DHCP client
+type DhcpClientSource struct {
+	Interface string        // The interface to send the requests on
+	Timeout   time.Duration // Bounds the DHCP exchange
+}
+
+// Name identifies the source in the status file
+func (s *DhcpClientSource) Name() string {
+	return BootstrapSourceDhcpClient
+}
+
+// BootstrapURLs returns the URLs of the DHCPACK
+func (s *DhcpClientSource) BootstrapURLs(ctx context.Context) ([]string, error) {
+	log.Println("[INFO] Requesting the Bootstrap URL with the built-in DHCP client on " + s.Interface)
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	candidates, err := dhcp.RequestBootstrapURLs(ctx, s.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request the bootstrap URL on %s: %w", s.Interface, err)
+	}
+	urls := dhcp.SortBootstrapURLs(candidates, nil)
+	if len(urls) == 0 {
+		return nil, errors.New("no bootstrap URL offered on " + s.Interface)
+	}
+	return urls, nil
+}
+
+// NetworkManagerSource reads the sztp-redirect-urls option of the leases of Network Manager over D-Bus
+type NetworkManagerSource struct {
+	Timeout           time.Duration // How long to wait for a lease carrying the option, 0 to not wait
+	InterfacePriority []string      // Interfaces whose leases are tried first, in order
+}
+
+// Name identifies the source in the status file
+func (s *NetworkManagerSource) Name() string {
+	return BootstrapSourceNetworkManager
+}
+
+// BootstrapURLs returns the URLs of the active connections, waiting for a lease when there is none yet
+func (s *NetworkManagerSource) BootstrapURLs(ctx context.Context) ([]string, error) {
+	log.Println("[INFO] Discovering the Bootstrap URL from Network Manager via dbus")
+	nm, err := dhcp.ConnectNetworkManager()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Network Manager: %w", err)
+	}
+	defer func() { _ = nm.Close() }()
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	candidates, updates, err := nm.WatchBootstrapURLs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch Network Manager: %w", err)
+	}
+	urls := dhcp.SortBootstrapURLs(candidates, s.InterfacePriority)
+	for len(urls) == 0 {
+		log.Println("[INFO] No Bootstrap URL in the Network Manager leases yet, waiting for a new lease")
+		select {
+		case candidates, ok := <-updates:
+			if !ok {
+				return nil, errors.New("no bootstrap URL received from Network Manager within " + s.Timeout.String())
+			}
+			urls = dhcp.SortBootstrapURLs(candidates, s.InterfacePriority)
+		case <-ctx.Done():
+			return nil, errors.New("no bootstrap URL received from Network Manager within " + s.Timeout.String())
+		}
+	}
+	return urls, nil
+}
+
+// DNSSource queries the _sztp records of the local domains over unicast DNS and mDNS, the SRV
+// records for the bootstrap servers and the TXT records for the bootstrapping data
+type DNSSource struct {
+	ResolvConf   string        // The unicast DNS configuration, mDNS only when it cannot be read
+	SerialNumber string        // Names the device-specific records
+	Timeout      time.Duration // Bounds the queries
+}
+
+// Name identifies the source in the status file
+func (s *DNSSource) Name() string {
+	return BootstrapSourceDNS
+}
+
+// BootstrapURLs returns the URLs of the bootstrap servers of the SRV records
+func (s *DNSSource) BootstrapURLs(ctx context.Context) ([]string, error) {
+	log.Println("[INFO] Discovering the Bootstrap URL via DNS")
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	servers, err := s.resolver().GetBootstrapServers(ctx, s.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, 0, len(servers))
+	for _, server := range servers {
+		urls = append(urls, "https://"+server+BOOTSTRAP_PATH)
+	}
+	return urls, nil
+}
+
+// BootstrappingData returns the bootstrapping data of the TXT records
+func (s *DNSSource) BootstrappingData(ctx context.Context) ([]BootstrappingData, error) {
+	log.Println("[INFO] Discovering the bootstrapping data via DNS")
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	records, err := s.resolver().GetBootstrappingData(ctx, s.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]BootstrappingData, 0, len(records))
+	for _, record := range records {
+		data = append(data, BootstrappingData(record))
+	}
+	return data, nil
+}
+
+func (s *DNSSource) resolver() *dns.Resolver {
+	resolver, err := dns.NewResolver(s.ResolvConf)
+	if err != nil {
+		log.Println("[WARNING] No unicast DNS configuration, using mDNS only:", err)
+		return &dns.Resolver{Multicast: dns.MulticastAddress}
+	}
+	return resolver
+}
+
+// DefaultBootstrapSources returns the sources selected by the agent options: the bootstrap URL
+// given by the user alone, or a DHCP source followed by DNS when enabled. Integrators can
+// extend it and register the result with SetBootstrapSources.
+func (a *Agent) DefaultBootstrapSources() []BootstrapSource {
+	if a.InputBootstrapURL != "" {
+		return []BootstrapSource{&URLSource{URL: a.InputBootstrapURL}}
+	}
+	var sources []BootstrapSource
+	switch {
+	case a.DhcpLeaseFile != "" || a.Dhcp6LeaseFile != "":
+		source := &LeaseFileSource{InterfacePriority: a.GetDhcpInterfacePriority()}
+		for _, leaseFile := range []string{a.DhcpLeaseFile, a.Dhcp6LeaseFile} {
+			if leaseFile != "" {
+				source.LeaseFiles = append(source.LeaseFiles, leaseFile)
+			}
+		}
+		sources = append(sources, source)
+	case a.DhcpClientInterface != "":
+		sources = append(sources, &DhcpClientSource{Interface: a.DhcpClientInterface, Timeout: DHCP_CLIENT_TIMEOUT})
+	default:
+		source := &NetworkManagerSource{Timeout: DBUS_LEASE_TIMEOUT, InterfacePriority: a.GetDhcpInterfacePriority()}
+		if a.DnsDiscovery {
+			// DNS may provide the Bootstrap URLs, do not wait for a lease
+			source.Timeout = 0
+		}
+		sources = append(sources, source)
+	}
+	if a.DnsDiscovery {
+		sources = append(sources, &DNSSource{ResolvConf: dns.ResolvConf, SerialNumber: a.GetSerialNumber(), Timeout: DNS_DISCOVERY_TIMEOUT})
+	}
+	return sources
+}
+
+// NamedBootstrapSources returns the sources of the given names, in the same order, configured
+// from the agent options. Network Manager only waits for a lease when it is the last source.
+func (a *Agent) NamedBootstrapSources(names []string) ([]BootstrapSource, error) {
+	sources := make([]BootstrapSource, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for i, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("the %s bootstrap source is given twice", name)
+		}
+		seen[name] = true
+		switch name {
+		case BootstrapSourceURL:
+			if a.InputBootstrapURL == "" {
+				return nil, fmt.Errorf("the %s bootstrap source requires a bootstrap URL", name)
+			}
+			sources = append(sources, &URLSource{URL: a.InputBootstrapURL})
+		case BootstrapSourceLeaseFile:
+			source := &LeaseFileSource{InterfacePriority: a.GetDhcpInterfacePriority()}
+			for _, leaseFile := range []string{a.DhcpLeaseFile, a.Dhcp6LeaseFile} {
+				if leaseFile != "" {
+					source.LeaseFiles = append(source.LeaseFiles, leaseFile)
+				}
+			}
+			if len(source.LeaseFiles) == 0 {
+				return nil, fmt.Errorf("the %s bootstrap source requires a DHCP lease file", name)
+			}
+			sources = append(sources, source)
+		case BootstrapSourceDhcpClient:
+			if a.DhcpClientInterface == "" {
+				return nil, fmt.Errorf("the %s bootstrap source requires a DHCP client interface", name)
+			}
+			sources = append(sources, &DhcpClientSource{Interface: a.DhcpClientInterface, Timeout: DHCP_CLIENT_TIMEOUT})
+		case BootstrapSourceNetworkManager:
+			source := &NetworkManagerSource{InterfacePriority: a.GetDhcpInterfacePriority()}
+			if i == len(names)-1 {
+				source.Timeout = DBUS_LEASE_TIMEOUT
+			}
+			sources = append(sources, source)
+		case BootstrapSourceDNS:
+			sources = append(sources, &DNSSource{ResolvConf: dns.ResolvConf, SerialNumber: a.GetSerialNumber(), Timeout: DNS_DISCOVERY_TIMEOUT})
+		default:
+			return nil, fmt.Errorf("unknown bootstrap source %q", name)
+		}
+	}
+	return sources, nil
+}
+
+// bootstrapSources returns the registered bootstrap sources, or the default ones
+func (a *Agent) bootstrapSources() []BootstrapSource {
+	if sources := a.GetBootstrapSources(); len(sources) > 0 {
+		return sources
+	}
+	return a.DefaultBootstrapSources()
+}
+
+// watchBootstrapSources merges the notifications of the sources that can be watched. A change
+// happening while the bootstrap sequence runs is kept until the next wait.
+func (a *Agent) watchBootstrapSources(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	for _, source := range a.bootstrapSources() {
+		watched, ok := source.(WatchedBootstrapSource)
+		if !ok {
+			continue
+		}
+		sourceChanges, err := watched.Watch(ctx)
+		if err != nil {
+			log.Printf("[WARNING] Cannot watch the bootstrap source %s: %v", source.Name(), err)
+			continue
+		}
+		go func() {
+			for range sourceChanges {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}()
+	}
+	return changes
+}
+
+// loadSourcesBootstrappingData tries the bootstrapping data provided by the bootstrap sources
+// themselves, in order. Like on removable storage, nothing authenticates its origin, so the
+// conveyed-information must be signed by the owner. It returns false when there is no valid one,
+// the bootstrap servers are requested instead.
+func (a *Agent) loadSourcesBootstrappingData(ctx context.Context) bool {
+	for _, source := range a.bootstrapSources() {
+		dataSource, ok := source.(BootstrappingDataSource)
+		if !ok {
+			continue
+		}
+		candidates, err := dataSource.BootstrappingData(ctx)
+		if ctx.Err() != nil {
+			return false
+		}
+		if err != nil {
+			log.Printf("[WARNING] Bootstrap source %s failed to provide bootstrapping data: %v", source.Name(), err)
+			continue
+		}
+		for _, data := range candidates {
+			if err := requireSignedConveyedInformation(data.ConveyedInformation, source.Name()+" conveyed-information"); err != nil {
+				log.Printf("[WARNING] Ignoring the bootstrapping data of the bootstrap source %s: %v", source.Name(), err)
+				continue
+			}
+			_ = a.updateAndSaveStatus(StageTypeBootstrap, true, "")
+			err := a.processBootstrappingData(data.ConveyedInformation,
+				base64.StdEncoding.EncodeToString(data.OwnershipVoucher),
+				base64.StdEncoding.EncodeToString(data.OwnerCertificate))
+			if err != nil {
+				log.Printf("[WARNING] Ignoring the bootstrapping data of the bootstrap source %s: %v", source.Name(), err)
+				continue
+			}
+			log.Printf("[INFO] Bootstrapping data from the bootstrap source %s verified successfully", source.Name())
+			return true
+		}
+	}
+	return false
+}
+
+// discoverBootstrapURLs queries every bootstrap source in order and merges their URLs. A failing
+// source does not prevent the others from providing URLs.
+func (a *Agent) discoverBootstrapURLs(ctx context.Context) error {
+	log.Println("[INFO] Discovering the Bootstrap URL")
+	sources := a.bootstrapSources()
+	var discovered []DiscoveredBootstrapURL
+	seen := make(map[string]bool)
+	var lastErr error
+	for _, source := range sources {
+		urls, err := source.BootstrapURLs(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Printf("[WARNING] Bootstrap source %s failed: %v", source.Name(), err)
+			lastErr = fmt.Errorf("bootstrap source %s: %w", source.Name(), err)
+			continue
+		}
+		for _, u := range urls {
+			if u == "" || seen[u] {
+				continue
+			}
+			seen[u] = true
+			discovered = append(discovered, DiscoveredBootstrapURL{URL: u, Source: source.Name()})
+		}
+	}
+	if len(discovered) == 0 {
+		if lastErr != nil {
+			return lastErr
+		}
+		return errors.New("no bootstrap URL discovered")
+	}
+	a.setDiscoveredBootstrapURLs(discovered)
+	log.Printf("[INFO] Bootstrap URLs retrieved successfully: %v", discovered)
+	return nil
+}
+
+// setDiscoveredBootstrapURLs stores the bootstrap URLs to try and makes them visible in the status
+func (a *Agent) setDiscoveredBootstrapURLs(discovered []DiscoveredBootstrapURL) {
+	urls := make([]string, 0, len(discovered))
+	for _, d := range discovered {
+		urls = append(urls, d.URL)
+	}
+	a.SetBootstrapURLs(urls)
+	a.SetBootstrapURL(urls[0])
+	_ = a.updateAndSaveBootstrapURLs(discovered)
+}
@@ -0,0 +1,333 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testBootstrapSource stands in for an integrator's source, such as a BMC
+type testBootstrapSource struct {
+	name string
+	urls []string
+	err  error
+}
+
+func (s *testBootstrapSource) Name() string {
+	return s.name
+}
+
+func (s *testBootstrapSource) BootstrapURLs(_ context.Context) ([]string, error) {
+	return s.urls, s.err
+}
+
+// testBootstrappingDataSource stands in for a source providing the bootstrapping data, such as DNS
+type testBootstrappingDataSource struct {
+	testBootstrapSource
+	data    []BootstrappingData
+	dataErr error
+}
+
+func (s *testBootstrappingDataSource) BootstrappingData(_ context.Context) ([]BootstrappingData, error) {
+	return s.data, s.dataErr
+}
+
+//nolint:funlen
+func TestAgent_loadSourcesBootstrappingData(t *testing.T) {
+	manufacturerCert, manufacturerKey := newTestCertificate(t, "manufacturer", nil, nil)
+	ownerCert, ownerKey := newTestCertificate(t, "owner", nil, nil)
+	signed := BootstrappingData{
+		ConveyedInformation: newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ownerCert, ownerKey),
+		OwnerCertificate:    decodeTestBase64(t, newTestCertificateBundle(t, ownerCert)),
+		OwnershipVoucher:    decodeTestBase64(t, newTestOwnershipVoucher(t, newTestVoucher("my-serial-number", ownerCert), manufacturerCert, manufacturerKey)),
+	}
+	unsigned := signed
+	unsigned.ConveyedInformation = newTestContentInfo(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation))
+	withoutVoucher := signed
+	withoutVoucher.OwnershipVoucher = nil
+
+	tests := []struct {
+		name    string
+		sources []BootstrapSource
+		want    bool
+	}{
+		{
+			name:    "no source provides bootstrapping data",
+			sources: []BootstrapSource{&testBootstrapSource{name: "url", urls: []string{"https://bootstrap.example.com"}}},
+		},
+		{
+			name: "invalid bootstrapping data is skipped",
+			sources: []BootstrapSource{
+				&testBootstrappingDataSource{testBootstrapSource: testBootstrapSource{name: "failing"}, dataErr: errors.New("unreachable")},
+				&testBootstrappingDataSource{testBootstrapSource: testBootstrapSource{name: "dns"}, data: []BootstrappingData{unsigned, withoutVoucher, signed}},
+			},
+			want: true,
+		},
+		{
+			name: "only invalid bootstrapping data",
+			sources: []BootstrapSource{
+				&testBootstrappingDataSource{testBootstrapSource: testBootstrapSource{name: "dns"}, data: []BootstrappingData{unsigned, withoutVoucher}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a := &Agent{
+				SerialNumber:                "my-serial-number",
+				ManufacturerTrustAnchorCert: writeTestCertificatePEM(t, manufacturerCert),
+				BootstrapSources:            tt.sources,
+				StatusFilePath:              filepath.Join(dir, "status.json"),
+				ResultFilePath:              filepath.Join(dir, "result.json"),
+			}
+			if got := a.loadSourcesBootstrappingData(context.Background()); got != tt.want {
+				t.Fatalf("loadSourcesBootstrappingData() = %v, want %v", got, tt.want)
+			}
+			configuration := a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.Configuration
+			if tt.want && configuration != "dGVzdA==" {
+				t.Errorf("loadSourcesBootstrappingData() got unexpected onboarding information %v", a.BootstrapServerOnboardingInfo)
+			}
+			if !tt.want && configuration != "" {
+				t.Errorf("loadSourcesBootstrappingData() kept the onboarding information of invalid data %v", a.BootstrapServerOnboardingInfo)
+			}
+		})
+	}
+}
+
+//nolint:funlen
+func TestAgent_discoverBootstrapURLsSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []BootstrapSource
+		want    []DiscoveredBootstrapURL
+		wantErr bool
+	}{
+		{
+			name: "sources queried in order without duplicates",
+			sources: []BootstrapSource{
+				&testBootstrapSource{name: "bmc", urls: []string{"https://bmc/1", "https://shared"}},
+				&URLSource{URL: "https://user"},
+				&testBootstrapSource{name: "ipmi-fru", urls: []string{"https://shared", "https://fru/1"}},
+			},
+			want: []DiscoveredBootstrapURL{
+				{URL: "https://bmc/1", Source: "bmc"},
+				{URL: "https://shared", Source: "bmc"},
+				{URL: "https://user", Source: "bootstrap-url"},
+				{URL: "https://fru/1", Source: "ipmi-fru"},
+			},
+		},
+		{
+			name: "failing source skipped",
+			sources: []BootstrapSource{
+				&testBootstrapSource{name: "bmc", err: errors.New("BMC unreachable")},
+				&testBootstrapSource{name: "ipmi-fru", urls: []string{"https://fru/1"}},
+			},
+			want: []DiscoveredBootstrapURL{{URL: "https://fru/1", Source: "ipmi-fru"}},
+		},
+		{
+			name: "every source failing",
+			sources: []BootstrapSource{
+				&testBootstrapSource{name: "bmc", err: errors.New("BMC unreachable")},
+				&LeaseFileSource{LeaseFiles: []string{"/kk/kk"}},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "no URL from any source",
+			sources: []BootstrapSource{&testBootstrapSource{name: "bmc"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a := &Agent{
+				StatusFilePath: filepath.Join(dir, "status.json"),
+				ResultFilePath: filepath.Join(dir, "result.json"),
+			}
+			a.SetBootstrapSources(tt.sources)
+			err := a.discoverBootstrapURLs(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("discoverBootstrapURLs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if a.GetBootstrapURL() != tt.want[0].URL {
+				t.Errorf("discoverBootstrapURLs() bootstrap URL = %v, want %v", a.GetBootstrapURL(), tt.want[0].URL)
+			}
+			status, err := a.getCurrStatus()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(status.BootstrapURLs, tt.want) {
+				t.Errorf("status bootstrap-urls = %v, want %v", status.BootstrapURLs, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgent_DefaultBootstrapSources(t *testing.T) {
+	tests := []struct {
+		name  string
+		agent *Agent
+		want  []BootstrapSource
+	}{
+		{
+			name:  "bootstrap URL given by the user",
+			agent: &Agent{InputBootstrapURL: "https://user", DhcpLeaseFile: "/var/lib/dhclient/dhclient.leases", DnsDiscovery: true},
+			want:  []BootstrapSource{&URLSource{URL: "https://user"}},
+		},
+		{
+			name:  "lease files",
+			agent: &Agent{DhcpLeaseFile: "/dhclient.leases", Dhcp6LeaseFile: "/dhclient6.leases", DhcpInterfacePriority: []string{"eth1"}},
+			want: []BootstrapSource{
+				&LeaseFileSource{LeaseFiles: []string{"/dhclient.leases", "/dhclient6.leases"}, InterfacePriority: []string{"eth1"}},
+			},
+		},
+		{
+			name:  "built-in DHCP client then DNS",
+			agent: &Agent{DhcpClientInterface: "eth0", DnsDiscovery: true, SerialNumber: "SN1234"},
+			want: []BootstrapSource{
+				&DhcpClientSource{Interface: "eth0", Timeout: DHCP_CLIENT_TIMEOUT},
+				&DNSSource{ResolvConf: "/etc/resolv.conf", SerialNumber: "SN1234", Timeout: DNS_DISCOVERY_TIMEOUT},
+			},
+		},
+		{
+			name:  "Network Manager",
+			agent: &Agent{},
+			want:  []BootstrapSource{&NetworkManagerSource{Timeout: DBUS_LEASE_TIMEOUT}},
+		},
+		{
+			name:  "Network Manager without waiting for a lease then DNS",
+			agent: &Agent{DnsDiscovery: true},
+			want: []BootstrapSource{
+				&NetworkManagerSource{},
+				&DNSSource{ResolvConf: "/etc/resolv.conf", Timeout: DNS_DISCOVERY_TIMEOUT},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.agent.DefaultBootstrapSources(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DefaultBootstrapSources() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgent_NamedBootstrapSources(t *testing.T) {
+	agent := &Agent{
+		InputBootstrapURL:     "https://user",
+		DhcpLeaseFile:         "/dhclient.leases",
+		DhcpClientInterface:   "eth0",
+		DhcpInterfacePriority: []string{"eth1"},
+		SerialNumber:          "SN1234",
+	}
+	tests := []struct {
+		name    string
+		agent   *Agent
+		names   []string
+		want    []BootstrapSource
+		wantErr bool
+	}{
+		{
+			name:  "ordered sources",
+			agent: agent,
+			names: []string{"dns", "bootstrap-url", "dhcp-lease-file", "dhcp-client"},
+			want: []BootstrapSource{
+				&DNSSource{ResolvConf: "/etc/resolv.conf", SerialNumber: "SN1234", Timeout: DNS_DISCOVERY_TIMEOUT},
+				&URLSource{URL: "https://user"},
+				&LeaseFileSource{LeaseFiles: []string{"/dhclient.leases"}, InterfacePriority: []string{"eth1"}},
+				&DhcpClientSource{Interface: "eth0", Timeout: DHCP_CLIENT_TIMEOUT},
+			},
+		},
+		{
+			name:  "Network Manager waits for a lease when it is the last source",
+			agent: &Agent{},
+			names: []string{"dns", "network-manager"},
+			want: []BootstrapSource{
+				&DNSSource{ResolvConf: "/etc/resolv.conf", Timeout: DNS_DISCOVERY_TIMEOUT},
+				&NetworkManagerSource{Timeout: DBUS_LEASE_TIMEOUT},
+			},
+		},
+		{
+			name:  "Network Manager followed by another source",
+			agent: &Agent{},
+			names: []string{"network-manager", "dns"},
+			want: []BootstrapSource{
+				&NetworkManagerSource{},
+				&DNSSource{ResolvConf: "/etc/resolv.conf", Timeout: DNS_DISCOVERY_TIMEOUT},
+			},
+		},
+		{
+			name:    "unknown source",
+			agent:   agent,
+			names:   []string{"dns", "ftp"},
+			wantErr: true,
+		},
+		{
+			name:    "source given twice",
+			agent:   agent,
+			names:   []string{"dns", "dns"},
+			wantErr: true,
+		},
+		{
+			name:    "source without its option",
+			agent:   &Agent{},
+			names:   []string{"dhcp-lease-file"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.agent.NamedBootstrapSources(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NamedBootstrapSources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NamedBootstrapSources() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgent_watchBootstrapSources(t *testing.T) {
+	leaseFile := filepath.Join(t.TempDir(), "dhclient.leases")
+	if err := os.WriteFile(leaseFile, []byte("lease {\n  interface \"eth0\";\n}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a := &Agent{DhcpLeaseFile: leaseFile}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := a.watchBootstrapSources(ctx)
+
+	// Without a change, the whole retry interval is waited
+	start := time.Now()
+	if err := waitForRetry(ctx, changes, 100*time.Millisecond); err != nil {
+		t.Fatalf("waitForRetry() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("waitForRetry() returned after %v without a change", elapsed)
+	}
+
+	lease := "lease {\n  interface \"eth0\";\n  option sztp-redirect-urls \"https://new\";\n}\n"
+	if err := os.WriteFile(leaseFile, []byte(lease), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if err := waitForRetry(ctx, changes, time.Minute); err != nil {
+		t.Fatalf("waitForRetry() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("waitForRetry() returned after %v despite the new lease", elapsed)
+	}
+}
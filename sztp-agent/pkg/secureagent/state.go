@@ -0,0 +1,141 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// BootstrapState is the progress of the bootstrap sequence, persisted in the state file so that the
+// sequence resumes where it stopped, in particular after the device reboots into the installed boot image
+type BootstrapState struct {
+	BootstrapURL    string                        `json:"bootstrap-url,omitempty"`
+	TrustAnchor     string                        `json:"trust-anchor,omitempty"`
+	OnboardingInfo  BootstrapServerOnboardingInfo `json:"onboarding-information"`
+	Stage           string                        `json:"stage"`
+	CompletedStages []string                      `json:"completed-stages"`
+	BootID          string                        `json:"boot-id,omitempty"`
+}
+
+// completed tells whether the stage was completed by a previous run of the bootstrap sequence
+func (s *BootstrapState) completed(stage StageType) bool {
+	for _, completed := range s.CompletedStages {
+		if completed == stage.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingReboot tells whether the boot image was installed and the device was about to reboot
+func (s *BootstrapState) pendingReboot() bool {
+	return s.Stage == StageTypePendingReboot.String()
+}
+
+// rebooted tells whether the device rebooted since the boot image was installed. The boot is
+// assumed to have changed when its identifier is unknown.
+func (s *BootstrapState) rebooted() bool {
+	return s.BootID == "" || s.BootID != currentBootID()
+}
+
+// loadBootstrapState loads the state of a previous bootstrap sequence pending the reboot into the
+// installed boot image. The state is empty when there is none, or when no state file is configured.
+// Any other state is stale, the bootstrap sequence starts from scratch instead.
+func (a *Agent) loadBootstrapState() *BootstrapState {
+	var state BootstrapState
+	if a.GetStateFilePath() == "" {
+		return &state
+	}
+	if err := loadFile(a.GetStateFilePath(), &state); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[WARNING] Ignoring the invalid state file %s: %v", a.GetStateFilePath(), err)
+			a.removeBootstrapState()
+		}
+		return &BootstrapState{}
+	}
+	if !state.pendingReboot() {
+		log.Printf("[WARNING] Ignoring the state file %s not pending a reboot", a.GetStateFilePath())
+		a.removeBootstrapState()
+		return &BootstrapState{}
+	}
+	return &state
+}
+
+// saveBootstrapState persists the state of the bootstrap sequence, with the current onboarding information.
+// The file is only readable by its owner, it holds the decrypted configuration and scripts
+func (a *Agent) saveBootstrapState(state *BootstrapState) error {
+	if a.GetStateFilePath() == "" {
+		return nil
+	}
+	state.BootstrapURL = a.GetBootstrapURL()
+	state.TrustAnchor = a.GetRedirectTrustAnchor()
+	state.OnboardingInfo = a.BootstrapServerOnboardingInfo
+	if err := ensureDirExists(filepath.Dir(a.GetStateFilePath())); err != nil {
+		return err
+	}
+	return saveToFileWithMode(state, a.GetStateFilePath(), 0600)
+}
+
+// completeStage records that the stage is completed. The state is only persisted by prepareReboot, the
+// completed stages are then skipped when the bootstrap sequence resumes after the reboot.
+func (a *Agent) completeStage(state *BootstrapState, stage StageType) {
+	if !state.completed(stage) {
+		state.CompletedStages = append(state.CompletedStages, stage.String())
+	}
+	state.Stage = stage.String()
+}
+
+// resumeBootstrapSequence restores the onboarding information of a previous run of the bootstrap
+// sequence, and the bootstrap server it came from. The state stays pending the reboot when the device
+// did not reboot yet, otherwise it is removed: the bootstrap sequence resumes once, and starts from
+// scratch when it is retried.
+func (a *Agent) resumeBootstrapSequence(state *BootstrapState) {
+	log.Printf("[INFO] Resuming the bootstrap sequence, completed stages: %v", state.CompletedStages)
+	a.SetBootstrapURL(state.BootstrapURL)
+	if state.TrustAnchor != "" {
+		// The progress is reported to the redirect bootstrap server, authenticated by its trust-anchor
+		if err := a.useTrustAnchor(state.TrustAnchor); err != nil {
+			log.Println("[ERROR] Failed to use the redirect trust-anchor: ", err)
+		}
+	}
+	a.BootstrapServerOnboardingInfo = state.OnboardingInfo
+	if state.pendingReboot() && state.rebooted() {
+		log.Println("[INFO] The device rebooted into the installed boot image")
+		_ = a.updateAndSaveStatus(StageTypePendingReboot, false, "")
+		state.Stage = StageTypeBootImage.String()
+		a.removeBootstrapState()
+	}
+}
+
+// prepareReboot records that the bootstrap sequence resumes after the device reboots into the
+// installed boot image, and reports it to the bootstrap server
+func (a *Agent) prepareReboot(ctx context.Context, state *BootstrapState) error {
+	state.Stage = StageTypePendingReboot.String()
+	state.BootID = currentBootID()
+	if err := a.saveBootstrapState(state); err != nil {
+		return err
+	}
+	_ = a.doReportProgress(ctx, ProgressTypeBootImageInstalledRebooting, "BootImage Installed, Rebooting")
+	return a.updateAndSaveStatus(StageTypePendingReboot, true, "")
+}
+
+// removeBootstrapState removes the state once it is resumed, stale or given up, the next bootstrap
+// sequence starts from scratch
+func (a *Agent) removeBootstrapState() {
+	if a.GetStateFilePath() == "" {
+		return
+	}
+	if err := os.Remove(a.GetStateFilePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("[ERROR] Failed to remove the bootstrap state: ", err)
+	}
+}
@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newStateTestAgent(t *testing.T) *Agent {
+	t.Helper()
+	dir := t.TempDir()
+	return &Agent{
+		StatusFilePath: filepath.Join(dir, "status.json"),
+		ResultFilePath: filepath.Join(dir, "result.json"),
+		StateFilePath:  filepath.Join(dir, "state", "state.json"),
+	}
+}
+
+func TestAgent_loadBootstrapState(t *testing.T) {
+	a := newStateTestAgent(t)
+	if got := a.loadBootstrapState(); !reflect.DeepEqual(got, &BootstrapState{}) {
+		t.Errorf("loadBootstrapState() without a state file = %+v, want empty", got)
+	}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer svr.Close()
+	a.HttpClient = &http.Client{}
+	state := &BootstrapState{}
+	a.SetBootstrapURL(svr.URL + "/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data")
+	a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.InfoTimestampReference = "12345678"
+	a.completeStage(state, StageTypeOnboarding)
+	if _, err := os.Stat(a.GetStateFilePath()); !os.IsNotExist(err) {
+		t.Errorf("state file saved before preparing the reboot: %v", err)
+	}
+	a.completeStage(state, StageTypeBootImage)
+	if err := a.prepareReboot(context.Background(), state); err != nil {
+		t.Fatalf("prepareReboot() error = %v", err)
+	}
+	if info, err := os.Stat(a.GetStateFilePath()); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("state file not only readable by its owner: %v, %v", info, err)
+	}
+	got := a.loadBootstrapState()
+	if got.BootstrapURL != a.GetBootstrapURL() || !got.pendingReboot() || !got.completed(StageTypeOnboarding) || !got.completed(StageTypeBootImage) {
+		t.Errorf("loadBootstrapState() = %+v, want pending the reboot", got)
+	}
+	if got.OnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.InfoTimestampReference != "12345678" {
+		t.Errorf("loadBootstrapState() onboarding information = %+v, want the saved one", got.OnboardingInfo)
+	}
+
+	// A state not pending the reboot is stale
+	got.Stage = StageTypeConfig.String()
+	if err := saveToFile(got, a.GetStateFilePath()); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.loadBootstrapState(); !reflect.DeepEqual(got, &BootstrapState{}) {
+		t.Errorf("loadBootstrapState() with a stale state file = %+v, want empty", got)
+	}
+	if _, err := os.Stat(a.GetStateFilePath()); !os.IsNotExist(err) {
+		t.Errorf("stale state file not removed: %v", err)
+	}
+
+	if err := os.WriteFile(a.GetStateFilePath(), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.loadBootstrapState(); !reflect.DeepEqual(got, &BootstrapState{}) {
+		t.Errorf("loadBootstrapState() with an invalid state file = %+v, want empty", got)
+	}
+	a.SetStateFilePath("")
+	if err := a.prepareReboot(context.Background(), &BootstrapState{}); err != nil {
+		t.Fatalf("prepareReboot() error = %v", err)
+	}
+	if got := a.loadBootstrapState(); !reflect.DeepEqual(got, &BootstrapState{}) {
+		t.Errorf("loadBootstrapState() without state file path = %+v, want empty", got)
+	}
+}
+
+func TestAgent_performBootstrapSequenceResume(t *testing.T) {
+	a := newStateTestAgent(t)
+	onboarding := &a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation
+	onboarding.InfoTimestampReference = "resume"
+	onboarding.Configuration = base64.StdEncoding.EncodeToString([]byte("configuration"))
+	onboarding.PreConfigurationScript = base64.StdEncoding.EncodeToString([]byte("exit 0"))
+	onboarding.PostConfigurationScript = base64.StdEncoding.EncodeToString([]byte("exit 0"))
+	// The boot image was installed by the previous run, before the reboot
+	state := &BootstrapState{}
+	a.completeStage(state, StageTypeOnboarding)
+	a.completeStage(state, StageTypeBootImage)
+	if err := a.prepareReboot(context.Background(), state); err != nil {
+		t.Fatalf("prepareReboot() error = %v", err)
+	}
+	if status, _ := a.getCurrStatus(); status.Stage != "pending-reboot-in-progress" {
+		t.Errorf("status stage = %q, want pending-reboot-in-progress", status.Stage)
+	}
+	if !a.loadBootstrapState().pendingReboot() {
+		t.Error("loadBootstrapState() is not pending the reboot")
+	}
+
+	// A new agent started before the reboot reboots again
+	b := &Agent{StatusFilePath: a.StatusFilePath, ResultFilePath: a.ResultFilePath, StateFilePath: a.StateFilePath}
+	if currentBootID() != "" {
+		if err := b.performBootstrapSequence(context.Background()); !errors.Is(err, errRebootPending) {
+			t.Fatalf("performBootstrapSequence() error = %v, want %v", err, errRebootPending)
+		}
+	}
+
+	// After the reboot, it resumes without onboarding information of its own
+	state = b.loadBootstrapState()
+	state.BootID = "previous-boot"
+	if err := saveToFile(state, b.GetStateFilePath()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.performBootstrapSequence(context.Background()); err != nil {
+		t.Fatalf("performBootstrapSequence() error = %v", err)
+	}
+	if !reflect.DeepEqual(b.BootstrapServerOnboardingInfo, a.BootstrapServerOnboardingInfo) {
+		t.Errorf("performBootstrapSequence() onboarding information = %+v, want %+v", b.BootstrapServerOnboardingInfo, a.BootstrapServerOnboardingInfo)
+	}
+	status, err := b.getCurrStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.PendingReboot.End == 0 || status.BootImage.Start != 0 || status.Config.End == 0 || status.PostScript.End == 0 || status.Bootstrap.End == 0 {
+		t.Errorf("status = %+v, want the boot image skipped and the other stages completed", status)
+	}
+	if _, err := os.Stat(b.GetStateFilePath()); !os.IsNotExist(err) {
+		t.Errorf("state file not removed once the bootstrap is complete: %v", err)
+	}
+}
+
+func TestAgent_resumeBootstrapSequenceTrustAnchor(t *testing.T) {
+	cert, _ := newTestCertificate(t, "redirect bootstrap server", nil, nil)
+	trustAnchor := newTestCertificateBundle(t, cert)
+	a := newStateTestAgent(t)
+	a.HttpClient = &http.Client{}
+	a.SetBootstrapURL("https://redirect:8443/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data")
+	if err := a.useTrustAnchor(trustAnchor); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.saveBootstrapState(&BootstrapState{Stage: StageTypePendingReboot.String(), BootID: "previous-boot"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The agent started after the reboot authenticates the redirect bootstrap server again
+	b := &Agent{StatusFilePath: a.StatusFilePath, ResultFilePath: a.ResultFilePath, StateFilePath: a.StateFilePath, HttpClient: &http.Client{}}
+	b.resumeBootstrapSequence(b.loadBootstrapState())
+	if b.GetBootstrapURL() != a.GetBootstrapURL() || b.GetRedirectTrustAnchor() != trustAnchor {
+		t.Errorf("resumeBootstrapSequence() = %s, %q, want %s, %q", b.GetBootstrapURL(), b.GetRedirectTrustAnchor(), a.GetBootstrapURL(), trustAnchor)
+	}
+	client, ok := b.HttpClient.(*http.Client)
+	if !ok {
+		t.Fatalf("HttpClient = %T, want *http.Client", b.HttpClient)
+	}
+	if transport, ok := client.Transport.(*http.Transport); !ok || transport.TLSClientConfig.RootCAs == nil {
+		t.Errorf("HttpClient transport = %+v, want the redirect trust-anchor", client.Transport)
+	}
+}
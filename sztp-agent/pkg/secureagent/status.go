@@ -17,6 +17,9 @@ import (
 
 type StageType int64
 
+// StageAborted is the stage of the status when the bootstrap sequence is stopped before completing
+const StageAborted = "aborted"
+
 const (
 	StageTypeInit StageType = iota
 	StageTypeDownloadingFile
@@ -30,6 +33,7 @@ const (
 	StageTypePostScript
 	StageTypeBootstrap
 	StageTypeIsCompleted
+	StageTypeDecrypting
 )
 
 func (s StageType) String() string {
@@ -58,6 +62,8 @@ func (s StageType) String() string {
 		return "bootstrap"
 	case StageTypeIsCompleted:
 		return "is-completed"
+	case StageTypeDecrypting:
+		return "decrypting"
 	default:
 		return "unknown"
 	}
@@ -65,20 +71,25 @@ func (s StageType) String() string {
 
 // Status represents the status of the provisioning process.
 type Status struct {
-	Init            StageStatus `json:"init"`
-	DownloadingFile StageStatus `json:"downloading-file"`
-	PendingReboot   StageStatus `json:"pending-reboot"`
-	Parsing         StageStatus `json:"parsing"`
-	Onboarding      StageStatus `json:"onboarding"`
-	Redirect        StageStatus `json:"redirect"`
-	BootImage       StageStatus `json:"boot-image"`
-	PreScript       StageStatus `json:"pre-script"`
-	Config          StageStatus `json:"config"`
-	PostScript      StageStatus `json:"post-script"`
-	Bootstrap       StageStatus `json:"bootstrap"`
-	IsCompleted     StageStatus `json:"is-completed"`
-	Informational   string      `json:"informational"`
-	Stage           string      `json:"stage"`
+	Init            StageStatus              `json:"init"`
+	DownloadingFile DownloadStatus           `json:"downloading-file"`
+	PendingReboot   StageStatus              `json:"pending-reboot"`
+	Parsing         StageStatus              `json:"parsing"`
+	Onboarding      StageStatus              `json:"onboarding"`
+	Decrypting      StageStatus              `json:"decrypting"`
+	Redirect        StageStatus              `json:"redirect"`
+	BootImage       StageStatus              `json:"boot-image"`
+	PreScript       StageStatus              `json:"pre-script"`
+	Config          StageStatus              `json:"config"`
+	PostScript      StageStatus              `json:"post-script"`
+	Bootstrap       StageStatus              `json:"bootstrap"`
+	IsCompleted     StageStatus              `json:"is-completed"`
+	Insecure        bool                     `json:"insecure,omitempty"`
+	BootstrapURLs   []DiscoveredBootstrapURL `json:"bootstrap-urls,omitempty"`
+	BootstrapServer string                   `json:"bootstrap-server,omitempty"`
+	NextRetry       float64                  `json:"next-retry,omitempty"`
+	Informational   string                   `json:"informational"`
+	Stage           string                   `json:"stage"`
 }
 
 // Result represents the result of the provisioning process.
@@ -93,6 +104,14 @@ type StageStatus struct {
 	End    float64  `json:"end"`
 }
 
+// DownloadStatus represents the status of the downloading-file stage, with the progress of the download.
+type DownloadStatus struct {
+	StageStatus
+	URI   string `json:"uri,omitempty"`
+	Bytes int64  `json:"bytes"`
+	Total int64  `json:"total,omitempty"`
+}
+
 func (a *Agent) getCurrStatus() (*Status, error) {
 	var status Status
 	err := loadFile(a.GetStatusFilePath(), &status)
@@ -130,6 +149,7 @@ func (a *Agent) updateAndSaveStatus(s StageType, isStart bool, errMsg string) er
 	if err != nil {
 		return err
 	}
+	status.Insecure = a.GetInsecure()
 
 	return a.saveStatus(status)
 }
@@ -143,7 +163,7 @@ func (a *Agent) updateStageStatus(status *Status, stageType StageType, isStart b
 	case StageTypeInit:
 		a.updateStage(&status.Init, isStart, now, errMsg)
 	case StageTypeDownloadingFile:
-		a.updateStage(&status.DownloadingFile, isStart, now, errMsg)
+		a.updateStage(&status.DownloadingFile.StageStatus, isStart, now, errMsg)
 	case StageTypePendingReboot:
 		a.updateStage(&status.PendingReboot, isStart, now, errMsg)
 	case StageTypeIsCompleted:
@@ -152,6 +172,8 @@ func (a *Agent) updateStageStatus(status *Status, stageType StageType, isStart b
 		a.updateStage(&status.Parsing, isStart, now, errMsg)
 	case StageTypeOnboarding:
 		a.updateStage(&status.Onboarding, isStart, now, errMsg)
+	case StageTypeDecrypting:
+		a.updateStage(&status.Decrypting, isStart, now, errMsg)
 	case StageTypeRedirect:
 		a.updateStage(&status.Redirect, isStart, now, errMsg)
 	case StageTypeBootImage:
@@ -194,6 +216,59 @@ func (a *Agent) updateStage(stageStatus *StageStatus, isStart bool, now float64,
 	}
 }
 
+// modifyStatus applies a change to the current status, or to a new one, and saves it.
+func (a *Agent) modifyStatus(modify func(status *Status)) error {
+	status, err := a.getCurrStatus()
+	if err != nil {
+		log.Printf("[INFO] Creating a new status file %s", a.GetStatusFilePath())
+		status = a.createNewStatus()
+	}
+	modify(status)
+	return a.saveStatus(status)
+}
+
+// updateAndSaveBootstrapURLs records the discovered bootstrap URLs and their sources, in the order they are tried.
+func (a *Agent) updateAndSaveBootstrapURLs(urls []DiscoveredBootstrapURL) error {
+	return a.modifyStatus(func(status *Status) {
+		status.BootstrapURLs = urls
+	})
+}
+
+// updateAndSaveBootstrapServer records the bootstrap server the bootstrapping data was retrieved from.
+func (a *Agent) updateAndSaveBootstrapServer(bootstrapServer string) error {
+	return a.modifyStatus(func(status *Status) {
+		status.BootstrapServer = bootstrapServer
+	})
+}
+
+// updateAndSaveNextRetry records when the daemon retries the bootstrap sequence, a zero time clears it.
+func (a *Agent) updateAndSaveNextRetry(next time.Time) error {
+	return a.modifyStatus(func(status *Status) {
+		status.NextRetry = 0
+		if !next.IsZero() {
+			status.NextRetry = float64(next.Unix())
+		}
+	})
+}
+
+// updateAndSaveAborted records that the bootstrap sequence was stopped before completing, with the reason.
+func (a *Agent) updateAndSaveAborted(reason string) error {
+	return a.modifyStatus(func(status *Status) {
+		a.updateStage(&status.IsCompleted, false, float64(time.Now().Unix()), reason)
+		status.NextRetry = 0
+		status.Stage = StageAborted
+	})
+}
+
+// updateAndSaveDownloadProgress records the bytes of the file downloaded so far, out of the total when it is known.
+func (a *Agent) updateAndSaveDownloadProgress(uri string, bytes int64, total int64) error {
+	return a.modifyStatus(func(status *Status) {
+		status.DownloadingFile.URI = uri
+		status.DownloadingFile.Bytes = bytes
+		status.DownloadingFile.Total = total
+	})
+}
+
 func (a *Agent) saveStatus(status *Status) error {
 	return saveToFile(status, a.GetStatusFilePath())
 }
@@ -5,6 +5,7 @@
 package secureagent
 
 import (
+	"path/filepath"
 	"testing"
 )
 
@@ -105,3 +106,24 @@ func TestAgent_RunCommandStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestAgent_updateAndSaveStatusInsecure(t *testing.T) {
+	dir := t.TempDir()
+	for _, insecure := range []bool{false, true} {
+		a := &Agent{
+			Insecure:       insecure,
+			StatusFilePath: filepath.Join(dir, "status.json"),
+			ResultFilePath: filepath.Join(dir, "result.json"),
+		}
+		if err := a.updateAndSaveStatus(StageTypeInit, true, ""); err != nil {
+			t.Fatalf("updateAndSaveStatus() error = %v", err)
+		}
+		status, err := a.getCurrStatus()
+		if err != nil {
+			t.Fatalf("getCurrStatus() error = %v", err)
+		}
+		if status.Insecure != insecure {
+			t.Errorf("updateAndSaveStatus() insecure = %v, want %v", status.Insecure, insecure)
+		}
+	}
+}
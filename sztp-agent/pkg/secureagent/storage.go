@@ -0,0 +1,89 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/github/smimesign/ietf-cms/oid"
+	"github.com/github/smimesign/ietf-cms/protocol"
+)
+
+// Bootstrapping data artifacts on removable storage (RFC 8572 section 4.1)
+const (
+	removableStorageConveyedInformation = "conveyed-information.cms"
+	removableStorageOwnerCertificate    = "owner-certificate.cms"
+	removableStorageOwnershipVoucher    = "ownership-voucher.vcj"
+)
+
+// loadRemovableStorageBootstrappingData reads the bootstrapping data from the removable storage
+// and verifies it like the data fetched from a bootstrap server. As there is no TLS channel to
+// authenticate its origin, the conveyed-information must be signed by the owner.
+func (a *Agent) loadRemovableStorageBootstrappingData() error {
+	log.Println("[INFO] Reading the bootstrapping data from the removable storage: " + a.GetRemovableStoragePath())
+	conveyedInfo, err := a.readRemovableStorageArtifact(removableStorageConveyedInformation)
+	if err != nil {
+		return err
+	}
+	ownerCertificate, err := a.readRemovableStorageArtifact(removableStorageOwnerCertificate)
+	if err != nil {
+		return err
+	}
+	ownershipVoucher, err := a.readRemovableStorageArtifact(removableStorageOwnershipVoucher)
+	if err != nil {
+		return err
+	}
+	_ = a.updateAndSaveStatus(StageTypeBootstrap, true, "")
+	if err := requireSignedConveyedInformation(conveyedInfo, removableStorageConveyedInformation); err != nil {
+		return err
+	}
+	err = a.processBootstrappingData(conveyedInfo,
+		base64.StdEncoding.EncodeToString(ownershipVoucher),
+		base64.StdEncoding.EncodeToString(ownerCertificate))
+	if err != nil {
+		return err
+	}
+	log.Println("[INFO] Bootstrapping data from the removable storage verified successfully")
+	return nil
+}
+
+// readRemovableStorageArtifact reads one of the DER encoded artifacts of the removable storage
+func (a *Agent) readRemovableStorageArtifact(name string) ([]byte, error) {
+	path := filepath.Join(a.GetRemovableStoragePath(), name)
+	// nolint:gosec
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s not found on the removable storage, signed bootstrapping data is required", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return data, nil
+}
+
+// requireSignedConveyedInformation rejects unsigned conveyed-information, named after its origin.
+// An encrypted one is accepted here as its signature is checked once decrypted.
+func requireSignedConveyedInformation(conveyedInfo []byte, name string) error {
+	ci, err := protocol.ParseContentInfo(conveyedInfo)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if !ci.ContentType.Equal(oid.ContentTypeSignedData) && !ci.ContentType.Equal(oidContentTypeEnvelopedData) {
+		return fmt.Errorf("%s must be signed, got content type %v", name, ci.ContentType)
+	}
+	return nil
+}
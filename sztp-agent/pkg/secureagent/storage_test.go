@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestRemovableStorage(t *testing.T, artifacts map[string][]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range artifacts {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func decodeTestBase64(t *testing.T, encoded string) []byte {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+//nolint:funlen
+func TestAgent_loadRemovableStorageBootstrappingData(t *testing.T) {
+	manufacturerCert, manufacturerKey := newTestCertificate(t, "manufacturer", nil, nil)
+	ownerCert, ownerKey := newTestCertificate(t, "owner", nil, nil)
+	otherCert, otherKey := newTestCertificate(t, "other", nil, nil)
+
+	signedConveyedInfo := newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ownerCert, ownerKey)
+	ownerCertificate := decodeTestBase64(t, newTestCertificateBundle(t, ownerCert))
+	ownershipVoucher := decodeTestBase64(t, newTestOwnershipVoucher(t, newTestVoucher("my-serial-number", ownerCert), manufacturerCert, manufacturerKey))
+
+	tests := []struct {
+		name      string
+		artifacts map[string][]byte
+		wantErr   bool
+	}{
+		{
+			name: "signed bootstrapping data",
+			artifacts: map[string][]byte{
+				removableStorageConveyedInformation: signedConveyedInfo,
+				removableStorageOwnerCertificate:    ownerCertificate,
+				removableStorageOwnershipVoucher:    ownershipVoucher,
+			},
+		},
+		{
+			name: "unsigned conveyed-information",
+			artifacts: map[string][]byte{
+				removableStorageConveyedInformation: newTestContentInfo(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation)),
+				removableStorageOwnerCertificate:    ownerCertificate,
+				removableStorageOwnershipVoucher:    ownershipVoucher,
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing ownership voucher",
+			artifacts: map[string][]byte{
+				removableStorageConveyedInformation: signedConveyedInfo,
+				removableStorageOwnerCertificate:    ownerCertificate,
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing owner certificate",
+			artifacts: map[string][]byte{
+				removableStorageConveyedInformation: signedConveyedInfo,
+				removableStorageOwnershipVoucher:    ownershipVoucher,
+			},
+			wantErr: true,
+		},
+		{
+			name: "signed by another owner",
+			artifacts: map[string][]byte{
+				removableStorageConveyedInformation: newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), otherCert, otherKey),
+				removableStorageOwnerCertificate:    ownerCertificate,
+				removableStorageOwnershipVoucher:    ownershipVoucher,
+			},
+			wantErr: true,
+		},
+		{
+			name: "voucher for another device",
+			artifacts: map[string][]byte{
+				removableStorageConveyedInformation: signedConveyedInfo,
+				removableStorageOwnerCertificate:    ownerCertificate,
+				removableStorageOwnershipVoucher:    decodeTestBase64(t, newTestOwnershipVoucher(t, newTestVoucher("other-serial-number", ownerCert), manufacturerCert, manufacturerKey)),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a := &Agent{
+				SerialNumber:                "my-serial-number",
+				ManufacturerTrustAnchorCert: writeTestCertificatePEM(t, manufacturerCert),
+				RemovableStoragePath:        writeTestRemovableStorage(t, tt.artifacts),
+				StatusFilePath:              filepath.Join(dir, "status.json"),
+				ResultFilePath:              filepath.Join(dir, "result.json"),
+			}
+			err := a.loadRemovableStorageBootstrappingData()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadRemovableStorageBootstrappingData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.Configuration != "dGVzdA==" {
+				t.Errorf("loadRemovableStorageBootstrappingData() got unexpected onboarding information %v", a.BootstrapServerOnboardingInfo)
+			}
+			// There is no bootstrap server to report the progress to
+			if err := a.doReportProgress(context.Background(), ProgressTypeBootstrapInitiated, "Bootstrap Initiated"); err != nil {
+				t.Errorf("doReportProgress() error = %v", err)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ package secureagent
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -23,31 +24,123 @@ import (
 	"strings"
 )
 
-// NewHTTPClient instantiate a new HTTP Client
+// NewHTTPClient instantiate a new HTTP Client authenticating the bootstrap server with the
+// bootstrap trust anchor
 func NewHTTPClient(bootstrapTrustAnchorCert string, deviceEndEntityCert string, devicePrivateKey string) http.Client {
 	certPath := filepath.Clean(bootstrapTrustAnchorCert)
 	caCert, _ := os.ReadFile(certPath)
 	caCertPool := x509.NewCertPool()
 	caCertPool.AppendCertsFromPEM(caCert)
-	cert, _ := tls.LoadX509KeyPair(deviceEndEntityCert, devicePrivateKey)
+	return newHTTPClient(caCertPool, deviceEndEntityCert, devicePrivateKey, false)
+}
+
+// NewInsecureHTTPClient instantiate a new HTTP Client that does not authenticate the bootstrap
+// server, it must only be used in lab environments
+func NewInsecureHTTPClient(deviceEndEntityCert string, devicePrivateKey string) http.Client {
+	return newHTTPClient(nil, deviceEndEntityCert, devicePrivateKey, true)
+}
+
+func newHTTPClient(rootCAs *x509.CertPool, deviceEndEntityCert string, devicePrivateKey string, insecure bool) http.Client {
+	tlsConfig := &tls.Config{
+		//nolint:gosec
+		InsecureSkipVerify: insecure,
+		RootCAs:            rootCAs,
+		MinVersion:         tls.VersionTLS12,
+	}
+	cert, err := tls.LoadX509KeyPair(deviceEndEntityCert, devicePrivateKey)
+	if err == nil {
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 	client := http.Client{
 		CheckRedirect: func(r *http.Request, _ []*http.Request) error {
 			r.URL.Opaque = r.URL.Path
 			return nil
 		},
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				//nolint:gosec
-				InsecureSkipVerify: true, // TODO: remove skip verify
-				RootCAs:            caCertPool,
-				Certificates:       []tls.Certificate{cert},
-			},
+			TLSClientConfig: tlsConfig,
 		},
 	}
 	return client
 }
 
-func (a *Agent) doTLSRequest(input string, url string, empty bool) (*BootstrapServerPostOutput, error) {
+// useTrustAnchor authenticates the following requests with the CMS encoded trust-anchor
+// received in the redirect information, instead of the trust anchor of the base HttpClient
+func (a *Agent) useTrustAnchor(trustAnchor string) error {
+	certs, err := parseCertificates(trustAnchor, "trust-anchor")
+	if err != nil {
+		return err
+	}
+	rootCAs := x509.NewCertPool()
+	for _, cert := range certs {
+		rootCAs.AddCert(cert)
+	}
+	if a.BaseHttpClient == nil {
+		a.BaseHttpClient = a.HttpClient
+	}
+	client, ok := a.BaseHttpClient.(*http.Client)
+	if !ok {
+		return errors.New("the HTTP client does not support changing the trust anchor")
+	}
+	roundTripper := client.Transport
+	if roundTripper == nil {
+		roundTripper = http.DefaultTransport
+	}
+	transport, ok := roundTripper.(*http.Transport)
+	if !ok {
+		return errors.New("the HTTP transport does not support changing the trust anchor")
+	}
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	transport.TLSClientConfig.RootCAs = rootCAs
+	a.HttpClient = &http.Client{
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       client.Timeout,
+		Transport:     transport,
+	}
+	a.RedirectTrustAnchor = trustAnchor
+	log.Println("[INFO] Using the redirect trust-anchor to authenticate the bootstrap server")
+	return nil
+}
+
+// downloadHTTPClient returns the client downloading the boot image and its signature. They may be
+// hosted on any mirror, their integrity comes from the image verification: the servers are
+// authenticated with the system roots and the device certificate is not presented to them. The
+// proxy and the timeouts are the ones of the base HttpClient.
+func (a *Agent) downloadHTTPClient() HttpClient {
+	if a.DownloadHttpClient != nil {
+		return a.DownloadHttpClient
+	}
+	base := a.BaseHttpClient
+	if base == nil {
+		base = a.HttpClient
+	}
+	client := &http.Client{}
+	if baseClient, ok := base.(*http.Client); ok {
+		client.Timeout = baseClient.Timeout
+		if transport, ok := baseClient.Transport.(*http.Transport); ok {
+			transport = transport.Clone()
+			transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+			client.Transport = transport
+		}
+	}
+	a.DownloadHttpClient = client
+	return client
+}
+
+// resetRedirect forgets the redirect of a previous bootstrap server, the requests are authenticated
+// with the base HttpClient again
+func (a *Agent) resetRedirect() {
+	if a.BaseHttpClient != nil {
+		a.HttpClient = a.BaseHttpClient
+	}
+	a.RedirectTrustAnchor = ""
+	a.BootstrapServerRedirectInfo = BootstrapServerRedirectInfo{}
+}
+
+func (a *Agent) doTLSRequest(ctx context.Context, input string, url string, empty bool) (*BootstrapServerPostOutput, error) {
 	var postResponse BootstrapServerPostOutput
 	var errorResponse BootstrapServerErrorOutput
 
@@ -55,7 +148,7 @@ func (a *Agent) doTLSRequest(input string, url string, empty bool) (*BootstrapSe
 	log.Println("[DEBUG] Sending input: " + input)
 
 	body := strings.NewReader(input)
-	r, err := http.NewRequest(http.MethodPost, url, body)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
 	if err != nil {
 		return nil, err
 	}
@@ -5,8 +5,19 @@
 package secureagent
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestAgent_doTLSRequest(t *testing.T) {
@@ -40,7 +51,7 @@ func TestAgent_doTLSRequest(t *testing.T) {
 				InputJSONContent:         tt.fields.InputJSONContent,
 				DhcpLeaseFile:            tt.fields.DhcpLeaseFile,
 			}
-			got, err := a.doTLSRequest(a.GetInputJSONContent(), a.GetBootstrapURL(), false)
+			got, err := a.doTLSRequest(context.Background(), a.GetInputJSONContent(), a.GetBootstrapURL(), false)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("doTLSRequest() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -51,3 +62,191 @@ func TestAgent_doTLSRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestNewHTTPClient(t *testing.T) {
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+	otherCert, _ := newTestCertificate(t, "other", nil, nil)
+
+	tests := []struct {
+		name    string
+		client  http.Client
+		wantErr bool
+	}{
+		{
+			name:    "server certificate issued by the bootstrap trust anchor",
+			client:  NewHTTPClient(writeTestCertificatePEM(t, svr.Certificate()), "", ""),
+			wantErr: false,
+		},
+		{
+			name:    "server certificate not issued by the bootstrap trust anchor",
+			client:  NewHTTPClient(writeTestCertificatePEM(t, otherCert), "", ""),
+			wantErr: true,
+		},
+		{
+			name:    "missing bootstrap trust anchor",
+			client:  NewHTTPClient(filepath.Join(t.TempDir(), "missing.pem"), "", ""),
+			wantErr: true,
+		},
+		{
+			name:    "insecure client",
+			client:  NewInsecureHTTPClient("", ""),
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := tt.client.Get(svr.URL)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				_ = res.Body.Close()
+			}
+		})
+	}
+}
+
+func TestAgent_useTrustAnchor(t *testing.T) {
+	output := BootstrapServerPostOutput{}
+	output.IetfSztpBootstrapServerOutput.ConveyedInformation = base64.StdEncoding.EncodeToString(
+		newTestContentInfo(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation)))
+	body, err := json.Marshal(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer svr.Close()
+	host, port, err := net.SplitHostPort(svr.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, _ := newTestCertificate(t, "other", nil, nil)
+
+	tests := []struct {
+		name        string
+		trustAnchor string
+		wantErr     bool
+	}{
+		{
+			name:        "redirect trust anchor authenticates the server",
+			trustAnchor: newTestCertificateBundle(t, svr.Certificate()),
+			wantErr:     false,
+		},
+		{
+			name:        "redirect trust anchor does not authenticate the server",
+			trustAnchor: newTestCertificateBundle(t, otherCert),
+			wantErr:     true,
+		},
+		{
+			name:        "no redirect trust anchor",
+			trustAnchor: "",
+			wantErr:     true,
+		},
+		{
+			name:        "invalid redirect trust anchor",
+			trustAnchor: "{wrongBASE64}",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewHTTPClient(writeTestCertificatePEM(t, otherCert), "", "")
+			dir := t.TempDir()
+			a := &Agent{
+				BootstrapURL:   "https://bootstrap.example.com/restconf/operations/ietf-sztp-bootstrap-server:get-bootstrapping-data",
+				HttpClient:     &client,
+				StatusFilePath: filepath.Join(dir, "status.json"),
+				ResultFilePath: filepath.Join(dir, "result.json"),
+			}
+			a.BootstrapServerRedirectInfo.IetfSztpConveyedInfoRedirectInformation.BootstrapServer = []struct {
+				Address     string `json:"address"`
+				Port        int    `json:"port"`
+				TrustAnchor string `json:"trust-anchor"`
+			}{{Address: host, Port: portNumber, TrustAnchor: tt.trustAnchor}}
+			err := a.doHandleBootstrapRedirect(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("doHandleBootstrapRedirect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.Configuration == "" {
+				t.Errorf("doHandleBootstrapRedirect() did not retrieve the onboarding information")
+			}
+		})
+	}
+}
+
+func TestAgent_useTrustAnchorClient(t *testing.T) {
+	rootCert, _ := newTestCertificate(t, "root", nil, nil)
+	a := &Agent{HttpClient: &http.Client{Transport: http.NewFileTransport(http.Dir(t.TempDir()))}}
+	if err := a.useTrustAnchor(newTestCertificateBundle(t, rootCert)); err == nil {
+		t.Errorf("useTrustAnchor() expected an error for a transport without TLS configuration")
+	}
+	client := NewInsecureHTTPClient("", "")
+	a = &Agent{HttpClient: &client}
+	if err := a.useTrustAnchor(newTestCertificateBundle(t, rootCert)); err != nil {
+		t.Fatalf("useTrustAnchor() error = %v", err)
+	}
+	tlsConfig := a.HttpClient.(*http.Client).Transport.(*http.Transport).TLSClientConfig
+	if !tlsConfig.InsecureSkipVerify {
+		t.Errorf("useTrustAnchor() must keep the insecure mode")
+	}
+	if !tlsConfig.RootCAs.Equal(func() *x509.CertPool {
+		pool := x509.NewCertPool()
+		pool.AddCert(rootCert)
+		return pool
+	}()) {
+		t.Errorf("useTrustAnchor() did not install the trust anchor")
+	}
+	if client.Transport.(*http.Transport).TLSClientConfig.RootCAs != nil {
+		t.Errorf("useTrustAnchor() modified the original HTTP client")
+	}
+	a.resetRedirect()
+	if a.HttpClient != &client || a.GetRedirectTrustAnchor() != "" {
+		t.Errorf("resetRedirect() did not restore the original HTTP client")
+	}
+}
+
+func TestAgent_downloadHTTPClient(t *testing.T) {
+	rootCert, _ := newTestCertificate(t, "root", nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(rootCert)
+	base := &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{{}}, MinVersion: tls.VersionTLS12},
+		},
+	}
+	a := &Agent{HttpClient: base, BaseHttpClient: base}
+	if err := a.useTrustAnchor(newTestCertificateBundle(t, rootCert)); err != nil {
+		t.Fatalf("useTrustAnchor() error = %v", err)
+	}
+	client, ok := a.downloadHTTPClient().(*http.Client)
+	if !ok {
+		t.Fatalf("downloadHTTPClient() = %T, want *http.Client", a.downloadHTTPClient())
+	}
+	if client.Timeout != base.Timeout {
+		t.Errorf("downloadHTTPClient() timeout = %v, want %v", client.Timeout, base.Timeout)
+	}
+	transport := client.Transport.(*http.Transport)
+	if transport.Proxy == nil {
+		t.Errorf("downloadHTTPClient() must keep the proxy of the base client")
+	}
+	if transport.TLSClientConfig.RootCAs != nil || len(transport.TLSClientConfig.Certificates) != 0 {
+		t.Errorf("downloadHTTPClient() must use the system roots without the device certificate")
+	}
+	if base.Transport.(*http.Transport).TLSClientConfig.RootCAs != pool {
+		t.Errorf("downloadHTTPClient() modified the base HTTP client")
+	}
+	if a.downloadHTTPClient() != client {
+		t.Errorf("downloadHTTPClient() must reuse the download client")
+	}
+}
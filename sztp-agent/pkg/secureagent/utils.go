@@ -11,6 +11,7 @@ package secureagent
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -40,15 +41,19 @@ func GetSerialNumber(givenSerialNumber string) string {
 	return serialNumber
 }
 
+// readOSRelease returns the name and version of the running operating system from an os-release file
+func readOSRelease(path string) (string, string, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return "", "", err
+	}
+	return cfg.Section("").Key("NAME").String(), cfg.Section("").Key("VERSION").String(), nil
+}
+
 func generateInputJSONContent() string {
-	osName := ""
-	osVersion := ""
-	cfg, err := ini.Load(OS_RELEASE_FILE)
+	osName, osVersion, err := readOSRelease(OS_RELEASE_FILE)
 	if err != nil {
 		log.Printf("[ERROR] Error loading os-release file: %v", err)
-	} else {
-		osName = cfg.Section("").Key("NAME").String()
-		osVersion = cfg.Section("").Key("VERSION").String()
 	}
 	hwModel := ""
 	baseboard, err := ghw.Baseboard()
@@ -66,6 +71,41 @@ func generateInputJSONContent() string {
 	return string(inputJSON)
 }
 
+// generateNonce returns a random nonce to bind the ownership voucher to this request
+func generateNonce() ([]byte, error) {
+	nonce := make([]byte, NONCE_LENGTH)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// requestInputJSONContent returns the get-bootstrapping-data input carrying a fresh nonce,
+// unless nonceless ownership vouchers were requested.
+func (a *Agent) requestInputJSONContent() (string, error) {
+	if a.GetNoncelessVoucher() {
+		a.Nonce = nil
+		return a.GetInputJSONContent(), nil
+	}
+	var input InputJSON
+	if a.GetInputJSONContent() != "" {
+		if err := json.Unmarshal([]byte(a.GetInputJSONContent()), &input); err != nil {
+			return "", err
+		}
+	}
+	nonce, err := generateNonce()
+	if err != nil {
+		return "", err
+	}
+	input.IetfSztpBootstrapServerInput.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+	a.Nonce = nonce
+	return string(inputJSON), nil
+}
+
 func replaceQuotes(input string) string {
 	return strings.ReplaceAll(input, "\"", "")
 }
@@ -91,11 +131,16 @@ func calculateSHA256File(filePath string) (string, error) {
 }
 
 func saveToFile(data interface{}, filePath string) error {
+	return saveToFileWithMode(data, filePath, 0666)
+}
+
+// saveToFileWithMode is saveToFile creating the file with the given permissions (before umask)
+func saveToFileWithMode(data interface{}, filePath string, perm os.FileMode) error {
 	filePath = filepath.Clean(filePath)
 	random, _ := rand.Prime(rand.Reader, 64)
 	tempPath := fmt.Sprintf("%s.%d.tmp", filePath, random) // rand number to avoid conflicts when multiple agents are running
 	tempPath = filepath.Clean(tempPath)
-	file, err := os.Create(tempPath)
+	file, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return err
 	}
@@ -5,6 +5,7 @@
 package secureagent
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -246,3 +247,36 @@ func Test_createSymlink(t *testing.T) {
 		t.Errorf("expected symlink to point to %s, got %s", newTargetFile, newTarget)
 	}
 }
+
+func TestAgent_requestInputJSONContent(t *testing.T) {
+	a := &Agent{
+		InputJSONContent: generateInputJSONContent(),
+	}
+	first, err := a.requestInputJSONContent()
+	if err != nil {
+		t.Fatalf("requestInputJSONContent() error = %v", err)
+	}
+	var input InputJSON
+	if err := json.Unmarshal([]byte(first), &input); err != nil {
+		t.Fatalf("requestInputJSONContent() returned invalid JSON: %v", err)
+	}
+	if input.IetfSztpBootstrapServerInput.Nonce != base64.StdEncoding.EncodeToString(a.Nonce) || len(a.Nonce) != NONCE_LENGTH {
+		t.Errorf("requestInputJSONContent() nonce = %v, want %v", input.IetfSztpBootstrapServerInput.Nonce, a.Nonce)
+	}
+	second, err := a.requestInputJSONContent()
+	if err != nil {
+		t.Fatalf("requestInputJSONContent() error = %v", err)
+	}
+	if first == second {
+		t.Errorf("requestInputJSONContent() must generate a new nonce for every request")
+	}
+
+	a.SetNoncelessVoucher(true)
+	nonceless, err := a.requestInputJSONContent()
+	if err != nil {
+		t.Fatalf("requestInputJSONContent() error = %v", err)
+	}
+	if nonceless != a.GetInputJSONContent() || a.Nonce != nil {
+		t.Errorf("requestInputJSONContent() = %v, want %v without nonce", nonceless, a.GetInputJSONContent())
+	}
+}
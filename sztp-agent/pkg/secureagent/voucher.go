@@ -0,0 +1,170 @@
+/*
+SPDX-License-Identifier: Apache-2.0
+Copyright (C) 2022-2023 Intel Corporation
+Copyright (c) 2022 Dell Inc, or its subsidiaries.
+Copyright (C) 2022 Red Hat.
+*/
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	cms "github.com/github/smimesign/ietf-cms"
+)
+
+// oidContentTypeAnimaJSONVoucher is the id-ct-animaJSONVoucher content type defined by RFC 8366
+var oidContentTypeAnimaJSONVoucher = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 40}
+
+// Voucher assertions defined by RFC 8366
+const (
+	VoucherAssertionVerified  = "verified"
+	VoucherAssertionLogged    = "logged"
+	VoucherAssertionProximity = "proximity"
+)
+
+// verifyOwnership authenticates the owner of the bootstrapping data. It returns the owner
+// certificate chain and the pinned-domain-cert it has been authenticated with, or nil values
+// when the bootstrap server did not send any ownership artifact.
+func (a *Agent) verifyOwnership(ownershipVoucher, ownerCertificate string) ([]*x509.Certificate, *x509.Certificate, error) {
+	if ownershipVoucher == "" && ownerCertificate == "" {
+		return nil, nil, nil
+	}
+	if ownershipVoucher == "" || ownerCertificate == "" {
+		return nil, nil, errors.New("ownership-voucher and owner-certificate must be provided together")
+	}
+	voucher, err := a.verifyOwnershipVoucher(ownershipVoucher)
+	if err != nil {
+		return nil, nil, err
+	}
+	pinnedDomainCert, err := voucher.pinnedDomainCert()
+	if err != nil {
+		return nil, nil, err
+	}
+	ownerCerts, err := parseOwnerCertificate(ownerCertificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Println("[INFO] Ownership voucher verified successfully")
+	return ownerCerts, pinnedDomainCert, nil
+}
+
+// verifyOwnershipVoucher checks the voucher signature against the manufacturer trust anchor
+// and that the voucher is valid for this device.
+func (a *Agent) verifyOwnershipVoucher(ownershipVoucher string) (*OwnershipVoucher, error) {
+	if a.GetManufacturerTrustAnchorCert() == "" {
+		return nil, errors.New("ownership-voucher received but no manufacturer trust anchor is configured")
+	}
+	roots, err := loadCertPool(a.GetManufacturerTrustAnchorCert())
+	if err != nil {
+		return nil, err
+	}
+	der, err := base64.StdEncoding.DecodeString(ownershipVoucher)
+	if err != nil {
+		return nil, err
+	}
+	sd, err := cms.ParseSignedData(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ownership-voucher: %w", err)
+	}
+	_, err = sd.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ownership-voucher signature verification failed: %w", err)
+	}
+	contentType, content, err := signedDataContent(der)
+	if err != nil {
+		return nil, err
+	}
+	if !contentType.Equal(oidContentTypeAnimaJSONVoucher) {
+		return nil, fmt.Errorf("unsupported ownership-voucher content type: %v", contentType)
+	}
+	var voucher OwnershipVoucher
+	if err := json.Unmarshal(content, &voucher); err != nil {
+		return nil, err
+	}
+	if err := voucher.validate(a.GetSerialNumber(), a.Nonce, time.Now()); err != nil {
+		return nil, err
+	}
+	return &voucher, nil
+}
+
+// validate checks the voucher leaves against the device serial number, the nonce sent in the
+// request and the current time
+func (v *OwnershipVoucher) validate(serialNumber string, nonce []byte, now time.Time) error {
+	voucher := v.IetfVoucherVoucher
+	if voucher.SerialNumber != serialNumber {
+		return fmt.Errorf("ownership-voucher serial-number %q does not match the device serial number %q", voucher.SerialNumber, serialNumber)
+	}
+	switch voucher.Assertion {
+	case VoucherAssertionVerified, VoucherAssertionLogged:
+	case VoucherAssertionProximity:
+		return errors.New("ownership-voucher proximity assertion is not supported for zero touch bootstrapping")
+	default:
+		return fmt.Errorf("unknown ownership-voucher assertion: %q", voucher.Assertion)
+	}
+	if voucher.Nonce != "" {
+		voucherNonce, err := base64.StdEncoding.DecodeString(voucher.Nonce)
+		if err != nil {
+			return fmt.Errorf("invalid ownership-voucher nonce: %w", err)
+		}
+		if len(nonce) == 0 || !bytes.Equal(voucherNonce, nonce) {
+			return errors.New("ownership-voucher nonce does not match the nonce sent in the request")
+		}
+	}
+	if voucher.ExpiresOn != "" {
+		expiresOn, err := time.Parse(time.RFC3339, voucher.ExpiresOn)
+		if err != nil {
+			return fmt.Errorf("invalid ownership-voucher expires-on: %w", err)
+		}
+		if now.After(expiresOn) {
+			return fmt.Errorf("ownership-voucher expired on %s", voucher.ExpiresOn)
+		}
+	}
+	if voucher.DomainCertRevocationChecks {
+		log.Println("[WARNING] ownership-voucher requests revocation checks which are not supported")
+	}
+	return nil
+}
+
+// pinnedDomainCert returns the certificate the owner certificate must chain to
+func (v *OwnershipVoucher) pinnedDomainCert() (*x509.Certificate, error) {
+	if v.IetfVoucherVoucher.PinnedDomainCert == "" {
+		return nil, errors.New("ownership-voucher has no pinned-domain-cert")
+	}
+	der, err := base64.StdEncoding.DecodeString(v.IetfVoucherVoucher.PinnedDomainCert)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ownership-voucher pinned-domain-cert: %w", err)
+	}
+	return cert, nil
+}
+
+// loadCertPool reads the PEM certificates of a trust anchor file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
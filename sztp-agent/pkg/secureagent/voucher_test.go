@@ -0,0 +1,321 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright (C) 2022-2023 Red Hat.
+
+// Package secureagent implements the secure agent
+package secureagent
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificatePEM(t *testing.T, cert *x509.Certificate) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "trust-anchor.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestVoucher(serialNumber string, pinnedDomainCert *x509.Certificate) OwnershipVoucher {
+	var v OwnershipVoucher
+	v.IetfVoucherVoucher.CreatedOn = time.Now().Format(time.RFC3339)
+	v.IetfVoucherVoucher.ExpiresOn = time.Now().Add(time.Hour).Format(time.RFC3339)
+	v.IetfVoucherVoucher.Assertion = VoucherAssertionVerified
+	v.IetfVoucherVoucher.SerialNumber = serialNumber
+	if pinnedDomainCert != nil {
+		v.IetfVoucherVoucher.PinnedDomainCert = base64.StdEncoding.EncodeToString(pinnedDomainCert.Raw)
+	}
+	return v
+}
+
+func newTestOwnershipVoucher(t *testing.T, v OwnershipVoucher, cert *x509.Certificate, key crypto.Signer) string {
+	t.Helper()
+	content, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(newTestSignedData(t, oidContentTypeAnimaJSONVoucher, content, cert, key))
+}
+
+//nolint:funlen
+func TestOwnershipVoucher_validate(t *testing.T) {
+	now := time.Now()
+	nonce := []byte("0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		name    string
+		modify  func(v *OwnershipVoucher)
+		wantErr bool
+	}{
+		{
+			name:    "verified assertion",
+			modify:  func(_ *OwnershipVoucher) {},
+			wantErr: false,
+		},
+		{
+			name: "logged assertion without expiration",
+			modify: func(v *OwnershipVoucher) {
+				v.IetfVoucherVoucher.Assertion = VoucherAssertionLogged
+				v.IetfVoucherVoucher.ExpiresOn = ""
+			},
+			wantErr: false,
+		},
+		{
+			name: "proximity assertion",
+			modify: func(v *OwnershipVoucher) {
+				v.IetfVoucherVoucher.Assertion = VoucherAssertionProximity
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown assertion",
+			modify: func(v *OwnershipVoucher) {
+				v.IetfVoucherVoucher.Assertion = "trust-me"
+			},
+			wantErr: true,
+		},
+		{
+			name: "serial number mismatch",
+			modify: func(v *OwnershipVoucher) {
+				v.IetfVoucherVoucher.SerialNumber = "another-serial-number"
+			},
+			wantErr: true,
+		},
+		{
+			name: "matching nonce",
+			modify: func(v *OwnershipVoucher) {
+				v.IetfVoucherVoucher.Nonce = base64.StdEncoding.EncodeToString(nonce)
+			},
+			wantErr: false,
+		},
+		{
+			name: "nonce mismatch",
+			modify: func(v *OwnershipVoucher) {
+				v.IetfVoucherVoucher.Nonce = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid nonce",
+			modify: func(v *OwnershipVoucher) {
+				v.IetfVoucherVoucher.Nonce = "{wrongBASE64}"
+			},
+			wantErr: true,
+		},
+		{
+			name: "expired voucher",
+			modify: func(v *OwnershipVoucher) {
+				v.IetfVoucherVoucher.ExpiresOn = now.Add(-time.Minute).Format(time.RFC3339)
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid expires-on",
+			modify: func(v *OwnershipVoucher) {
+				v.IetfVoucherVoucher.ExpiresOn = "tomorrow"
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestVoucher("my-serial-number", nil)
+			tt.modify(&v)
+			if err := v.validate("my-serial-number", nonce, now); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+//nolint:funlen
+func TestAgent_verifyOwnership(t *testing.T) {
+	manufacturerCert, manufacturerKey := newTestCertificate(t, "manufacturer", nil, nil)
+	masaCert, masaKey := newTestCertificate(t, "masa", manufacturerCert, manufacturerKey)
+	rogueCert, rogueKey := newTestCertificate(t, "rogue", nil, nil)
+	ownerCert, _ := newTestCertificate(t, "owner", nil, nil)
+	manufacturerTrustAnchor := writeTestCertificatePEM(t, manufacturerCert)
+	ownerCertificate := newTestCertificateBundle(t, ownerCert)
+
+	noPinnedCert := newTestVoucher("my-serial-number", nil)
+	wrongContentType, err := json.Marshal(newTestVoucher("my-serial-number", ownerCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type fields struct {
+		ManufacturerTrustAnchorCert string
+	}
+	type args struct {
+		ownershipVoucher string
+		ownerCertificate string
+	}
+	tests := []struct {
+		name       string
+		fields     fields
+		args       args
+		wantPinned bool
+		wantErr    bool
+	}{
+		{
+			name:   "no ownership artifacts",
+			fields: fields{ManufacturerTrustAnchorCert: manufacturerTrustAnchor},
+		},
+		{
+			name:   "valid ownership voucher and owner certificate",
+			fields: fields{ManufacturerTrustAnchorCert: manufacturerTrustAnchor},
+			args: args{
+				ownershipVoucher: newTestOwnershipVoucher(t, newTestVoucher("my-serial-number", ownerCert), masaCert, masaKey),
+				ownerCertificate: ownerCertificate,
+			},
+			wantPinned: true,
+		},
+		{
+			name:   "owner certificate without ownership voucher",
+			fields: fields{ManufacturerTrustAnchorCert: manufacturerTrustAnchor},
+			args: args{
+				ownerCertificate: ownerCertificate,
+			},
+			wantErr: true,
+		},
+		{
+			name:   "ownership voucher without owner certificate",
+			fields: fields{ManufacturerTrustAnchorCert: manufacturerTrustAnchor},
+			args: args{
+				ownershipVoucher: newTestOwnershipVoucher(t, newTestVoucher("my-serial-number", ownerCert), masaCert, masaKey),
+			},
+			wantErr: true,
+		},
+		{
+			name:   "manufacturer trust anchor not configured",
+			fields: fields{},
+			args: args{
+				ownershipVoucher: newTestOwnershipVoucher(t, newTestVoucher("my-serial-number", ownerCert), masaCert, masaKey),
+				ownerCertificate: ownerCertificate,
+			},
+			wantErr: true,
+		},
+		{
+			name:   "ownership voucher not signed by the manufacturer",
+			fields: fields{ManufacturerTrustAnchorCert: manufacturerTrustAnchor},
+			args: args{
+				ownershipVoucher: newTestOwnershipVoucher(t, newTestVoucher("my-serial-number", ownerCert), rogueCert, rogueKey),
+				ownerCertificate: ownerCertificate,
+			},
+			wantErr: true,
+		},
+		{
+			name:   "ownership voucher for another device",
+			fields: fields{ManufacturerTrustAnchorCert: manufacturerTrustAnchor},
+			args: args{
+				ownershipVoucher: newTestOwnershipVoucher(t, newTestVoucher("another-serial-number", ownerCert), masaCert, masaKey),
+				ownerCertificate: ownerCertificate,
+			},
+			wantErr: true,
+		},
+		{
+			name:   "ownership voucher without pinned-domain-cert",
+			fields: fields{ManufacturerTrustAnchorCert: manufacturerTrustAnchor},
+			args: args{
+				ownershipVoucher: newTestOwnershipVoucher(t, noPinnedCert, masaCert, masaKey),
+				ownerCertificate: ownerCertificate,
+			},
+			wantErr: true,
+		},
+		{
+			name:   "ownership voucher with wrong content type",
+			fields: fields{ManufacturerTrustAnchorCert: manufacturerTrustAnchor},
+			args: args{
+				ownershipVoucher: base64.StdEncoding.EncodeToString(newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, wrongContentType, masaCert, masaKey)),
+				ownerCertificate: ownerCertificate,
+			},
+			wantErr: true,
+		},
+		{
+			name:   "ownership voucher with wrong base64",
+			fields: fields{ManufacturerTrustAnchorCert: manufacturerTrustAnchor},
+			args: args{
+				ownershipVoucher: "{wrongBASE64}",
+				ownerCertificate: ownerCertificate,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{
+				SerialNumber:                "my-serial-number",
+				ManufacturerTrustAnchorCert: tt.fields.ManufacturerTrustAnchorCert,
+			}
+			ownerCerts, pinnedDomainCert, err := a.verifyOwnership(tt.args.ownershipVoucher, tt.args.ownerCertificate)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyOwnership() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if (pinnedDomainCert != nil) != tt.wantPinned || (len(ownerCerts) != 0) != tt.wantPinned {
+				t.Errorf("verifyOwnership() got pinned-domain-cert = %v, owner certificates = %d", pinnedDomainCert, len(ownerCerts))
+			}
+			if tt.wantPinned && !pinnedDomainCert.Equal(ownerCert) {
+				t.Errorf("verifyOwnership() pinned-domain-cert = %v, want %v", pinnedDomainCert.Subject, ownerCert.Subject)
+			}
+		})
+	}
+}
+
+func TestOwnershipVoucher_validateNonceNotSent(t *testing.T) {
+	v := newTestVoucher("my-serial-number", nil)
+	v.IetfVoucherVoucher.Nonce = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	if err := v.validate("my-serial-number", nil, time.Now()); err == nil {
+		t.Errorf("validate() expected an error for a nonceful voucher when no nonce was sent")
+	}
+}
+
+func TestAgent_doRequestBootstrapServerOnboardingInfoSigned(t *testing.T) {
+	manufacturerCert, manufacturerKey := newTestCertificate(t, "manufacturer", nil, nil)
+	ownerCert, ownerKey := newTestCertificate(t, "owner", nil, nil)
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input InputJSON
+		_ = json.NewDecoder(r.Body).Decode(&input)
+		voucher := newTestVoucher("my-serial-number", ownerCert)
+		voucher.IetfVoucherVoucher.Nonce = input.IetfSztpBootstrapServerInput.Nonce
+		var output BootstrapServerPostOutput
+		output.IetfSztpBootstrapServerOutput.ConveyedInformation = base64.StdEncoding.EncodeToString(newTestSignedData(t, oidContentTypeSztpConveyedInfoJSON, []byte(testConveyedInformation), ownerCert, ownerKey))
+		output.IetfSztpBootstrapServerOutput.OwnerCertificate = newTestCertificateBundle(t, ownerCert)
+		output.IetfSztpBootstrapServerOutput.OwnershipVoucher = newTestOwnershipVoucher(t, voucher, manufacturerCert, manufacturerKey)
+		body, _ := json.Marshal(output)
+		w.WriteHeader(200)
+		_, _ = fmt.Fprint(w, string(body))
+	}))
+	defer svr.Close()
+
+	a := &Agent{
+		BootstrapURL:                svr.URL,
+		SerialNumber:                "my-serial-number",
+		ManufacturerTrustAnchorCert: writeTestCertificatePEM(t, manufacturerCert),
+		HttpClient:                  &http.Client{},
+	}
+	if err := a.doRequestBootstrapServerOnboardingInfo(context.Background()); err != nil {
+		t.Fatalf("doRequestBootstrapServerOnboardingInfo() error = %v", err)
+	}
+	if a.BootstrapServerOnboardingInfo.IetfSztpConveyedInfoOnboardingInformation.Configuration != "dGVzdA==" {
+		t.Errorf("doRequestBootstrapServerOnboardingInfo() got unexpected onboarding information %v", a.BootstrapServerOnboardingInfo)
+	}
+
+	a.SetManufacturerTrustAnchorCert(writeTestCertificatePEM(t, ownerCert))
+	if err := a.doRequestBootstrapServerOnboardingInfo(context.Background()); err == nil {
+		t.Errorf("doRequestBootstrapServerOnboardingInfo() expected an error with an untrusted ownership voucher")
+	}
+}